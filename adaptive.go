@@ -0,0 +1,15 @@
+package main
+
+import "time"
+
+// Returns how long to wait before polling a host again with -adaptive: back to interval as
+// soon as its records change, otherwise twice as long as last time, up to -max-inter
+func adaptiveInterval(current, interval time.Duration, changed bool) time.Duration {
+	if changed || current < interval {
+		return interval
+	}
+	if current *= 2; current > maxInterval {
+		current = maxInterval
+	}
+	return current
+}
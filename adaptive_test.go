@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveInterval(t *testing.T) {
+	defer func(orig time.Duration) { maxInterval = orig }(maxInterval)
+	maxInterval = time.Minute
+	interval := 5 * time.Second
+
+	// unchanged lookups double the wait up to -max-inter
+	current := interval
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		if current = adaptiveInterval(current, interval, false); current != want {
+			t.Fatalf("after an unchanged lookup waited %v, want %v", current, want)
+		}
+	}
+	// a change drops straight back to -inter
+	if got := adaptiveInterval(current, interval, true); got != interval {
+		t.Errorf("after a change waited %v, want %v", got, interval)
+	}
+	// and so does a wait that was somehow shorter than -inter
+	if got := adaptiveInterval(time.Second, interval, false); got != interval {
+		t.Errorf("from 1s waited %v, want %v", got, interval)
+	}
+}
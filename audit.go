@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -audit-file, opened for appending. It is never truncated or rotated by dns-gen.
+var auditLog = struct {
+	sync.Mutex
+	f *os.File
+}{}
+
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Old     []string  `json:"old"`
+	New     []string  `json:"new"`
+	Action  string    `json:"action"`
+	Outcome string    `json:"outcome"`
+}
+
+func openAuditFile(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	auditLog.f = f
+	return nil
+}
+
+// Appends an entry for a host change and the react that handled it. Each entry is synced to
+// disk before returning.
+func audit(ev changeEvent, result reactResult) {
+	if auditLog.f == nil {
+		return
+	}
+
+	entry := auditEntry{Time: ev.At, Host: ev.Host, Old: ev.Old, New: ev.New, Outcome: "ok"}
+	var stages []string
+	for _, s := range result.Stages {
+		stages = append(stages, s.Stage)
+	}
+	if entry.Action = strings.Join(stages, ","); entry.Action == "" {
+		entry.Action = "none"
+	}
+	if err := result.Err(); err != nil {
+		entry.Outcome = err.Error()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logError("failed to encode audit entry: %v", err)
+		return
+	}
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	if _, err := auditLog.f.Write(append(line, '\n')); err != nil {
+		logError("failed to write audit entry: %v", err)
+		return
+	}
+	if err := auditLog.f.Sync(); err != nil {
+		logError("failed to sync audit file: %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Opens an -audit-file in a new temp dir. Returns its path and a func that closes and removes it.
+func setupAudit(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dns-gen-audit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "audit.log")
+	if err := openAuditFile(path); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() {
+		auditLog.f.Close()
+		auditLog.f = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// Reads every entry in the audit file at path, failing if any line isn't a whole entry
+func readAudit(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []auditEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("audit line %d isn't an entry: %v\n%s", len(entries)+1, err, s.Bytes())
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditConcurrentChanges(t *testing.T) {
+	defer resetStore()
+	path, closeAudit := setupAudit(t)
+	defer closeAudit()
+
+	q := make(chan changeEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReactor(ctx, q, func(context.Context, []changeEvent) reactResult {
+			var r reactResult
+			r.run(stageRender, func() error { return nil })
+			return r
+		})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// several monitors reporting changes at once, each host going through 0, 1, 2...
+	const hosts, changesPerHost = 8, 25
+	var wg sync.WaitGroup
+	for h := 0; h < hosts; h++ {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			var old []string
+			for i := 0; i < changesPerHost; i++ {
+				addrs := []string{fmt.Sprintf("10.0.0.%d", i)}
+				reportChange(ctx, q, host, old, addrs)
+				old = addrs
+			}
+		}(fmt.Sprintf("host%d", h))
+	}
+	wg.Wait()
+	if !eventually(func() bool { return len(readAudit(t, path)) == hosts*changesPerHost }) {
+		t.Fatalf("audited %d of %d changes", len(readAudit(t, path)), hosts*changesPerHost)
+	}
+
+	// each host's changes are audited in the order they happened
+	last := make(map[string][]string)
+	for i, e := range readAudit(t, path) {
+		if !reflect.DeepEqual(e.Old, last[e.Host]) {
+			t.Fatalf("entry %d: %s changed from %v, but its last audited addresses were %v", i+1, e.Host, e.Old, last[e.Host])
+		}
+		if e.Action != stageRender || e.Outcome != "ok" {
+			t.Errorf("entry %d: action %q, outcome %q", i+1, e.Action, e.Outcome)
+		}
+		last[e.Host] = e.New
+	}
+}
+
+func TestAuditRecordsOutcome(t *testing.T) {
+	path, closeAudit := setupAudit(t)
+	defer closeAudit()
+
+	at := time.Now().Round(0)
+	ev := changeEvent{Host: "a.example.com", Old: []string{"10.0.0.1"}, New: []string{"10.0.0.2"}, At: at}
+	var failed reactResult
+	failed.run(stageRender, func() error { return nil })
+	failed.run(stageWrite, func() error { return errors.New("disk full") })
+	audit(ev, failed)
+	audit(ev, reactResult{})
+
+	entries := readAudit(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	want := auditEntry{Time: at, Host: "a.example.com", Old: []string{"10.0.0.1"}, New: []string{"10.0.0.2"}, Action: "render,write", Outcome: "write: disk full"}
+	if e := entries[0]; !e.Time.Equal(want.Time) {
+		t.Errorf("time = %v, want %v", e.Time, want.Time)
+	} else if e.Time = want.Time; !reflect.DeepEqual(e, want) {
+		t.Errorf("got %+v, want %+v", e, want)
+	}
+	if e := entries[1]; e.Action != "none" || e.Outcome != "ok" {
+		t.Errorf("a react that did nothing was audited as action %q, outcome %q", e.Action, e.Outcome)
+	}
+}
+
+func TestAuditFileIsAppendedTo(t *testing.T) {
+	path, closeAudit := setupAudit(t)
+	defer closeAudit()
+	audit(changeEvent{Host: "a"}, reactResult{})
+	auditLog.f.Close()
+
+	// reopening, as after a restart, keeps what was there
+	if err := openAuditFile(path); err != nil {
+		t.Fatal(err)
+	}
+	audit(changeEvent{Host: "b"}, reactResult{})
+	entries := readAudit(t, path)
+	if len(entries) != 2 || entries[0].Host != "a" || entries[1].Host != "b" {
+		t.Errorf("got %+v, want a's entry followed by b's", entries)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Saves the content just written to path so it can be restored by warmStart after a restart. Only
+// -dest is cached; the files of -output aren't. The cache is replaced atomically, so a crash
+// while saving can't leave a truncated render for the next start to write to dest.
+func saveRenderCache(path string, content []byte) {
+	if renderCache == "" || path != dest {
+		return
+	}
+	if err := writeRenderCache(content); err != nil {
+		logError("error saving render cache: %v", err)
+	}
+}
+
+func writeRenderCache(content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(renderCache), "."+filepath.Base(renderCache)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), renderCache)
+}
+
+// Writes the render cached by the previous run to dest, so dest has the last known good content
+// while the first lookups are still in progress. Reactions don't replace it until every host has
+// been looked up at least once, since rendering before then would drop the hosts that haven't
+// resolved yet. Does nothing if there's no cache yet.
+func warmStart() {
+	if renderCache == "" || dest == "" {
+		return
+	}
+	content, err := ioutil.ReadFile(renderCache)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logError("error reading render cache: %v", err)
+		return
+	}
+	if _, err := writeFile(dest, content); err != nil {
+		logError("error writing cached render: %v", err)
+		return
+	}
+	store.Lock()
+	store.awaitingFirstLookups = true
+	store.Unlock()
+	logInfo("wrote cached render from %s to %s", renderCache, dest)
+}
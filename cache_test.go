@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWarmStartKeepsCacheUntilFirstLookups(t *testing.T) {
+	dir, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }} {{ .Addresses }}
+{{ end }}`)
+	defer restore()
+	origCache := renderCache
+	renderCache = filepath.Join(dir, "cache")
+	defer func() { renderCache = origCache }()
+	drainChanges()
+	defer drainChanges()
+
+	cached := "a [10.0.0.1]\nb [10.0.0.2]\n"
+	if err := ioutil.WriteFile(renderCache, []byte(cached), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registerHosts([]hostSpec{{Name: "a"}, {Name: "b"}})
+	warmStart()
+
+	// only a has been looked up, so a reaction must not replace the cached render with one
+	// missing b
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	recordLookup("a", nil)
+	react(context.Background(), nil)
+	if got, _ := ioutil.ReadFile(dest); string(got) != cached {
+		t.Fatalf("dest = %q before every host was looked up, want the cached %q", got, cached)
+	}
+	if fileExists(marker) {
+		t.Error("the command ran before every host was looked up")
+	}
+	if _, ok := nextChange(10 * time.Millisecond); ok {
+		t.Error("a react was triggered before every host was looked up")
+	}
+
+	// b's first lookup completes the set and asks for the react that replaces the cache
+	updateHost(Host{Name: "b", Addresses: []string{"10.0.0.3"}})
+	recordLookup("b", nil)
+	if _, ok := nextChange(time.Second); !ok {
+		t.Fatal("no react was triggered once every host was looked up")
+	}
+	react(context.Background(), nil)
+	want := "a [10.0.0.1]\nb [10.0.0.3]\n"
+	if got, _ := ioutil.ReadFile(dest); string(got) != want {
+		t.Errorf("dest = %q, want %q", got, want)
+	}
+	if got, _ := ioutil.ReadFile(renderCache); string(got) != want {
+		t.Errorf("cache = %q, want %q", got, want)
+	}
+	if !fileExists(marker) {
+		t.Error("the command didn't run once every host was looked up")
+	}
+}
+
+func TestSaveRenderCacheLeavesNoTempFiles(t *testing.T) {
+	dir, restore := setupOutput(t, "")
+	defer restore()
+	origCache := renderCache
+	renderCache = filepath.Join(dir, "cache")
+	defer func() { renderCache = origCache }()
+
+	saveRenderCache(dest, []byte("first"))
+	saveRenderCache(dest, []byte("second"))
+	saveRenderCache(filepath.Join(dir, "other"), []byte("other"))
+	if got, _ := ioutil.ReadFile(renderCache); string(got) != "second" {
+		t.Errorf("cache = %q, want %q", got, "second")
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "cache" && e.Name() != "test.tmpl" {
+			t.Errorf("unexpected file %s left next to the cache", e.Name())
+		}
+	}
+}
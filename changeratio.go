@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Returns the fraction of lines that differ between old and new, from 0 to 1: the larger of
+// the number of lines removed from old and the number added in new, relative to the longer of
+// the two, so replacing one line of four is 0.25. Line order is ignored.
+func changeRatio(old, new []byte) float64 {
+	oldLines, newLines := splitLines(old), splitLines(new)
+	counts := make(map[string]int, len(oldLines))
+	for _, l := range oldLines {
+		counts[string(l)]++
+	}
+	added := 0
+	for _, l := range newLines {
+		if counts[string(l)] > 0 {
+			counts[string(l)]--
+		} else {
+			added++
+		}
+	}
+	removed := 0
+	for _, n := range counts {
+		removed += n
+	}
+	total := len(oldLines)
+	if len(newLines) > total {
+		total = len(newLines)
+	}
+	if total == 0 {
+		return 0
+	}
+	changed := removed
+	if added > changed {
+		changed = added
+	}
+	return math.Min(float64(changed)/float64(total), 1)
+}
+
+// Splits content into lines, without the empty one after a final newline
+func splitLines(content []byte) [][]byte {
+	if len(content) == 0 {
+		return nil
+	}
+	return bytes.Split(bytes.TrimSuffix(content, []byte("\n")), []byte("\n"))
+}
+
+// Refuses a write that would change more of dest than -max-change-ratio allows, unless -force
+// is set. An empty or missing dest can always be written.
+func checkChangeRatio(old, new []byte) error {
+	if maxChangeRatio <= 0 || force || len(old) == 0 {
+		return nil
+	}
+	if ratio := changeRatio(old, new); ratio > maxChangeRatio {
+		return fmt.Errorf("refusing to write: %.0f%% of lines would change, more than -max-change-ratio %.0f%%; "+
+			"check the template and DNS data, or restart with -force to write it anyway", ratio*100, maxChangeRatio*100)
+	}
+	return nil
+}
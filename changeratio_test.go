@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func lines(n int, prefix string) []byte {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(prefix)
+		b.WriteString(string(rune('a' + i%26)))
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}
+
+func TestChangeRatio(t *testing.T) {
+	old := []byte("a\nb\nc\nd\n")
+	tests := []struct {
+		new  string
+		want float64
+	}{
+		{"a\nb\nc\nd\n", 0},
+		{"d\nc\nb\na\n", 0},
+		{"a\nb\nc\nx\n", 0.25},
+		{"a\nb\nc\nd", 0},
+		{"a\nb\n", 0.5},
+		{"a\nb\nc\nd\ne\nf\ng\nh\n", 0.5},
+		{"w\nx\ny\nz\n", 1},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		if got := changeRatio(old, []byte(tt.new)); got != tt.want {
+			t.Errorf("changeRatio(%q, %q) = %v, want %v", old, tt.new, got, tt.want)
+		}
+	}
+	if got := changeRatio(nil, nil); got != 0 {
+		t.Errorf("changeRatio of two empty files = %v, want 0", got)
+	}
+}
+
+func TestCheckChangeRatio(t *testing.T) {
+	origRatio, origForce := maxChangeRatio, force
+	defer func() { maxChangeRatio, force = origRatio, origForce }()
+	maxChangeRatio = 0.2
+
+	old := lines(20, "server ")
+	small := append(lines(19, "server "), []byte("server new\n")...)
+	large := lines(20, "backend ")
+	if err := checkChangeRatio(old, small); err != nil {
+		t.Errorf("a one-line change was blocked: %v", err)
+	}
+	if err := checkChangeRatio(old, large); err == nil {
+		t.Error("rewriting every line was allowed")
+	}
+	if err := checkChangeRatio(nil, large); err != nil {
+		t.Errorf("writing a missing dest was blocked: %v", err)
+	}
+	force = true
+	if err := checkChangeRatio(old, large); err != nil {
+		t.Errorf("-force did not override the check: %v", err)
+	}
+}
+
+func TestWriteFileBlocksLargeChanges(t *testing.T) {
+	_, restore := setupOutput(t, "")
+	defer restore()
+	origRatio := maxChangeRatio
+	defer func() { maxChangeRatio = origRatio }()
+	maxChangeRatio = 0.2
+
+	old := lines(20, "server ")
+	if _, err := writeFile(dest, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeFile(dest, lines(20, "backend ")); err == nil {
+		t.Error("writeFile allowed a change above -max-change-ratio")
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != string(old) {
+		t.Error("dest was changed by a blocked write")
+	}
+	if changed, err := writeFile(dest, append(lines(19, "server "), []byte("server new\n")...)); err != nil || !changed {
+		t.Errorf("a small change: writeFile = %v, %v", changed, err)
+	}
+}
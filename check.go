@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// -check, parsed; {{.}} is replaced with the path of the file to validate
+var checkTmpl *template.Template
+
+func parseCheck(s string) error {
+	t, err := template.New("check").Parse(s)
+	if err != nil {
+		return err
+	}
+	checkTmpl = t
+	return nil
+}
+
+// Runs the -check command against the rendered output in path before it replaces dest. A
+// non-zero exit means the output is rejected; the command's output is logged so the problem
+// can be found.
+func runCheck(path, dest string) error {
+	if checkTmpl == nil {
+		return nil
+	}
+	var b strings.Builder
+	if err := checkTmpl.Execute(&b, path); err != nil {
+		return fmt.Errorf("error building -check command: %v", err)
+	}
+	cs := b.String()
+
+	start := time.Now()
+	cmd := exec.Command("/bin/sh", "-c", cs)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := runWithTimeout(cmd, execTimeout); err != nil {
+		logError("check [%v] rejected the rendered output (%v) with output: %s", cs, err, out.Bytes())
+		return fmt.Errorf("rendered output failed -check, keeping the current %s", dest)
+	}
+	if debug {
+		logDebug("check [%v] passed in %v: %s", cs, time.Since(start), out.Bytes())
+	}
+	return nil
+}
+
+// Writes data to a temporary file and runs the -check command against it
+func checkCopy(data []byte, dest string) error {
+	tmp, err := ioutil.TempFile("", ".dns-gen-check-")
+	if err != nil {
+		return fmt.Errorf("error creating temp file for -check: %v", err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("error writing temp file for -check: %v", err)
+	}
+	return runCheck(tmp.Name(), dest)
+}
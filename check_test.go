@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileCheck(t *testing.T) {
+	_, restore := setupOutput(t, "")
+	defer restore()
+	defer func() { checkTmpl = nil }()
+	if err := parseCheck(`grep -q valid {{.}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := writeFile(dest, []byte("valid config\n")); err != nil {
+		t.Fatalf("output that passes -check was rejected: %v", err)
+	}
+	if _, err := writeFile(dest, []byte("broken config\n")); err == nil {
+		t.Fatal("output that fails -check was written")
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "valid config\n" {
+		t.Errorf("dest is %q after a failed check, want the previous content", got)
+	}
+	if names, _ := ioutil.ReadDir(filepath.Dir(dest)); len(names) != 2 {
+		t.Errorf("temp files were left next to dest: %v", names)
+	}
+}
+
+func TestCheckingInPlaceOverwrite(t *testing.T) {
+	defer func() { checkTmpl = nil }()
+	if err := parseCheck(`grep -q valid {{.}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkCopy([]byte("valid\n"), dest); err != nil {
+		t.Errorf("checkCopy rejected valid output: %v", err)
+	}
+	if err := checkCopy([]byte("broken\n"), dest); err == nil {
+		t.Error("checkCopy accepted output that fails the check")
+	}
+}
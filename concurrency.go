@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// a lookup waiting for a -concurrency worker
+type lookupJob struct {
+	host   hostSpec
+	result chan<- lookupResult
+}
+
+// the result of a host lookup
+type lookupResult struct {
+	addresses []string
+	err       error
+	// the lowest TTL of the records returned, if the answers had any
+	ttl      time.Duration
+	ttlKnown bool
+}
+
+// set when -concurrency is, and read by the workers started by startLookupWorkers
+var lookupJobs chan lookupJob
+
+// Starts n workers that every host lookup goes through, so that no more than n DNS lookups
+// are in progress at once no matter how many hosts are watched
+func startLookupWorkers(n int) {
+	lookupJobs = make(chan lookupJob)
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range lookupJobs {
+				job.result <- job.host.resolve()
+			}
+		}()
+	}
+}
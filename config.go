@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// groupConfig is one set of hosts in a -config file, monitored and rendered as its own group
+type groupConfig struct {
+	Name     string        `yaml:"name"`
+	Hosts    []string      `yaml:"hosts"`
+	Interval time.Duration `yaml:"interval"`
+	Template string        `yaml:"template"`
+	Dest     string        `yaml:"dest"`
+	Exec     string        `yaml:"exec"`
+	// rendered in addition to Template, from the same snapshot of the group's hosts
+	Outputs []outputConfig `yaml:"outputs"`
+	// update every output together or not at all, like -transactional
+	Transactional bool `yaml:"transactional"`
+}
+
+// outputConfig is an extra template of a group, the file it's rendered to, and a command to
+// run only when that file changed
+type outputConfig struct {
+	Template string `yaml:"template" json:"template"`
+	Dest     string `yaml:"dest" json:"dest"`
+	Exec     string `yaml:"exec" json:"exec,omitempty"`
+}
+
+type config struct {
+	// flags, without the leading dash, used when they aren't given on the command line
+	Flags  map[string]string `yaml:"flags"`
+	Groups []groupConfig     `yaml:"groups"`
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Groups) == 0 {
+		return nil, fmt.Errorf("no groups defined")
+	}
+	names := make(map[string]bool, len(cfg.Groups))
+	for i, g := range cfg.Groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("group %d has no name", i+1)
+		}
+		if names[g.Name] {
+			return nil, fmt.Errorf("duplicate group name %q", g.Name)
+		}
+		names[g.Name] = true
+		if len(g.Hosts) == 0 {
+			return nil, fmt.Errorf("group %q has no hosts", g.Name)
+		}
+	}
+	return &cfg, nil
+}
+
+// Sets each of cfg's flags on fs that wasn't already set on the command line, so the command line
+// takes precedence over the file
+func applyConfigFlags(cfg *config, fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	names := make([]string, 0, len(cfg.Flags))
+	for name := range cfg.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "config" {
+			return fmt.Errorf("flags can't set -config")
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag -%s", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, cfg.Flags[name]); err != nil {
+			return fmt.Errorf("invalid value %q for -%s: %v", cfg.Flags[name], name, err)
+		}
+	}
+	return nil
+}
@@ -2,25 +2,44 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	fsnotify "gopkg.in/fsnotify.v1"
 )
 
+// build info, set at build time with -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 var (
 	// flags
 	interval time.Duration
@@ -28,9 +47,120 @@ var (
 	tmplPath string
 	dest     string
 	debug    bool
+	validate bool
+	tmplTest string
+	printCfg bool
+	showVer  bool
+	probe    bool
+	once     bool
+	cfgPath  string
+	journal  bool
+
+	// what -once reports when it's done
+	summaryFormat string
+	summaryFile   string
+
+	// what to watch
+	recordType  string
+	hostsFile   string
+	watchFields string
+	wildcard    string
+	candidates  string
+	axfr        string
+	axfrTSIG    string
+	axfrMatch   string
+	k8sService  string
+	soaZone     string
+
+	// how to resolve
+	queryTimeout    time.Duration
+	resolverAddr    string
+	proxyURL        string
+	dot             string
+	dotServerName   string
+	quorumResolvers string
+	quorum          int
+	splitFamilies   bool
+	strictResolver  bool
+	stripZone       bool
+	preferFamily    string
+	happyEyeballs   bool
+
+	// output
+	jsonOutput     bool
+	simple         bool
+	simpleFormat   string
+	simpleSep      string
+	simplePrefix   string
+	simpleSuffix   string
+	gzipOutput     bool
+	followSymlink  bool
+	strictPerms    bool
+	maxChangeRatio float64
+	force          bool
+	funcPlugin     string
+	onEmpty        string
+	emptyTmplPath  string
+	historySize    int
+	historyTTL     time.Duration
+	maxMemoryHint  int
+	geoIPDB        string
+	renderCache    string
+	captureExec    bool
+	transactional  bool
+	sectionComment string
+
+	// when to poll
+	ttlPolling  bool
+	regenOnTTL  bool
+	adaptive    bool
+	concurrency int
+	jitter      float64
+	minInterval time.Duration
+	maxInterval time.Duration
+	minTTL      time.Duration
+
+	// when to react
+	startupDelay     time.Duration
+	startupSpread    time.Duration
+	minReactInterval time.Duration
+	debounce         time.Duration
+	debounceMax      time.Duration
+	execTimeout      time.Duration
+	execOnChangeOnly bool
+	execPerHost      bool
+	execRetries      int
+	execBackoff      time.Duration
+	execArgvJSON     string
+	execArgvRepeat   bool
+	check            string
+	checkInterval    time.Duration
+	watchDest        bool
+	guardHost        string
+	activeFile       string
+	reactLock        string
+	reactLockSkip    bool
+	reloadSignal     string
+	logFormat        string
+	shutdownTimeout  time.Duration
+
+	// reporting
+	stabilityWindow   time.Duration
+	changingThreshold int
+	flappingThreshold int
+	maskAddresses     bool
+	auditPath         string
+	publishURL        string
+	publishSubject    string
+	publishContent    bool
+	metricsAddr       string
+	statusAddr        string
+	grpcAddr          string
+
+	// -exec-argv, decoded
+	execArgv []string
 
 	wg sync.WaitGroup
-	mu sync.Mutex
 )
 
 func usage() {
@@ -44,28 +174,154 @@ Options:
 
 	fmt.Printf(`
 Arguments:
-  hostname: (required) One or more hostnames to watch for updates
+  hostname: (required unless -hosts-file, -config, -axfr, -wildcard, -k8s-service or -soa is set) One or more hostnames to watch for updates.
+            Follow a hostname with "via <server>[:port]" to resolve it with a specific nameserver,
+            with "watch <field>[,<field>...]" to override -watch-fields for it,
+            with "min-ttl <duration>" to override -min-ttl for it,
+            and with "on-empty render|keep|template" to override -on-empty for it
+
+Templates are executed with the current state of every host:
+  {{ range .Hosts }}{{ .Name }}: {{ range .Addresses }}{{ . }} {{ end }}{{ end }}
 `)
 }
 
 func parseFlags() {
 	flag.DurationVar(&interval, "inter", 5*time.Second, "interval for DNS queries")
+	flag.BoolVar(&regenOnTTL, "regen-on-ttl", false, "also look a host up again and react whenever the TTL (at least -min-inter) of its records runs out, counted from when they were first seen, running -exec even if the output hasn't changed, e.g. to refresh caches keyed on the output's age")
+	flag.DurationVar(&minTTL, "min-ttl", 0, "treat records with a shorter TTL as if it were this long when scheduling lookups with -inter-from-ttl and -regen-on-ttl, so tiny TTLs can't flood the resolver; a host can set its own with \"min-ttl DURATION\"")
+	flag.BoolVar(&ttlPolling, "inter-from-ttl", false, "refresh each host when its records' TTL expires (clamped to -min-inter and -max-inter) instead of every -inter")
+	flag.DurationVar(&minInterval, "min-inter", time.Second, "with -inter-from-ttl, the shortest time between DNS queries for a host")
+	flag.DurationVar(&maxInterval, "max-inter", 5*time.Minute, "with -inter-from-ttl or -adaptive, the longest time between DNS queries for a host")
+	flag.Float64Var(&jitter, "jitter", 0, "randomly move each host's first lookup and every later one by up to this fraction of the interval (0-1, e.g. 0.1 for ±10%), to spread queries out over time")
+	flag.IntVar(&concurrency, "concurrency", 0, "maximum number of DNS lookups in progress at once across all hosts; 0 means no limit")
+	flag.BoolVar(&adaptive, "adaptive", false, "poll each host less often while its records stay the same: the wait doubles after every unchanged lookup, up to -max-inter, and drops back to -inter when they change")
+	flag.DurationVar(&startupDelay, "startup-delay", 0, "wait this long before the first DNS query")
+	flag.DurationVar(&startupSpread, "startup-spread", 0, "spread the first lookups of all hosts evenly over this window after -startup-delay; 0 looks them all up at once")
+	flag.DurationVar(&minReactInterval, "min-react-interval", 0, "minimum time between reactions; changes that arrive sooner are collapsed into one deferred reaction")
+	flag.DurationVar(&debounce, "debounce", 0, "wait until no changes have been detected for this long before reacting, so a burst of changes causes a single reaction")
+	flag.DurationVar(&debounceMax, "render-debounce-max", 0, "with -debounce, react no later than this long after the first change of a burst, even if changes keep arriving; 0 waits for the changes to settle however long that takes")
+	flag.StringVar(&hostsFile, "hosts-file", "", "also watch the hostnames in this file, one per line (blank lines and # comments are ignored)")
+	flag.StringVar(&recordType, "type", typeHost, "record type to watch: host (A/AAAA), srv, mx, txt or cname")
+	flag.StringVar(&watchFields, "watch-fields", "", "with -type srv or mx, comma separated record fields that count as a change (srv: priority,weight,port,target; mx: preference,host)")
 	flag.StringVar(&execute, "exec", "", "command to execute when a change is detected")
+	flag.StringVar(&execArgvJSON, "exec-argv", "", `command to execute when a change is detected, as a JSON array of arguments run without a shell (e.g. ["nginx", "-s", "reload"]); with -type srv, an argument of "{{endpoints}}" expands to one host:port argument per record, and "{{addresses}}" expands to one argument per address of every host`)
+	flag.BoolVar(&execArgvRepeat, "exec-argv-repeat", false, `with -exec-argv, repeat the argument before "{{addresses}}" ahead of each address, e.g. ["cmd", "--server", "{{addresses}}"] runs cmd --server <addr1> --server <addr2>`)
+	flag.BoolVar(&execOnChangeOnly, "exec-on-change-only", true, "only run -exec when the rendered output differs from what's in dest; set to false to run it on every reaction")
+	flag.StringVar(&check, "check", "", "command that validates the rendered output before it replaces dest, with {{.}} standing for the new file (e.g. \"nginx -t -c {{.}}\"); if it fails, dest is left as it is")
+	flag.BoolVar(&execPerHost, "exec-per-host", false, "run -exec once for each host that changed, one after another, with that host's DNSGEN_HOST, DNSGEN_OLD_ADDRS and DNSGEN_NEW_ADDRS; reactions without a host change run it once")
+	flag.IntVar(&execRetries, "exec-retries", 0, "retry a failed -exec up to this many times")
+	flag.DurationVar(&execBackoff, "exec-backoff", time.Second, "how long to wait before the first -exec retry; the wait doubles after each failed attempt")
+	flag.DurationVar(&execTimeout, "exec-timeout", 0, "kill -exec, along with any processes it started, if it runs longer than this; 0 waits indefinitely")
 	flag.StringVar(&tmplPath, "tmpl", "", "if not empty, render this template to [dest | stdout]")
+	flag.BoolVar(&jsonOutput, "json", false, "instead of rendering a template, write the addresses of all hosts as JSON to [dest | stdout]")
+	flag.BoolVar(&simple, "simple", false, "instead of rendering a template, write every address formatted with -simple-format to [dest | stdout]")
+	flag.StringVar(&simpleFormat, "simple-format", "%addr%", "with -simple, the format of each address; %addr% and %host% are replaced with the address and its hostname")
+	flag.StringVar(&simpleSep, "sep", "\n", "with -simple, the separator between addresses")
+	flag.StringVar(&simplePrefix, "prefix", "", "with -simple, text written before the first address")
+	flag.StringVar(&simpleSuffix, "suffix", "", "with -simple, text written after the last address")
 	flag.StringVar(&dest, "dest", "", "if tmpl is provided, it will be rendered to dest")
+	flag.Var(&extraOutputs, "output", "tmpl=PATH,dest=PATH[,exec=CMD] another template to render to another file on every reaction, from the same snapshot of the hosts as -tmpl, and a command to run only when that file changed (repeatable)")
+	flag.BoolVar(&transactional, "transactional", false, "render and stage every output (-dest and each -output) before replacing any of them, so they're either all updated or, if one fails, all left as they were")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
+	flag.BoolVar(&journal, "journal", false, "send log messages to the systemd journal (falls back to stderr when not running under systemd)")
+	flag.BoolVar(&showVer, "version", false, "print version information and exit")
+	flag.BoolVar(&probe, "probe", false, "resolve each hostname once, print the results, and exit without rendering or running commands")
+	flag.StringVar(&cfgPath, "config", "", "YAML file defining groups of hosts, each with its own interval, template, dest and exec, and flags used when they aren't given on the command line. Groups are monitored side by side in this process; flags apply to every group, and -inter, -tmpl, -dest and -exec are defaults for groups that don't set their own")
+	flag.BoolVar(&once, "once", false, "look up every host once, render and run -exec, then exit with a status reflecting whether they succeeded")
+	flag.StringVar(&summaryFormat, "summary-format", "", "with -once, print a summary of the run, each host's addresses and errors and whether the output changed, as json or text; with -probe, print its results as json or text")
+	flag.StringVar(&summaryFile, "summary-file", "", "write the -summary-format summary to this file instead of stdout")
+	flag.BoolVar(&printCfg, "print-config", false, "print the effective configuration, including defaults, as JSON and exit")
+	flag.BoolVar(&validate, "validate", false, "parse tmpl, report any errors, and exit")
+	flag.StringVar(&tmplTest, "template-test", "", "render -tmpl against each name.json fixture in this directory, compare the output with name.golden and exit")
+	flag.StringVar(&wildcard, "wildcard", "", "parent domain of a wildcard record; react when the set of -candidates under it that resolve changes")
+	flag.StringVar(&candidates, "candidates", "", "comma-separated subdomain labels to probe under -wildcard")
+	flag.StringVar(&axfr, "axfr", "", "watch an entire zone via zone transfer, specified as zone@server[:port]")
+	flag.StringVar(&axfrTSIG, "axfr-tsig", "", "TSIG key for -axfr in [algorithm:]name:secret format (default algorithm hmac-sha256)")
+	flag.StringVar(&axfrMatch, "axfr-match", "", "if not empty, only react to zone records whose owner name matches this regular expression")
+	flag.StringVar(&k8sService, "k8s-service", "", "watch the endpoints of this Kubernetes Service (namespace/name) through the API instead of DNS; requires running in the cluster")
+	flag.StringVar(&soaZone, "soa", "", "watch the SOA record of this zone and react whenever its serial changes")
+	flag.Var(fallbacks, "fallback", "hostname=addr[,addr...] addresses to use for hostname when it doesn't resolve (repeatable)")
+	flag.StringVar(&proxyURL, "proxy", "", "socks5://host:port proxy to send DNS queries (over TCP) and health check connections through")
+	flag.DurationVar(&queryTimeout, "timeout", 2*time.Second, "give up on a DNS lookup after this long; timeouts are retried like other temporary errors")
+	flag.StringVar(&resolverAddr, "resolver", "", "send DNS queries to this nameserver (host[:port]) instead of the system's")
+	flag.StringVar(&dot, "dot", "", "resolve hostnames using DNS-over-TLS with this server (host[:port], default port 853)")
+	flag.StringVar(&dotServerName, "dot-servername", "", "server name used to verify the -dot server's certificate (default: the -dot host)")
+	flag.StringVar(&quorumResolvers, "quorum-resolvers", "", "comma-separated nameservers to query for every host; a result is only accepted if -quorum of them agree")
+	flag.IntVar(&quorum, "quorum", 0, "number of -quorum-resolvers that must agree on a host's addresses (default majority)")
+	flag.DurationVar(&stabilityWindow, "stability-window", 10*time.Minute, "how far back changes are counted to classify a host as stable, changing or flapping")
+	flag.IntVar(&changingThreshold, "changing-threshold", 1, "changes within -stability-window for a host to be reported as changing")
+	flag.IntVar(&flappingThreshold, "flapping-threshold", 5, "changes within -stability-window for a host to be reported as flapping")
+	flag.BoolVar(&maskAddresses, "mask-addresses", false, "partially mask IP addresses in log output (rendered output is not affected)")
+	flag.BoolVar(&gzipOutput, "gzip", false, "gzip-compress the output written to [dest | stdout]")
+	flag.StringVar(&sectionComment, "section-comment", "#", "what the marker lines around each {{ section }} of a template start with, i.e. the dest format's comment syntax")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "on SIGTERM or SIGINT, how long to wait for a reaction in progress to finish before exiting anyway; 0 waits indefinitely")
+	flag.StringVar(&logFormat, "log-format", logFormatText, "log output format: text, or json for one JSON object per line with level, msg and fields such as host, old, new and duration_ms")
+	flag.StringVar(&reloadSignal, "reload-signal", "SIGHUP", "signal that triggers a reload: SIGHUP, SIGUSR1, SIGUSR2 or SIGALRM")
+	flag.StringVar(&guardHost, "guard-host", "", "only render and run commands while this hostname resolves; otherwise defer until it does")
+	flag.IntVar(&historySize, "history-size", 0, "number of previous address sets to keep per host for its .History and .Draining and the history and draining template functions")
+	flag.DurationVar(&historyTTL, "history-ttl", 5*time.Minute, "how long previous address sets are kept by -history-size")
+	flag.IntVar(&maxMemoryHint, "max-memory-hint", 0, "if the heap grows beyond this many MiB, drop optional data such as address history to reduce memory use; 0 disables the check")
+	flag.StringVar(&geoIPDB, "geoip-db", "", "comma-separated MaxMind databases (e.g. GeoLite2 City and ASN) used to add the country, city and ASN of each address to the render context as .Geo")
+	flag.StringVar(&renderCache, "render-cache", "", "save each render to this file, and write the saved render to dest at startup; it is kept until every host has been looked up once")
+	flag.BoolVar(&captureExec, "capture-exec-output", false, "make the stdout of the last successful -exec available to templates as .LastExecOutput")
+	flag.BoolVar(&watchDest, "watch-dest", false, "watch each dest and regenerate it as soon as anything but dns-gen changes or removes it")
+	flag.DurationVar(&checkInterval, "check-interval", 0, "if set, periodically re-render and regenerate dest if it no longer matches (e.g. after being edited out of band)")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9100) at /metrics")
+	flag.StringVar(&statusAddr, "status-addr", "", "serve /healthz (200 once the output has been rendered or what is monitored has been found, with every host resolved to at least one address and no output's last render failing; 503 otherwise), /status (JSON) and /version on this address")
+	flag.StringVar(&grpcAddr, "grpc-addr", "", "serve a gRPC API on this address (e.g. :9200) whose Watch call streams each change to a host's addresses, see dnsgen.proto")
+	flag.StringVar(&publishURL, "publish", "", "NATS server URL (e.g. nats://localhost:4222) to publish change events to")
+	flag.StringVar(&publishSubject, "publish-subject", "dns-gen.changes", "subject that -publish events are published on")
+	flag.BoolVar(&publishContent, "publish-content", false, "with -publish, also publish the rendered content each time it changes")
+	flag.StringVar(&activeFile, "active-when-file-exists", "", "only render and run commands while this file exists; DNS is still monitored, and the current state is rendered as soon as it appears")
+	flag.StringVar(&onEmpty, "on-empty", onEmptyRender, "what to do when a host resolves to no addresses: render (the empty set), keep (its last addresses), or template (render -empty-tmpl instead); a host can set its own with \"on-empty MODE\"")
+	flag.StringVar(&emptyTmplPath, "empty-tmpl", "", "with -on-empty template, the template rendered while any host set to it has no addresses")
+	flag.StringVar(&funcPlugin, "func-plugin", "", "load additional template functions from this Go plugin (.so exporting Funcs() template.FuncMap; requires a cgo-enabled build on Linux, macOS or FreeBSD)")
+	flag.StringVar(&reactLock, "react-lock", "", "name (or path) of a file lock held while rendering and running commands, to serialize instances on the same host")
+	flag.BoolVar(&reactLockSkip, "react-lock-skip", false, "skip the reaction instead of waiting when -react-lock is held by another instance")
+	flag.StringVar(&auditPath, "audit-file", "", "append a JSON line describing every DNS change and the action taken to this file")
+	flag.BoolVar(&splitFamilies, "split-families", false, "resolve A and AAAA records with separate concurrent queries")
+	flag.BoolVar(&strictResolver, "strict-resolver", false, "treat a host as temporarily unresolvable if its A or AAAA query fails, instead of using the other family's addresses (implies -split-families)")
+	flag.BoolVar(&stripZone, "strip-zone", false, "remove zone identifiers from IPv6 addresses (fe80::1%eth0 becomes fe80::1) before comparing and rendering them; by default they are kept")
+	flag.StringVar(&preferFamily, "prefer-family", preferNone, "with -split-families, list this family's addresses first: none, ipv4 or ipv6")
+	flag.BoolVar(&happyEyeballs, "happy-eyeballs", false, "with -split-families and -prefer-family, interleave the two families starting with the preferred one")
+	flag.BoolVar(&followSymlink, "follow-symlink", false, "if dest is a symlink, update the file it points to instead of replacing the link with a regular file")
+	flag.BoolVar(&strictPerms, "strict-perms", false, "fail the write if dest's owner can't be preserved (by default this is skipped, e.g. when not running as root)")
+	flag.Float64Var(&maxChangeRatio, "max-change-ratio", 0, "refuse to write dest if more than this fraction of its lines (0-1) would change; 0 disables the check")
+	flag.BoolVar(&force, "force", false, "write dest even if the change exceeds -max-change-ratio")
 	flag.Usage = usage
 	flag.Parse()
 }
 
 var Funcs = template.FuncMap{
-	"lookupHost": safeLookup,
-	"add":        add,
-	"addf":       addf,
-	"mul":        mul,
-	"mulf":       mulf,
-	"div":        div,
-	"divf":       divf,
+	"lookupHost":      safeLookup,
+	"zoneRecords":     zoneRecords,
+	"lookupSOA":       safeLookupSOA,
+	"wildcardMembers": wildcardMembers,
+	"history":         addressHistory,
+	"draining":        draining,
+	"add":             add,
+	"addf":            addf,
+	"mul":             mul,
+	"mulf":            mulf,
+	"div":             div,
+	"divf":            divf,
+	"ringFor":         ringFor,
+	"ringGet":         ringGet,
+	"difference":      difference,
+	"intersection":    intersection,
+	"union":           union,
+	"sortByRTT":       sortByRTT,
+	"shuffle":         shuffle,
+	"shuffleSeed":     shuffleSeed,
+	"padLeft":         padLeft,
+	"padRight":        padRight,
+	"columns":         columns,
+	"countFamily":     countFamily,
+	"familyCounts":    familyCounts,
+	"seq":             seq,
+	"until":           until,
+	"count":           count,
+	"section":         noSection,
 }
 
 func add(i, j int) int {
@@ -92,8 +348,238 @@ func divf(i, j float64) float64 {
 	return i / j
 }
 
+// integers from start to end inclusive, or none if end < start
+func seq(start, end int) []int {
+	if end < start {
+		return []int{}
+	}
+	s := make([]int, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		s = append(s, i)
+	}
+	return s
+}
+
+// integers from 0 to n-1
+func until(n int) []int {
+	return seq(0, n-1)
+}
+
+// number of items, e.g. a host's addresses
+func count(items []string) int {
+	return len(items)
+}
+
+// Returns the sorted, deduplicated elements of items for which keep returns true
+func setOf(items []string, keep func(string) bool) []string {
+	seen := make(map[string]bool, len(items))
+	out := []string{}
+	for _, item := range items {
+		if !seen[item] && keep(item) {
+			out = append(out, item)
+		}
+		seen[item] = true
+	}
+	sortAddresses(out)
+	return out
+}
+
+func contains(items []string) func(string) bool {
+	m := make(map[string]bool, len(items))
+	for _, item := range items {
+		m[item] = true
+	}
+	return func(s string) bool { return m[s] }
+}
+
+// elements of a that are not in b
+func difference(a, b []string) []string {
+	inB := contains(b)
+	return setOf(a, func(s string) bool { return !inB(s) })
+}
+
+// elements in both a and b
+func intersection(a, b []string) []string {
+	return setOf(a, contains(b))
+}
+
+// elements in either a or b
+func union(a, b []string) []string {
+	return setOf(append(append([]string{}, a...), b...), func(string) bool { return true })
+}
+
+// picked once per process, so separate dns-gen instances order the same addresses differently
+var shuffleProcessSeed = time.Now().UnixNano()
+
+// Returns a copy of addrs in random order. The order only changes when the set of addresses
+// does, so rendering the same data again outside a reaction, e.g. to check for drift, produces
+// the same output. Reactions give a set that changed a new order, see shuffleSeeds.
+func shuffle(addrs []string) []string {
+	return shuffleRender(nil, addrs)
+}
+
+// Like shuffle, ordering addrs by the seed seeds has for their set
+func shuffleRender(seeds *shuffleSeeds, addrs []string) []string {
+	h := fnv.New64a()
+	for _, addr := range sortedCopy(addrs) {
+		h.Write([]byte(addr))
+		h.Write([]byte{0})
+	}
+	return shuffleSeed(shuffleProcessSeed^seeds.seedFor(h.Sum64()), addrs)
+}
+
+// shuffleSeeds are the seeds shuffle orders address sets by during a render, keyed by a hash of
+// the set. A set that was in the last render to change an output keeps the seed it had then, so
+// its order only changes along with the set; any other set gets a seed from fresh.
+type shuffleSeeds struct {
+	fresh int64
+	// the seeds of the last render that changed an output; never modified
+	prev map[uint64]int64
+
+	mu sync.Mutex
+	// the seeds this render used
+	used map[uint64]int64
+}
+
+func newShuffleSeeds(prev map[uint64]int64) *shuffleSeeds {
+	return &shuffleSeeds{prev: prev, used: make(map[uint64]int64)}
+}
+
+// Keeps the seeds of the last render for the sets this render didn't use, as when it only
+// rendered some of the sections of a template
+func (s *shuffleSeeds) keepPrevious() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for set, seed := range s.prev {
+		if _, ok := s.used[set]; !ok {
+			s.used[set] = seed
+		}
+	}
+}
+
+func (s *shuffleSeeds) seedFor(set uint64) int64 {
+	if s == nil {
+		return int64(set)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seed, ok := s.prev[set]
+	if !ok {
+		seed = s.fresh ^ int64(set)
+	}
+	s.used[set] = seed
+	return seed
+}
+
+// Like shuffle, but the order is determined by seed and the set of addresses alone
+func shuffleSeed(seed int64, addrs []string) []string {
+	return shuffleWith(rand.New(rand.NewSource(seed)), sortedCopy(addrs))
+}
+
+func shuffleWith(r *rand.Rand, addrs []string) []string {
+	out := append([]string{}, addrs...)
+	r.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out
+}
+
+func sortedCopy(addrs []string) []string {
+	out := append([]string{}, addrs...)
+	sortAddresses(out)
+	return out
+}
+
+// pads s with spaces on the left to width characters
+func padLeft(width int, s string) string {
+	return fmt.Sprintf("%*s", width, s)
+}
+
+// pads s with spaces on the right to width characters
+func padRight(width int, s string) string {
+	return fmt.Sprintf("%-*s", width, s)
+}
+
+// Aligns rows into columns separated by a single space, one row per line. rows is either a
+// [][]string, or a []string where each element is a row of tab-separated fields.
+func columns(rows interface{}) (string, error) {
+	var table [][]string
+	switch r := rows.(type) {
+	case [][]string:
+		table = r
+	case []string:
+		for _, line := range r {
+			table = append(table, strings.Split(line, "\t"))
+		}
+	default:
+		return "", fmt.Errorf("columns: expected [][]string or []string, got %T", rows)
+	}
+
+	var widths []int
+	for _, row := range table {
+		for i, field := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(field); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	lines := make([]string, len(table))
+	for i, row := range table {
+		fields := make([]string, len(row))
+		for j, field := range row {
+			if j < len(row)-1 {
+				field = padRight(widths[j], field)
+			}
+			fields[j] = field
+		}
+		lines[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// FamilyCounts is the number of addresses of each IP family
+type FamilyCounts struct {
+	IPv4 int
+	IPv6 int
+}
+
+// counts IPv4 and IPv6 addresses, ignoring anything that doesn't parse as an IP
+func familyCounts(addrs []string) FamilyCounts {
+	var c FamilyCounts
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		if ip.To4() != nil {
+			c.IPv4++
+		} else {
+			c.IPv6++
+		}
+	}
+	return c
+}
+
+// counts the addresses of a single family: "ipv4" or "ipv6" (or "4"/"6")
+func countFamily(family string, addrs []string) (int, error) {
+	c := familyCounts(addrs)
+	switch strings.ToLower(family) {
+	case "ipv4", "v4", "4":
+		return c.IPv4, nil
+	case "ipv6", "v6", "6":
+		return c.IPv6, nil
+	}
+	return 0, fmt.Errorf("countFamily: unknown address family %q", family)
+}
+
 func safeLookup(hn string) []string {
-	ips, _ := lookup(hn)
+	ips, _ := lookupAddrs(hn)
+	ips, _ = withFallback(hn, ips)
 	return ips
 }
 
@@ -101,13 +587,51 @@ func newTemplate(name string) *template.Template {
 	return template.New(name).Funcs(Funcs)
 }
 
-// Executes a template located at path with the specified data
-func execTemplateFile(path string, data interface{}) ([]byte, error) {
+var undefinedFunc = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+func funcNames() []string {
+	names := make([]string, 0, len(Funcs))
+	for name := range Funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parses the template located at path without executing it. Calls to unknown functions are
+// reported along with the list of functions that are available.
+func validateTemplate(path string) error {
+	_, err := newTemplate(filepath.Base(path)).ParseFiles(path)
+	if err == nil {
+		return nil
+	}
+	if m := undefinedFunc.FindStringSubmatch(err.Error()); m != nil {
+		return fmt.Errorf("%v (unknown function %q; available functions: %s)", err, m[1], strings.Join(funcNames(), ", "))
+	}
+	return err
+}
+
+// Executes the template at path with ctx, with shuffle seeded by ctx's seeds
+func (ctx RenderContext) execTemplateFile(path string) ([]byte, error) {
+	tmpl, err := ctx.parseTemplateFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return execTemplate(tmpl, ctx)
+}
+
+// Parses the template at path to be executed with ctx: shuffle is seeded by ctx's seeds, and
+// section renders with ctx, recording the sections in rec unless it's nil
+func (ctx RenderContext) parseTemplateFile(path string, rec *sectionRecorder) (*template.Template, error) {
 	tmpl, err := newTemplate(filepath.Base(path)).ParseFiles(path)
 	if err != nil {
 		return nil, err
 	}
-	return execTemplate(tmpl, data)
+	tmpl.Funcs(template.FuncMap{
+		"shuffle": func(addrs []string) []string { return shuffleRender(ctx.seeds, addrs) },
+		"section": sectionFunc(tmpl, ctx, rec),
+	})
+	return tmpl, nil
 }
 
 // Helper for execTemplateFile and execTemplateString - actually executes the template
@@ -124,246 +648,1692 @@ func sameLength(a, b []string) bool {
 }
 
 func sameContents(a, b []string) bool {
-	return reflect.DeepEqual(a, b)
+	return reflect.DeepEqual(normalizeRecords(a), normalizeRecords(b))
 }
 
-func equivalent(a, b []string) bool {
-	return sameLength(a, b) && sameContents(a, b)
+var domainName = regexp.MustCompile(`^[A-Za-z0-9_*-]+(\.[A-Za-z0-9_-]+)*\.?$`)
+
+// Normalizes the way record values are written so that cosmetic differences don't count as
+// changes. The target name of a record (the last field, for CNAME, NS, MX and SRV data) is
+// lowercased and its trailing dot removed. IP addresses are left as they are.
+func normalizeRecord(record string) string {
+	if recordType == typeTXT {
+		// TXT data is free-form, so case matters
+		return record
+	}
+	fields := strings.Fields(record)
+	if len(fields) == 0 {
+		return record
+	}
+	name := fields[len(fields)-1]
+	if net.ParseIP(name) != nil || !domainName.MatchString(name) {
+		return record
+	}
+	fields[len(fields)-1] = strings.TrimSuffix(strings.ToLower(name), ".")
+	return strings.Join(fields, " ")
 }
 
-func lookup(hostname string) ([]string, error) {
-	addresses, err := net.LookupHost(hostname)
-	if err != nil {
-		return nil, err
+func normalizeRecords(records []string) []string {
+	if records == nil {
+		return nil
 	}
-	sort.Strings(addresses)
-	return addresses, nil
+	normalized := make([]string, len(records))
+	for i, r := range records {
+		normalized[i] = normalizeRecord(r)
+	}
+	return normalized
 }
 
-func react() {
-	mu.Lock()
-	defer mu.Unlock()
+func equivalent(a, b []string) bool {
+	return sameLength(a, b) && sameContents(a, b)
+}
 
-	if tmplPath != "" {
-		start := time.Now()
-		content, err := execTemplateFile(tmplPath, nil)
-		if err != nil {
-			log.Printf("[ERROR] failed to execute template: %v\n", err)
-		} else if debug {
-			log.Printf("[DEBUG] template [%s] generated in %v\n", tmplPath, time.Since(start))
+// Removes the zone from scoped IPv6 addresses (fe80::1%eth0 becomes fe80::1), since the zone
+// names an interface on whichever host did the lookup rather than anything about the address
+func stripZones(addresses []string) []string {
+	stripped := make([]string, 0, len(addresses))
+	seen := make(map[string]bool, len(addresses))
+	for _, addr := range addresses {
+		if i := strings.IndexByte(addr, '%'); i >= 0 && net.ParseIP(addr[:i]) != nil {
+			addr = addr[:i]
 		}
-		if err := writeFile(content); err != nil {
-			log.Printf("[ERROR] failed to write output file: %v\n", err)
+		if !seen[addr] {
+			seen[addr] = true
+			stripped = append(stripped, addr)
 		}
 	}
-	if execute != "" {
-		if err := runCmd(execute); err != nil {
-			log.Printf("[ERROR] failed to execute command: %v\n", err)
-		}
+	sortAddresses(stripped)
+	return stripped
+}
+
+// Hides the host part of an IP address: the last octet of IPv4 addresses and everything
+// after the /64 prefix of IPv6 addresses. Anything else is returned unchanged.
+func maskAddr(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
 	}
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.x", v4[0], v4[1], v4[2])
+	}
+	return fmt.Sprintf("%x:%x:%x:%x::x", uint16(ip[0])<<8|uint16(ip[1]), uint16(ip[2])<<8|uint16(ip[3]),
+		uint16(ip[4])<<8|uint16(ip[5]), uint16(ip[6])<<8|uint16(ip[7]))
 }
 
-func runCmd(cs string) error {
-	start := time.Now()
-	if debug {
-		log.Printf("[DEBUG] running command [%v]...", cs)
+// Returns addresses as they should appear in log messages, masked if -mask-addresses is set
+func logAddrs(addresses []string) []string {
+	if !maskAddresses {
+		return addresses
 	}
-	cmd := exec.Command("/bin/sh", "-c", cs)
-	out, err := cmd.CombinedOutput()
-	log.Printf("[INFO] ran command [%v] in %v.\n", cs, time.Since(start))
-	if err != nil {
-		log.Printf("[ERROR] command [%v] failed with output: %s\n", cs, out)
-	} else if debug {
-		log.Printf("[DEBUG] output: %s\n", out)
+	masked := make([]string, len(addresses))
+	for i, addr := range addresses {
+		masked[i] = maskAddr(addr)
 	}
-	return err
+	return masked
 }
 
-func writeFile(content []byte) error {
-	if dest == "" {
-		os.Stdout.Write(content)
-		return nil
+// Looks up hostname's monitored records using the package-level resolver
+func lookup(ctx context.Context, hostname string) ([]string, error) {
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	return resolver.Lookup(ctx, hostname)
+}
+
+// Looks up hostname's addresses, regardless of -type
+func lookupAddrs(hostname string) ([]string, error) {
+	ctx, cancel := queryContext(context.Background())
+	defer cancel()
+	return lookupWith(ctx, systemResolver, hostname)
+}
+
+// Returns a context for a single lookup that expires after -timeout
+func queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(parent)
 	}
+	return context.WithTimeout(parent, queryTimeout)
+}
 
-	start := time.Now()
-	// write to a temp file first so we can copy it into place with a single atomic operation
-	tmp, err := ioutil.TempFile("", fmt.Sprintf("dns-gen-%d", time.Now().UnixNano()))
-	defer func() {
-		tmp.Close()
-		os.Remove(tmp.Name())
-	}()
+// Reports whether a lookup error is likely to go away on its own, such as a timeout, so the
+// known addresses should be kept and the lookup retried
+func isTemporary(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var de *net.DNSError
+	return errors.As(err, &de) && de.Temporary()
+}
+
+func lookupWith(ctx context.Context, r *net.Resolver, hostname string) ([]string, error) {
+	if splitFamilies || strictResolver {
+		return lookupFamilies(ctx, r, hostname)
+	}
+	addresses, err := r.LookupHost(ctx, hostname)
 	if err != nil {
-		return fmt.Errorf("error creating temp file: %v", err)
+		return nil, err
 	}
+	sortAddresses(addresses)
+	return addresses, nil
+}
+
+// Sorts IP addresses numerically, IPv4 before IPv6, so that 10.0.0.2 comes before 10.0.0.10.
+// Anything that isn't an IP address sorts after them as a string.
+func sortAddresses(addresses []string) {
+	sort.SliceStable(addresses, func(i, j int) bool { return addressLess(addresses[i], addresses[j]) })
+}
 
-	if _, err := tmp.Write(content); err != nil {
-		return fmt.Errorf("error writing temp file: %v", err)
+// Reports whether address x sorts before y in sortAddresses' order
+func addressLess(x, y string) bool {
+	a, b := net.ParseIP(x), net.ParseIP(y)
+	switch {
+	case a == nil && b == nil:
+		return x < y
+	case a == nil || b == nil:
+		return b == nil
+	}
+	if a4, b4 := a.To4() != nil, b.To4() != nil; a4 != b4 {
+		return a4
 	}
+	return bytes.Compare(a.To16(), b.To16()) < 0
+}
 
-	var oldContent []byte
-	if fi, err := os.Stat(dest); err == nil {
-		// set permissions and ownership on new file
-		if err := tmp.Chmod(fi.Mode()); err != nil {
-			return fmt.Errorf("error setting file permissions: %v", err)
-		}
-		if err := tmp.Chown(int(fi.Sys().(*syscall.Stat_t).Uid), int(fi.Sys().(*syscall.Stat_t).Gid)); err != nil {
-			return fmt.Errorf("error changing file owner: %v", err)
-		}
-		if oldContent, err = ioutil.ReadFile(dest); err != nil {
-			return fmt.Errorf("error comparing old version: %v", err)
-		}
+// stages of the react pipeline, in the order they run
+const (
+	stageLock   = "lock"
+	stageGuard  = "guard"
+	stageRender = "render"
+	stageWrite  = "write"
+	stageExec   = "exec"
+)
+
+type stageResult struct {
+	Stage    string
+	Err      error
+	Duration time.Duration
+}
+
+// reactResult describes which stages of a react ran and how each of them went
+type reactResult struct {
+	Stages []stageResult
+	// whether the write stage changed a dest
+	Changed bool
+}
+
+// Runs a single stage and records its outcome. Returns false if the stage failed, in which
+// case the remaining stages should be skipped.
+func (r *reactResult) run(stage string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	r.Stages = append(r.Stages, stageResult{Stage: stage, Err: err, Duration: time.Since(start)})
+	if stage == stageRender {
+		observeRender(time.Since(start))
+	}
+	if err != nil {
+		logError("%s failed: %v", stage, err)
 	}
+	return err == nil
+}
 
-	if bytes.Compare(oldContent, content) != 0 {
-		if err = os.Rename(tmp.Name(), dest); err != nil {
-			return fmt.Errorf("error creating output file: %v", err)
+// Err returns the error from the stage that failed, if any
+func (r *reactResult) Err() error {
+	for _, s := range r.Stages {
+		if s.Err != nil {
+			return fmt.Errorf("%s: %v", s.Stage, s.Err)
 		}
-		log.Printf("output file [%s] created in %v\n", dest, time.Since(start))
 	}
-
 	return nil
 }
 
-func monitor(hostname string, interval time.Duration) {
-	defer wg.Done()
-
-	var knownAddresses []string
-	sigCh := newSigChan()
-	ticker := time.NewTicker(interval)
-	first := time.After(0)
+// Reacts for the command line group
+func react(ctx context.Context, changes []changeEvent) reactResult {
+	return commandLineGroup().react(ctx, changes)
+}
 
-	refresh := func() error {
-		start := time.Now()
-		addresses, err := lookup(hostname)
-		if err != nil {
-			if de, ok := err.(*net.DNSError); ok && de.Temporary() {
-				log.Printf("temporary error resolving hostname: %v. will retry...\n", hostname)
-				return err
-			} else {
-				log.Printf("error resolving hostname: %v\n", err)
-			}
+// Renders each of the group's outputs from one snapshot of its hosts, so they all agree, writes
+// them to their dests, and runs the commands of the outputs that changed followed by the group's
+// command, stopping at the first stage that fails so a broken render is never written and a
+// failed write never triggers a command. Only one react runs at a time for a group: while
+// monitoring, they are all run by the group's reactor.
+func (g *group) react(ctx context.Context, changes []changeEvent) reactResult {
+	var result reactResult
+	if !isActive() {
+		if debug {
+			logDebug("standby, not rendering or running commands")
+		}
+		return result
+	}
+	if reactLock != "" {
+		var release func()
+		ok := result.run(stageLock, func() (err error) {
+			release, err = acquireReactLock()
+			return err
+		})
+		if !ok {
+			return result
 		}
+		defer release()
+	}
+	if guardHost != "" && !result.run(stageGuard, checkGuard) {
+		return result
+	}
+	if awaitingFirstLookups() {
 		if debug {
-			log.Printf("[DEBUG] lookup [%s] => %v in %v\n", hostname, addresses, time.Since(start))
+			logDebug("keeping the cached render until every host has been looked up")
 		}
-		if !equivalent(knownAddresses, addresses) {
-			log.Printf("[CHANGE] %s %s -> %s", hostname, knownAddresses, addresses)
-			knownAddresses = addresses
-			react()
+		return result
+	}
+	rc := g.snapshot()
+	// address sets that changed since the last render get a new order
+	rc.seeds.fresh = time.Now().UnixNano()
+	write := g.writeEach
+	if g.transactional {
+		write = g.writeTogether
+	}
+	changedOutputs, ok := write(&result, rc)
+	result.Changed = len(changedOutputs) > 0
+	if result.Changed {
+		g.setShuffleSeeds(rc.seeds.used)
+	}
+	if !ok {
+		return result
+	}
+	// an output's own command runs only when that output changed
+	for _, o := range changedOutputs {
+		if !o.exec.empty() && !result.run(stageExec, func() error { return runExec(ctx, o.exec, changes, rc.Hosts) }) {
+			return result
 		}
-		return nil
 	}
-
-	for {
-		select {
-		case <-first:
-			refresh()
-		case <-ticker.C:
-			refresh()
-		case sig := <-sigCh:
-			if sig == syscall.SIGTERM || sig == syscall.SIGINT {
-				ticker.Stop()
-				return
-			}
+	if len(g.outputs) > 0 && !result.Changed && execOnChangeOnly && !anyExpired(changes) {
+		if debug {
+			logDebug("output unchanged, not running the command")
 		}
+		return result
 	}
-}
-
-// watch for changes to the template file and regenerate
-func watchTemplate() {
-	defer wg.Done()
-	if tmplPath == "" {
-		return
+	if !g.exec.empty() {
+		result.run(stageExec, func() error { return runExec(ctx, g.exec, changes, rc.Hosts) })
 	}
+	return result
+}
 
-	watch, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatalf("error watching template file for changes: %v\n", err)
+// Runs c for a reaction to changes: once, or with -exec-per-host once per changed
+// host with just that host's changes. Each run gets its own -exec-timeout and retries. With
+// -exec-per-host every host is tried even if an earlier one failed, and the first error is
+// returned. hosts are the ones the reaction rendered, for -exec-argv placeholders and the
+// command's environment.
+func runExec(ctx context.Context, c command, changes []changeEvent, hosts []Host) error {
+	byHost := changesByHost(changes)
+	if !execPerHost || len(byHost) == 0 {
+		return runCmdWithRetries(ctx, c, changes, hosts)
 	}
-	go func() {
-		defer watch.Close()
-		sigCh := newSigChan()
-		for {
-			select {
-			case ev := <-watch.Events:
-				if ev.Name == tmplPath && (ev.Op == fsnotify.Write || ev.Op == fsnotify.Create) {
-					log.Printf("[CHANGE] template changed: %#v\n", ev)
-					react()
-				}
-			case err := <-watch.Errors:
-				log.Printf("watch error: %v", err)
-			case <-sigCh:
-				return
+	var first error
+	failed := 0
+	for _, hostChanges := range byHost {
+		if err := runCmdWithRetries(ctx, c, hostChanges, hosts); err != nil {
+			if first == nil {
+				first = fmt.Errorf("%s: %v", hostChanges[0].Host, err)
 			}
+			failed++
 		}
-	}()
-
-	err = watch.Add(filepath.Dir(tmplPath))
-	if err != nil {
-		log.Fatalf("error watching template file for changes: %v\n", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if failed > 1 {
+		return fmt.Errorf("command failed for %d of %d hosts, first %v", failed, len(byHost), first)
 	}
+	return first
 }
 
-func newSigChan() <-chan os.Signal {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
-	return ch
+// Groups changes by host in the order the hosts first changed, leaving out the ones without a host
+func changesByHost(changes []changeEvent) [][]changeEvent {
+	var groups [][]changeEvent
+	index := make(map[string]int)
+	for _, c := range changes {
+		if c.Host == "" {
+			continue
+		}
+		i, ok := index[c.Host]
+		if !ok {
+			i = len(groups)
+			index[c.Host] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], c)
+	}
+	return groups
 }
 
-// watch for signals
-// trigger refresh on sighup
-// exit on sigterm
-func watchSignals() {
-	defer wg.Done()
-	sigCh := newSigChan()
-	for sig := range sigCh {
-		if sig == syscall.SIGTERM || sig == syscall.SIGINT {
-			return
-		} else if sig == syscall.SIGHUP {
-			log.Printf("[CHANGE] caught SIGHUP\n")
-			react()
-		} else {
-			log.Printf("signal caught: %v\n", sig)
+// Renders each of the group's outputs from rc and writes it to its dest, one after another,
+// stopping at the first that fails. Returns the outputs that changed and whether they were all
+// written.
+func (g *group) writeEach(result *reactResult, rc RenderContext) ([]output, bool) {
+	var changedOutputs []output
+	for _, o := range g.outputs {
+		var content []byte
+		var sections *sectionState
+		var err error
+		ok := result.run(stageRender, func() error {
+			content, sections, err = g.renderOutput(o, rc)
+			return err
+		})
+		if !ok {
+			setRenderError(o.name(), err)
+			return changedOutputs, false
+		}
+		if debug {
+			logDebug("output generated in %v", result.Stages[len(result.Stages)-1].Duration)
+		}
+		var changed bool
+		if !result.run(stageWrite, func() error {
+			changed, err = writeFile(o.dest, content)
+			return err
+		}) {
+			g.setSections(o, nil)
+			setRenderError(o.name(), err)
+			return changedOutputs, false
+		}
+		g.setSections(o, sections)
+		if changed {
+			changedOutputs = append(changedOutputs, o)
 		}
+		rendered(o, content, changed)
 	}
+	return changedOutputs, true
 }
 
-func monitorHosts(interval time.Duration, execute string) {
-	log.Printf("[INFO] Monitoring %d hosts every %v: %+v", flag.NArg(), interval, flag.Args())
-	for _, hostname := range flag.Args() {
-		wg.Add(1)
-		go monitor(hostname, interval)
+// Renders every one of the group's outputs from rc and stages it next to its dest before
+// replacing any of them, so that if a render, a -check or a write fails, every dest is left as
+// it was. Once they're all staged each is renamed into place; a dest that can only be
+// overwritten in place is written then too. Returns the outputs that changed and whether they
+// were all written.
+func (g *group) writeTogether(result *reactResult, rc RenderContext) ([]output, bool) {
+	contents := make([][]byte, len(g.outputs))
+	sections := make([]*sectionState, len(g.outputs))
+	for i, o := range g.outputs {
+		var err error
+		if !result.run(stageRender, func() error {
+			contents[i], sections[i], err = g.renderOutput(o, rc)
+			return err
+		}) {
+			setRenderError(o.name(), err)
+			return nil, false
+		}
+	}
+	var changedOutputs []output
+	changed := make([]bool, len(g.outputs))
+	ok := result.run(stageWrite, func() error {
+		pending := make([]*pendingWrite, 0, len(g.outputs))
+		defer func() {
+			for _, w := range pending {
+				w.discard()
+			}
+		}()
+		for i, o := range g.outputs {
+			w, err := stageFile(o.dest, contents[i])
+			if err != nil {
+				setRenderError(o.name(), err)
+				return fmt.Errorf("%s: %v", o.name(), err)
+			}
+			pending = append(pending, w)
+		}
+		for i, w := range pending {
+			var err error
+			if changed[i], err = w.commit(); err != nil {
+				setRenderError(g.outputs[i].name(), err)
+				return fmt.Errorf("%s: %v", g.outputs[i].name(), err)
+			}
+			if changed[i] {
+				changedOutputs = append(changedOutputs, g.outputs[i])
+			}
+		}
+		return nil
+	})
+	if !ok {
+		// some dests may have been replaced already
+		for _, o := range g.outputs {
+			g.setSections(o, nil)
+		}
+		return changedOutputs, false
+	}
+	for i, content := range contents {
+		g.setSections(g.outputs[i], sections[i])
+		rendered(g.outputs[i], content, changed[i])
 	}
+	return changedOutputs, true
 }
 
-func noHostsProvided() bool {
-	return flag.NArg() == 0
+// Records a successful render of o that was written out, publishing it with -publish-content
+// if it changed the dest
+func rendered(o output, content []byte, changed bool) {
+	setLastRender(o.name(), time.Now())
+	if publishContent && changed {
+		publish(publishEvent{Type: "render", Content: content})
+	}
 }
 
-func templateMissing() bool {
-	if tmplPath != "" {
-		if _, err := os.Stat(tmplPath); os.IsNotExist(err) {
-			return true
+// Runs c's shell command with /bin/sh, or its argv directly. changes are the host changes that
+// led to this run and are passed to the command in its environment.
+func runCmd(c command, changes []changeEvent, hosts []Host) error {
+	start := time.Now()
+	// the command as it's logged: an argv expanded with addresses has them masked with
+	// -mask-addresses
+	cs := c.shell
+	cmd := exec.Command("/bin/sh", "-c", cs)
+	if len(c.argv) > 0 {
+		argv := expandArgv(c.argv, hosts)
+		if len(argv) == 0 {
+			return fmt.Errorf("%q expanded to an empty command line", c.argv)
 		}
+		cs = strings.Join(logAddrs(argv), " ")
+		cmd = exec.Command(argv[0], argv[1:]...)
 	}
-	return false
+	if debug {
+		logDebug("running command [%v]...", cs)
+	}
+	cmd.Env = append(os.Environ(), execEnv(changes, hosts)...)
+	// run the command in its own process group, so a timeout kills anything it started too
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := runWithTimeout(cmd, execTimeout)
+	observeCommand(time.Since(start))
+	out := append(stdout.Bytes(), stderr.Bytes()...)
+	logEvent(levelInfo, logFields{"command": cs, "duration_ms": durationMS(time.Since(start))}, "ran command [%v] in %v.", cs, time.Since(start))
+	if err != nil {
+		logEvent(levelError, logFields{"command": cs, "error": err.Error()}, "command [%v] failed with output: %s", cs, out)
+		return err
+	}
+	if debug {
+		logDebug("output: %s", out)
+	}
+	if captureExec {
+		setExecOutput(stdout.Bytes())
+	}
+	return nil
+}
+
+// upper bound on the delay between -exec retries
+const maxExecBackoff = 5 * time.Minute
+
+// Runs the command, retrying up to -exec-retries times if it fails, waiting -exec-backoff
+// before the first retry and twice as long before each one after that. Stops retrying if
+// ctx is cancelled.
+func runCmdWithRetries(ctx context.Context, c command, changes []changeEvent, hosts []Host) error {
+	err := runCmd(c, changes, hosts)
+	if err == nil || execRetries <= 0 {
+		return err
+	}
+
+	backoff := execBackoff
+	for attempt := 1; attempt <= execRetries; attempt++ {
+		logInfo("retrying command in %v (attempt %d of %d)", backoff, attempt, execRetries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			logInfo("shutting down, not retrying command")
+			return err
+		}
+		if err = runCmd(c, changes, hosts); err == nil {
+			return nil
+		}
+		if backoff *= 2; backoff > maxExecBackoff {
+			backoff = maxExecBackoff
+		}
+	}
+	logError("command still failing after %d retries, giving up", execRetries)
+	return err
+}
+
+// Runs cmd, killing its whole process group if it hasn't finished after timeout. A timeout of
+// 0 waits indefinitely.
+func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return cmd.Wait()
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// Extra environment variables for -exec:
+//
+//	DNSGEN_CHANGED_HOSTS: comma separated hosts whose addresses changed
+//	DNSGEN_HOST, DNSGEN_OLD_ADDRS, DNSGEN_NEW_ADDRS: when a single host changed, its name and
+//	  its comma separated addresses before and after
+//	DNSGEN_ENDPOINTS: with -type srv, the space separated host:port of every SRV record of the
+//	  rendered hosts
+func execEnv(changes []changeEvent, rendered []Host) []string {
+	var hosts []string
+	first := make(map[string]changeEvent)
+	last := make(map[string]changeEvent)
+	for _, c := range changes {
+		if c.Host == "" {
+			continue
+		}
+		if _, ok := first[c.Host]; !ok {
+			hosts = append(hosts, c.Host)
+			first[c.Host] = c
+		}
+		last[c.Host] = c
+	}
+	env := []string{"DNSGEN_CHANGED_HOSTS=" + strings.Join(hosts, ",")}
+	if len(hosts) == 1 {
+		// several changes to the same host in one batch are reported as a single change
+		h := hosts[0]
+		env = append(env, "DNSGEN_HOST="+h,
+			"DNSGEN_OLD_ADDRS="+strings.Join(first[h].Old, ","),
+			"DNSGEN_NEW_ADDRS="+strings.Join(last[h].New, ","))
+	}
+
+	if recordType == typeSRV {
+		var endpoints []string
+		for _, h := range rendered {
+			endpoints = append(endpoints, srvEndpoints(h.Addresses)...)
+		}
+		env = append(env, "DNSGEN_ENDPOINTS="+strings.Join(endpoints, " "))
+	}
+	return env
+}
+
+// Returns the -exec-argv command line with its placeholder arguments expanded from hosts:
+//
+//	{{endpoints}}: one argument per -type srv endpoint (host:port)
+//	{{addresses}}: one argument per address of every host. With -exec-argv-repeat, the
+//	  argument before it is repeated ahead of each address, so ["cmd", "--server",
+//	  "{{addresses}}"] runs cmd --server 10.0.0.1 --server 10.0.0.2, and just cmd when there
+//	  are no addresses.
+func expandArgv(argv []string, hosts []Host) []string {
+	var expanded []string
+	for i, arg := range argv {
+		switch arg {
+		case "{{endpoints}}":
+			for _, h := range hosts {
+				expanded = append(expanded, srvEndpoints(h.Addresses)...)
+			}
+		case "{{addresses}}":
+			addresses := allAddresses(hosts)
+			if !execArgvRepeat || i == 0 {
+				expanded = append(expanded, addresses...)
+				continue
+			}
+			// the argument before this one was added as is; it's repeated per address instead
+			repeat := expanded[len(expanded)-1]
+			expanded = expanded[:len(expanded)-1]
+			for _, addr := range addresses {
+				expanded = append(expanded, repeat, addr)
+			}
+		default:
+			expanded = append(expanded, arg)
+		}
+	}
+	return expanded
+}
+
+// Reports whether arg is one that expandArgv replaces
+func isArgvPlaceholder(arg string) bool {
+	return arg == "{{endpoints}}" || arg == "{{addresses}}"
+}
+
+// Returns every host's addresses in order, leaving out any already returned for an earlier host
+func allAddresses(hosts []Host) []string {
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, h := range hosts {
+		for _, addr := range h.Addresses {
+			if !seen[addr] {
+				seen[addr] = true
+				addresses = append(addresses, addr)
+			}
+		}
+	}
+	return addresses
+}
+
+// Replaces dest with content, unless it already holds exactly that. With -gzip, dest holds
+// gzip-compressed content. Compression isn't byte-for-byte stable, so change detection compares
+// the uncompressed content instead. Reports whether dest changed; output written to stdout (an
+// empty dest) always counts as a change.
+func writeFile(dest string, content []byte) (bool, error) {
+	w, err := stageFile(dest, content)
+	if err != nil {
+		return false, err
+	}
+	return w.commit()
+}
+
+// pendingWrite is content for dest that stageFile has prepared and checked, waiting for commit
+// to put it in place
+type pendingWrite struct {
+	dest, target  string
+	content, data []byte
+	start         time.Time
+	// the temp file next to target holding data, when it differs from what's in target
+	tmp *os.File
+	// target's directory isn't writable, so commit overwrites it in place
+	inPlace bool
+}
+
+// Prepares content to replace dest: writes it to a temp file next to dest and runs
+// -max-change-ratio and -check against it, so that commit only has to rename it into place.
+// Call discard instead of commit to drop it.
+func stageFile(dest string, content []byte) (w *pendingWrite, err error) {
+	w = &pendingWrite{dest: dest, content: content, data: content, start: time.Now()}
+	if gzipOutput {
+		if w.data, err = gzipBytes(content); err != nil {
+			return nil, fmt.Errorf("error compressing output: %v", err)
+		}
+	}
+	if dest == "" {
+		return w, nil
+	}
+
+	if w.target, err = destTarget(dest); err != nil {
+		return nil, err
+	}
+
+	// write to a temp file next to dest first so we can move it into place with a single atomic
+	// rename, which only works within a filesystem
+	tmp, err := ioutil.TempFile(filepath.Dir(w.target), ".dns-gen-")
+	if os.IsPermission(err) {
+		logWarn("unable to create temp file next to %s, overwriting it in place: %v", w.target, err)
+		w.inPlace = true
+		return w, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer func() {
+		if w == nil || w.tmp == nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(w.data); err != nil {
+		return nil, fmt.Errorf("error writing temp file: %v", err)
+	}
+
+	var oldContent []byte
+	if fi, err := os.Stat(w.target); err == nil {
+		// set permissions and ownership on new file
+		if err := tmp.Chmod(fi.Mode()); err != nil {
+			return nil, fmt.Errorf("error setting file permissions: %v", err)
+		}
+		// unprivileged users can't give files away, so keeping the owner is best-effort unless
+		// -strict-perms is set
+		if err := tmp.Chown(int(fi.Sys().(*syscall.Stat_t).Uid), int(fi.Sys().(*syscall.Stat_t).Gid)); err != nil {
+			if strictPerms {
+				return nil, fmt.Errorf("error changing file owner: %v", err)
+			} else if debug {
+				logDebug("unable to preserve the owner of %s: %v", w.target, err)
+			}
+		}
+		if oldContent, err = readOldContent(w.target); err != nil {
+			return nil, err
+		}
+	}
+
+	if bytes.Compare(oldContent, content) != 0 {
+		if err := checkChangeRatio(oldContent, content); err != nil {
+			return nil, err
+		}
+		if err := runCheck(tmp.Name(), dest); err != nil {
+			return nil, err
+		}
+		// flush the content to disk before the rename makes it visible, so a crash can't leave
+		// dest empty or truncated
+		if err := tmp.Sync(); err != nil {
+			return nil, fmt.Errorf("error syncing temp file: %v", err)
+		}
+		w.tmp = tmp
+	}
+	return w, nil
+}
+
+// Puts the staged content in place. Reports whether dest changed.
+func (w *pendingWrite) commit() (bool, error) {
+	if w.dest == "" {
+		os.Stdout.Write(w.data)
+		return true, nil
+	}
+	if w.inPlace {
+		return overwriteFile(w.dest, w.target, w.content, w.data, w.start)
+	}
+	if w.tmp == nil {
+		saveRenderCache(w.dest, w.content)
+		return false, nil
+	}
+	defer w.discard()
+	// recorded first, as watchers can see the rename before it returns
+	recordWrite(w.target, w.data)
+	if err := os.Rename(w.tmp.Name(), w.target); err != nil {
+		return false, fmt.Errorf("error creating output file: %v", err)
+	}
+	syncDir(filepath.Dir(w.target))
+	logEvent(levelInfo, logFields{"dest": w.dest, "duration_ms": durationMS(time.Since(w.start))}, "output file [%s] created in %v", w.dest, time.Since(w.start))
+	saveRenderCache(w.dest, w.content)
+	return true, nil
+}
+
+// Removes the staged temp file, if it hasn't been renamed into place
+func (w *pendingWrite) discard() {
+	if w.tmp != nil {
+		w.tmp.Close()
+		os.Remove(w.tmp.Name())
+		w.tmp = nil
+	}
+}
+
+// Flushes a directory's entries to disk so a rename into it survives a crash. Not every
+// filesystem supports this, so failures are only logged.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err == nil {
+		err = d.Sync()
+		d.Close()
+	}
+	if err != nil && debug {
+		logDebug("unable to sync directory %s: %v", dir, err)
+	}
+}
+
+// Returns the uncompressed content currently in target
+func readOldContent(target string) ([]byte, error) {
+	old, err := ioutil.ReadFile(target)
+	if err != nil {
+		return nil, fmt.Errorf("error comparing old version: %v", err)
+	}
+	if gzipOutput {
+		// an unreadable old file is simply treated as changed
+		old, _ = gunzipBytes(old)
+	}
+	return old, nil
+}
+
+// Writes data straight into target (dest's target), for when its directory isn't writable and
+// there's nowhere to put a temp file. This isn't atomic, but works as long as target itself is
+// writable.
+func overwriteFile(dest, target string, content, data []byte, start time.Time) (bool, error) {
+	if _, err := os.Stat(target); err == nil {
+		oldContent, err := readOldContent(target)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(oldContent, content) {
+			saveRenderCache(dest, content)
+			return false, nil
+		}
+		if err := checkChangeRatio(oldContent, content); err != nil {
+			return false, err
+		}
+	}
+	if checkTmpl != nil {
+		// there's no room next to target, so the check gets a copy in the system temp directory
+		if err := checkCopy(data, dest); err != nil {
+			return false, err
+		}
+	}
+	recordWrite(target, data)
+	if err := ioutil.WriteFile(target, data, 0644); err != nil {
+		return false, fmt.Errorf("error writing output file: %v", err)
+	}
+	saveRenderCache(dest, content)
+	logEvent(levelInfo, logFields{"dest": dest, "duration_ms": durationMS(time.Since(start))}, "output file [%s] overwritten in %v", dest, time.Since(start))
+	return true, nil
+}
+
+func gzipBytes(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// Returns the path that writeFile should replace for dest. By default this is dest itself, so a
+// symlink at dest is replaced by a regular file. With -follow-symlink, the link is resolved
+// and the file it points to is replaced instead, leaving the link intact.
+func destTarget(dest string) (string, error) {
+	if !followSymlink {
+		return dest, nil
+	}
+	fi, err := os.Lstat(dest)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return dest, nil
+	}
+	target, err := filepath.EvalSymlinks(dest)
+	if os.IsNotExist(err) {
+		// dangling link - create the file it points to
+		if target, err = os.Readlink(dest); err == nil && !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(dest), target)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("error resolving symlink: %v", err)
+	}
+	return target, nil
+}
+
+// delay before restarting a monitor that panicked, doubled on each restart
+const (
+	monitorRestartBackoff    = time.Second
+	maxMonitorRestartBackoff = time.Minute
+)
+
+func monitor(ctx context.Context, host hostSpec, interval time.Duration) {
+	defer wg.Done()
+
+	// kept across restarts so a restarted monitor doesn't report a spurious change
+	var known knownRecords
+	backoff := monitorRestartBackoff
+	for restarts := 0; ; {
+		setMonitorState(host.Name, true, restarts)
+		if !watchHost(ctx, host, interval, &known, restarts == 0) {
+			setMonitorState(host.Name, false, restarts)
+			return
+		}
+		restarts++
+		setMonitorState(host.Name, false, restarts)
+		countMonitorRestart(host.Name)
+		logError("restarting monitor for %s in %v (restart #%d)", host.Name, backoff, restarts)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxMonitorRestartBackoff {
+			backoff = maxMonitorRestartBackoff
+		}
+	}
+}
+
+// knownRecords is what a monitor last reported for its host
+type knownRecords struct {
+	addresses []string
+	// the addresses are the host's -fallback ones
+	fallback bool
+}
+
+// Polls host until ctx is cancelled. A panic while polling is recovered and logged, and reported by
+// returning true so the monitor can be restarted.
+func watchHost(ctx context.Context, host hostSpec, interval time.Duration, known *knownRecords, initial bool) (panicked bool) {
+	hostname := host.Name
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			stack := make([]byte, 4096)
+			stack = stack[:runtime.Stack(stack, false)]
+			logError("monitor for %s panicked: %v\n%s", hostname, r, stack)
+			panicked = true
+		}
+	}()
+
+	delay := startupDelay + host.StartOffset
+	if !initial {
+		delay = 0
+	}
+	first := time.After(delay + initialJitter(interval))
+	// with -adaptive, how long until the next lookup and whether the last one found a change
+	current, changed := interval, false
+
+	// the last lookup, whose TTL schedules the next one with -inter-from-ttl
+	var last lookupResult
+
+	refresh := func() error {
+		changed = false
+		start := time.Now()
+		last = host.lookup()
+		addresses, err := last.addresses, last.err
+		observeLookup(hostname, time.Since(start), err)
+		recordLookup(hostname, err)
+		if err != nil {
+			if isTemporary(err) {
+				logEvent(levelError, logFields{"host": hostname, "error": err.Error()}, "temporary error resolving %s: %v. will retry...", hostname, err)
+			} else {
+				logEvent(levelError, logFields{"host": hostname, "error": err.Error()}, "error resolving %s: %v", hostname, err)
+			}
+			// a failed lookup says nothing about the host's addresses, so keep the known ones
+			// unless the host has -fallback addresses to switch to
+			if _, ok := fallbacks[hostname]; !ok {
+				return err
+			}
+		}
+		if debug {
+			logEvent(levelDebug, logFields{"host": hostname, "new": logAddrs(addresses), "duration_ms": durationMS(time.Since(start))},
+				"lookup [%s] => %v in %v", hostname, logAddrs(addresses), time.Since(start))
+		}
+		addresses, usingFallback := withFallback(hostname, addresses)
+		if len(addresses) == 0 && host.onEmpty() == onEmptyKeep && len(known.addresses) > 0 {
+			logInfo("%s resolved to no addresses, keeping %s", hostname, logAddrs(known.addresses))
+			return nil
+		}
+		setEmpty(host, len(addresses) == 0)
+		// switching to or from the fallback is a change even if the addresses are the same
+		if !equivalent(projectRecords(known.addresses, host.Fields), projectRecords(addresses, host.Fields)) || usingFallback != known.fallback {
+			var note string
+			if usingFallback {
+				note = " (fallback)"
+			}
+			logEvent(levelChange, logFields{"host": hostname, "old": logAddrs(known.addresses), "new": logAddrs(addresses), "fallback": usingFallback},
+				"%s %s %s -> %s%s", hostname, recordTypeLabel(), logAddrs(known.addresses), logAddrs(addresses), note)
+			publish(publishEvent{Type: "change", Host: hostname, Old: known.addresses, New: addresses})
+			old := known.addresses
+			known.addresses, known.fallback = addresses, usingFallback
+			updateHost(Host{Name: hostname, Addresses: addresses, UsingFallback: usingFallback})
+			recordHistory(hostname, addresses)
+			if old != nil {
+				recordChange(hostname)
+			}
+			reportChange(ctx, host.Changes, hostname, old, addresses)
+			changed = true
+		} else if !equivalent(known.addresses, addresses) {
+			// only unwatched fields changed: keep the new records for the next render without reacting
+			if debug {
+				logDebug("%s %s %s -> %s (unwatched fields only)", hostname, recordTypeLabel(), logAddrs(known.addresses), logAddrs(addresses))
+			}
+			known.addresses = addresses
+			updateHost(Host{Name: hostname, Addresses: addresses, UsingFallback: usingFallback})
+		}
+		return nil
+	}
+
+	// with -regen-on-ttl, fires when the TTL of the records runs out, counted from when they were
+	// first seen: later lookups returning the same records don't put it off
+	var expired <-chan time.Time
+	scheduleExpiry := func() {
+		if regenOnTTL && last.err == nil && last.ttlKnown && (expired == nil || changed) {
+			expired = ttlExpiry(last.ttl)
+		}
+	}
+
+	for {
+		select {
+		case <-first:
+			refresh()
+			scheduleExpiry()
+			// restart the ticker so later lookups keep the first one's offset
+			ticker.Reset(withJitter(nextInterval(last, interval)))
+		case <-ticker.C:
+			refresh()
+			switch {
+			case ttlPolling:
+				ticker.Reset(withJitter(nextInterval(last, interval)))
+			case adaptive:
+				next := adaptiveInterval(current, interval, changed)
+				if next != current && debug {
+					logDebug("polling %s every %v", hostname, next)
+				}
+				current = next
+				ticker.Reset(withJitter(current))
+			case jitter > 0:
+				ticker.Reset(withJitter(interval))
+			}
+			scheduleExpiry()
+		case <-expired:
+			expired = nil
+			logEvent(levelInfo, logFields{"host": hostname}, "TTL of %s expired, regenerating", hostname)
+			// look the host up again so the react renders fresh records
+			refresh()
+			scheduleExpiry()
+			reportExpiry(ctx, host.Changes, hostname)
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// watch for changes to the template files of groups and have the groups rendering them
+// regenerate, until ctx is cancelled
+func watchTemplates(ctx context.Context, groups []*group) {
+	defer wg.Done()
+	queues := make(map[string][]chan changeEvent)
+	for _, g := range groups {
+		for _, o := range g.outputs {
+			if o.tmpl != "" {
+				queues[o.tmpl] = append(queues[o.tmpl], g.changes)
+			}
+		}
+	}
+	watchFiles(ctx, "template", queues, false)
+}
+
+// Watches the files in queues and asks the reactors reading a file's queues for a react when it
+// changes, until ctx is cancelled. Changes writeFile made are ignored, so a file that is both
+// rendered and watched doesn't set off a loop of reactions. A file that is removed only counts as
+// changed with removal set; otherwise the change is the file that replaces it.
+func watchFiles(ctx context.Context, what string, queues map[string][]chan changeEvent, removal bool) {
+	if len(queues) == 0 {
+		return
+	}
+	watch, err := fsnotify.NewWatcher()
+	if err != nil {
+		logFatal("error watching %s file for changes: %v", what, err)
+	}
+	go func() {
+		defer watch.Close()
+		for {
+			select {
+			case ev := <-watch.Events:
+				fileQueues, ok := queues[ev.Name]
+				if !ok {
+					continue
+				}
+				// editors that save by renaming a new file over the template report a Rename or
+				// Remove of it, and then a Create once the new file is in place. The directory
+				// is watched, so the Create arrives without re-adding anything; a rename that
+				// has already completed is picked up here.
+				if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && !removal {
+					if _, err := os.Stat(ev.Name); err != nil {
+						continue
+					}
+				}
+				if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+					if isOwnWrite(ev.Name) {
+						if debug {
+							logDebug("ignoring event caused by our own write: %#v", ev)
+						}
+						continue
+					}
+					logChange("%s changed: %#v", what, ev)
+					for _, q := range fileQueues {
+						requestReact(q)
+					}
+				}
+			case err := <-watch.Errors:
+				logError("watch error: %v", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	dirs := make(map[string]bool)
+	for path := range queues {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watch.Add(dir); err != nil {
+			logFatal("error watching %s file for changes: %v", what, err)
+		}
+	}
+}
+
+// signals that may be used with -reload-signal
+var reloadSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"ALRM": syscall.SIGALRM,
+}
+
+// signal that triggers a reload, set by -reload-signal
+var reloadSig = syscall.SIGHUP
+
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := reloadSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// Sets up -reload-signal. When another signal is chosen, SIGHUP is ignored rather than
+// left to its default action of terminating the process.
+func setupReloadSignal(name string) error {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return err
+	}
+	reloadSig = sig
+	if reloadSig != syscall.SIGHUP {
+		signal.Ignore(syscall.SIGHUP)
+	}
+	return nil
+}
+
+// watch for signals. this is the only place signals are received while monitoring, so each
+// one is acted on exactly once:
+// trigger refresh on the reload signal (sighup by default)
+// shut down on sigterm/sigint by cancelling the context shared by every monitor
+func watchSignals(shutdown context.CancelFunc) {
+	defer wg.Done()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, reloadSig, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	for sig := range sigCh {
+		if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+			logInfo("caught %v, shutting down", sig)
+			shutdown()
+			return
+		} else if sig == reloadSig {
+			logChange("caught %v", sig)
+			triggerReact()
+		} else {
+			logInfo("signal caught: %v", sig)
+		}
+	}
+}
+
+// Resolves every host once and prints the results to w, as a table or with -summary-format json
+// as a JSON document. Returns false if any host failed to resolve.
+func probeHosts(w io.Writer, hosts []hostSpec) bool {
+	ok := true
+	results := make([]hostSummary, 0, len(hosts))
+	for _, h := range hosts {
+		r := h.lookup()
+		hs := hostSummary{Name: h.Name, Addresses: r.addresses}
+		if hs.Addresses == nil {
+			hs.Addresses = []string{}
+		}
+		if r.err != nil {
+			ok = false
+			hs.Error = r.err.Error()
+		}
+		results = append(results, hs)
+	}
+	if summaryFormat == "json" {
+		b, _ := json.MarshalIndent(struct {
+			Hosts []hostSummary `json:"hosts"`
+		}{results}, "", "  ")
+		fmt.Fprintln(w, string(b))
+		return ok
+	}
+	header := "ADDRESSES"
+	if recordType != typeHost {
+		header = recordTypeLabel() + " RECORDS"
+	}
+	rows := [][]string{{"HOST", header}}
+	for _, hs := range results {
+		if hs.Error != "" {
+			rows = append(rows, []string{hs.Name, "error: " + hs.Error})
+			continue
+		}
+		rows = append(rows, []string{hs.Name, strings.Join(hs.Addresses, ",")})
+	}
+	table, _ := columns(rows)
+	fmt.Fprintln(w, table)
+	return ok
+}
+
+func noHostsProvided() bool {
+	return len(hostArgs()) == 0 && axfr == "" && wildcard == "" && k8sService == "" && soaZone == ""
+}
+
+func monitorZoneSOA(ctx context.Context, interval time.Duration) {
+	if soaZone == "" {
+		return
+	}
+	logInfo("Monitoring SOA serial of %s every %v", soaZone, interval)
+	wg.Add(1)
+	go monitorSOA(ctx, soaZone, interval)
+}
+
+func monitorK8s(ctx context.Context, interval time.Duration) {
+	if k8sService == "" {
+		return
+	}
+	namespace, name, err := parseK8sService(k8sService)
+	if err != nil {
+		logFatal("invalid -k8s-service: %v", err)
+	}
+	c, err := newK8sClient()
+	if err != nil {
+		logFatal("%v", err)
+	}
+	logInfo("Monitoring endpoints of service %s/%s every %v", namespace, name, interval)
+	registerHosts([]hostSpec{{Name: namespace + "/" + name}})
+	wg.Add(1)
+	go monitorK8sService(ctx, c, namespace, name, interval)
+}
+
+func monitorCandidates(ctx context.Context, interval time.Duration) {
+	if wildcard == "" {
+		return
+	}
+	parent := strings.Trim(strings.TrimPrefix(wildcard, "*."), ".")
+	names := parseCandidates(candidates)
+	if len(names) == 0 {
+		logFatal("-wildcard requires -candidates")
+	}
+	logInfo("Probing %d candidates under %s every %v", len(names), parent, interval)
+	wg.Add(1)
+	go monitorWildcard(ctx, parent, names, interval)
+}
+
+func monitorAXFR(ctx context.Context, interval time.Duration) {
+	if axfr == "" {
+		return
+	}
+	zone, server, err := parseAXFR(axfr)
+	if err != nil {
+		logFatal("invalid -axfr: %v", err)
+	}
+	if axfrTSIG != "" {
+		if _, _, _, err := parseTSIG(axfrTSIG); err != nil {
+			logFatal("invalid -axfr-tsig: %v", err)
+		}
+	}
+	var match *regexp.Regexp
+	if axfrMatch != "" {
+		if match, err = regexp.Compile(axfrMatch); err != nil {
+			logFatal("invalid -axfr-match: %v", err)
+		}
+	}
+	logInfo("Monitoring zone %s via %s every %v", zone, server, interval)
+	wg.Add(1)
+	go monitorZone(ctx, zone, server, match, interval)
+}
+
+// Returns the first template of groups that doesn't exist, if any
+func templateMissing(groups []*group) string {
+	for _, path := range groupTemplates(groups) {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+	}
+	return ""
+}
+
+func setupLogging() {
+	if err := validateLogFormat(); err != nil {
+		logFatal("%v", err)
+	}
+	if logFormat == logFormatJSON {
+		// every event carries its own time field
+		log.SetFlags(0)
+	}
+	if !journal {
+		return
+	}
+	w, err := newJournalWriter()
+	if err != nil {
+		logError("systemd journal unavailable, logging to stderr: %v", err)
+		return
+	}
+	journalLog = w
+}
+
+// flags whose values are replaced by -print-config
+var secretFlags = map[string]bool{"axfr-tsig": true}
+
+// flags holding URLs, whose userinfo -print-config replaces
+var urlFlags = map[string]bool{"proxy": true, "publish": true}
+
+// a group of a -config file as -print-config shows it, with the defaults it takes from the
+// command line filled in
+type printedGroup struct {
+	Name          string         `json:"name"`
+	Hosts         []string       `json:"hosts"`
+	Interval      string         `json:"interval"`
+	Template      string         `json:"template,omitempty"`
+	Dest          string         `json:"dest,omitempty"`
+	Exec          string         `json:"exec,omitempty"`
+	Outputs       []outputConfig `json:"outputs,omitempty"`
+	Transactional bool           `json:"transactional,omitempty"`
+}
+
+// Prints every flag of fs with its effective value (defaults included), the hostname arguments,
+// and the groups of cfg, if any, to w
+func printConfig(w io.Writer, fs *flag.FlagSet, cfg *config) error {
+	flags := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch {
+		case v == "":
+		case secretFlags[f.Name]:
+			v = "<redacted>"
+		case urlFlags[f.Name]:
+			v = redactURL(v)
+		}
+		flags[f.Name] = v
+	})
+	printed := struct {
+		Flags  map[string]string `json:"flags"`
+		Hosts  []string          `json:"hosts"`
+		Groups []printedGroup    `json:"groups,omitempty"`
+	}{Flags: flags, Hosts: hostArgs()}
+	if cfg != nil {
+		for _, gc := range cfg.Groups {
+			pg := printedGroup{
+				Name:          gc.Name,
+				Hosts:         gc.Hosts,
+				Interval:      interval.String(),
+				Template:      tmplPath,
+				Dest:          dest,
+				Exec:          execute,
+				Outputs:       gc.Outputs,
+				Transactional: transactional || gc.Transactional,
+			}
+			if gc.Interval != 0 {
+				pg.Interval = gc.Interval.String()
+			}
+			if gc.Template != "" {
+				pg.Template = gc.Template
+			}
+			if gc.Dest != "" {
+				pg.Dest = gc.Dest
+			}
+			if gc.Exec != "" {
+				pg.Exec = gc.Exec
+			}
+			printed.Groups = append(printed.Groups, pg)
+		}
+	}
+	out, err := json.MarshalIndent(printed, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// Hides the userinfo of a URL, which may hold a password or token
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		// an unparseable value may still contain credentials
+		return "<redacted>"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	return u.String()
+}
+
+func versionString() string {
+	return fmt.Sprintf("dns-gen %s (commit %s, built %s)", version, commit, buildDate)
 }
 
 func main() {
 	parseFlags()
-	if noHostsProvided() {
-		log.Printf("No hostnames provided")
+	if showVer {
+		fmt.Println(versionString())
+		return
+	}
+	var cfg *config
+	if cfgPath != "" {
+		var err error
+		if cfg, err = loadConfig(cfgPath); err != nil {
+			logFatal("invalid -config %s: %v", cfgPath, err)
+		}
+		if err := applyConfigFlags(cfg, flag.CommandLine); err != nil {
+			logFatal("invalid -config %s: %v", cfgPath, err)
+		}
+	}
+	if hostsFile != "" {
+		if err := loadHostsFile(hostsFile); err != nil {
+			logFatal("unable to read -hosts-file: %v", err)
+		}
+	}
+	if printCfg {
+		if err := printConfig(os.Stdout, flag.CommandLine, cfg); err != nil {
+			logFatal("failed to print config: %v", err)
+		}
+		return
+	}
+	setupLogging()
+	if cfg != nil {
+		if len(hostArgs()) > 0 {
+			logFatal("hostnames can't be given as arguments or with -hosts-file when using -config")
+		}
+		if once || probe || renderCache != "" || k8sService != "" {
+			logFatal("-once, -probe, -render-cache and -k8s-service can't be used with -config")
+		}
+	}
+	if funcPlugin != "" {
+		if err := loadFuncPlugin(funcPlugin); err != nil {
+			logFatal("failed to load -func-plugin: %v", err)
+		}
+	}
+	if err := validateRecordType(); err != nil {
+		logFatal("%v", err)
+	}
+	if proxyURL != "" {
+		if err := setupProxy(proxyURL); err != nil {
+			logFatal("invalid -proxy: %v", err)
+		}
+	}
+	if dot != "" && resolverAddr != "" {
+		logFatal("-dot and -resolver are mutually exclusive")
+	}
+	if dot != "" {
+		setupDoT(dot, dotServerName)
+	}
+	setupResolver(resolverAddr)
+	if publishURL != "" {
+		if err := setupPublisher(publishURL); err != nil {
+			logFatal("invalid -publish: %v", err)
+		}
+	}
+	if geoIPDB != "" {
+		if err := openGeoDBs(geoIPDB); err != nil {
+			logFatal("invalid -geoip-db: %v", err)
+		}
+	}
+	if auditPath != "" {
+		if err := openAuditFile(auditPath); err != nil {
+			logFatal("invalid -audit-file: %v", err)
+		}
+	}
+	if err := setupReloadSignal(reloadSignal); err != nil {
+		logFatal("invalid -reload-signal: %v", err)
+	}
+	if quorumResolvers != "" {
+		if err := setupQuorum(quorumResolvers); err != nil {
+			logFatal("invalid -quorum-resolvers: %v", err)
+		}
+	}
+	if err := validatePreferFamily(); err != nil {
+		logFatal("%v", err)
+	}
+	if ttlPolling && (minInterval <= 0 || minInterval > maxInterval) {
+		logFatal("-min-inter must be positive and no greater than -max-inter")
+	}
+	if jitter < 0 || jitter >= 1 {
+		logFatal("-jitter must be at least 0 and less than 1")
+	}
+	if adaptive && ttlPolling {
+		logFatal("-adaptive and -inter-from-ttl are mutually exclusive")
+	}
+	if changingThreshold < 1 || flappingThreshold < changingThreshold {
+		logFatal("-changing-threshold must be at least 1 and no greater than -flapping-threshold")
+	}
+	if validate {
+		if tmplPath == "" {
+			logFatal("-validate requires -tmpl")
+		}
+		if err := validateTemplate(tmplPath); err != nil {
+			logFatal("invalid template: %v", err)
+		}
+		logInfo("template [%s] is valid", tmplPath)
+		return
+	}
+	if tmplTest != "" {
+		if tmplPath == "" {
+			logFatal("-template-test requires -tmpl")
+		}
+		passed, err := runTemplateTests(tmplTest)
+		if err != nil {
+			logFatal("-template-test: %v", err)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if cfg == nil && noHostsProvided() {
+		logError("No hostnames provided")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	if templateMissing() {
-		log.Fatalf("temlpate file not found: %v\n", tmplPath)
+	if concurrency < 0 {
+		logFatal("-concurrency must not be negative")
+	} else if concurrency > 0 {
+		startLookupWorkers(concurrency)
+	}
+
+	if summaryFormat != "" && summaryFormat != "json" && summaryFormat != "text" {
+		logFatal("-summary-format must be json or text")
+	}
+	if summaryFormat != "" && !once && !probe {
+		logFatal("-summary-format requires -once or -probe")
+	}
+	if summaryFile != "" && !once {
+		logFatal("-summary-file requires -once")
+	}
+	if probe {
+		hosts, err := parseHosts(hostArgs())
+		if err != nil {
+			logFatal("invalid hostname arguments: %v", err)
+		}
+		if !probeHosts(os.Stdout, hosts) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := validateOnEmpty(); err != nil {
+		logFatal("%v", err)
+	}
+
+	if commandLineOutput().modes() > 1 {
+		logFatal("-tmpl, -json and -simple are mutually exclusive")
+	}
+	if minTTL < 0 {
+		logFatal("-min-ttl must not be negative")
+	}
+
+	if execArgvJSON != "" {
+		if execute != "" {
+			logFatal("-exec and -exec-argv are mutually exclusive")
+		}
+		if err := json.Unmarshal([]byte(execArgvJSON), &execArgv); err != nil || len(execArgv) == 0 {
+			logFatal("-exec-argv must be a non-empty JSON array of strings")
+		}
+		if isArgvPlaceholder(execArgv[0]) {
+			logFatal("-exec-argv must start with the command to run, not %s", execArgv[0])
+		}
+	}
+	if check != "" {
+		if err := parseCheck(check); err != nil {
+			logFatal("invalid -check: %v", err)
+		}
+	}
+	groups := []*group{commandLineGroup()}
+	if cfg != nil {
+		var err error
+		if groups, err = configGroups(cfg); err != nil {
+			logFatal("invalid -config %s: %v", cfgPath, err)
+		}
+		reactorQueues = nil
+		for _, g := range groups {
+			reactorQueues = append(reactorQueues, g.changes)
+		}
+	} else {
+		hosts, err := parseHosts(hostArgs())
+		if err != nil {
+			logFatal("invalid hostname arguments: %v", err)
+		}
+		groups[0].hosts = hosts
+	}
+	if err := checkDests(groups); err != nil {
+		logFatal("%v", err)
+	}
+	registerOutputs(groupOutputNames(groups))
+	if path := templateMissing(groups); path != "" {
+		logFatal("temlpate file not found: %v", path)
+	}
+
+	for _, path := range append(groupTemplates(groups), emptyTmplPath) {
+		if path == "" {
+			continue
+		}
+		if err := validateTemplate(path); err != nil {
+			logFatal("invalid template %s: %v", path, err)
+		}
 	}
 
-	monitorHosts(interval, execute)
+	logInfo("%s", versionString())
+	if summaryFile != "" && summaryFormat == "" {
+		summaryFormat = "text"
+	}
+	if once {
+		if axfr != "" || wildcard != "" || k8sService != "" || soaZone != "" {
+			logFatal("-once only supports hostname arguments, not -axfr, -wildcard, -k8s-service or -soa")
+		}
+		os.Exit(runOnce())
+	}
+	ctx, shutdown := context.WithCancel(context.Background())
+	if metricsAddr != "" {
+		if err := serveMetrics(metricsAddr); err != nil {
+			logFatal("error starting -metrics-addr server: %v", err)
+		}
+		logInfo("serving metrics on %s/metrics", metricsAddr)
+	}
+	if statusAddr != "" {
+		if err := serveStatus(statusAddr); err != nil {
+			logFatal("error starting -status-addr server: %v", err)
+		}
+		logInfo("serving status on %s/status", statusAddr)
+	}
+	if grpcAddr != "" {
+		if err := serveGRPC(grpcAddr); err != nil {
+			logFatal("error starting -grpc-addr server: %v", err)
+		}
+		logInfo("serving gRPC on %s", grpcAddr)
+	}
+	warmStart()
+	var reactors sync.WaitGroup
+	for _, g := range groups {
+		reactors.Add(1)
+		go func(g *group) {
+			defer reactors.Done()
+			runReactor(ctx, g.changes, g.react)
+		}(g)
+	}
+	reactorDone := make(chan struct{})
+	go func() {
+		reactors.Wait()
+		close(reactorDone)
+	}()
+	if maxMemoryHint > 0 {
+		go monitorMemory()
+	}
+	for _, g := range groups {
+		g.monitor(ctx)
+	}
+	monitorAXFR(ctx, interval)
+	monitorCandidates(ctx, interval)
+	monitorK8s(ctx, interval)
+	monitorZoneSOA(ctx, interval)
+	if guardHost != "" {
+		wg.Add(1)
+		go monitorGuard(ctx, interval)
+	}
+	if activeFile != "" {
+		wg.Add(1)
+		go monitorStandby(ctx)
+	}
+	if checkInterval > 0 {
+		wg.Add(1)
+		go monitorDrift(ctx, checkInterval, groups)
+	}
+	if watchDest {
+		wg.Add(1)
+		go watchDests(ctx, groups)
+	}
 	wg.Add(2)
-	go watchTemplate()
-	go watchSignals()
-	wg.Wait()
+	go watchTemplates(ctx, groups)
+	go watchSignals(shutdown)
+	waitForShutdown(ctx, reactorDone)
+}
+
+// Waits for every monitor to stop and for the reactors to finish the reactions they're in the
+// middle of, if any, once ctx is cancelled. Exits with status 1 if that takes longer than
+// -shutdown-timeout.
+func waitForShutdown(ctx context.Context, reactorDone <-chan struct{}) {
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		<-reactorDone
+		close(stopped)
+	}()
+	<-ctx.Done()
+	if shutdownTimeout <= 0 {
+		<-stopped
+		return
+	}
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		logError("still running after -shutdown-timeout %v, exiting anyway", shutdownTimeout)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,1144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Tests run with every flag at its default, as if dns-gen had been started without options
+func TestMain(m *testing.M) {
+	parseFlags()
+	code := m.Run()
+	removeTestPlugin()
+	os.Exit(code)
+}
+
+// Renders text with Funcs and data, failing the test on any error
+func renderString(t *testing.T, text string, data interface{}) string {
+	t.Helper()
+	tmpl, err := newTemplate("test").Parse(text)
+	if err != nil {
+		t.Fatalf("parse %q: %v", text, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatalf("execute %q: %v", text, err)
+	}
+	return buf.String()
+}
+
+func TestSetOperations(t *testing.T) {
+	a := []string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.1"}
+	b := []string{"10.0.0.4", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	tests := []struct {
+		name string
+		fn   func(a, b []string) []string
+		a, b []string
+		want []string
+	}{
+		{"difference", difference, a, b, []string{"10.0.0.1"}},
+		{"difference of equal sets", difference, a, a, []string{}},
+		{"difference with empty", difference, a, nil, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{"intersection", intersection, a, b, []string{"10.0.0.2", "10.0.0.3"}},
+		{"intersection with empty", intersection, a, nil, []string{}},
+		{"union", union, a, b, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}},
+		{"union of empty sets", union, nil, nil, []string{}},
+		{"union sorts numerically", union, []string{"10.0.0.10"}, []string{"10.0.0.9"}, []string{"10.0.0.9", "10.0.0.10"}},
+	}
+	for _, tt := range tests {
+		if got := tt.fn(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s(%v, %v) = %v, want %v", tt.name, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSetOperationsInTemplates(t *testing.T) {
+	data := map[string][]string{"Old": {"10.0.0.1", "10.0.0.2"}, "New": {"10.0.0.2", "10.0.0.3"}}
+	got := renderString(t, `{{ difference .New .Old }} {{ difference .Old .New }} {{ intersection .Old .New }} {{ union .Old .New }}`, data)
+	if want := "[10.0.0.3] [10.0.0.1] [10.0.0.2] [10.0.0.1 10.0.0.2 10.0.0.3]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestShufflePreservesSet(t *testing.T) {
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+	for _, got := range [][]string{shuffle(addrs), shuffleSeed(1, addrs), shuffleSeed(2, addrs)} {
+		if !reflect.DeepEqual(sortedCopy(got), addrs) {
+			t.Errorf("shuffled %v into %v, which is a different set", addrs, got)
+		}
+	}
+	if addrs[0] != "10.0.0.1" {
+		t.Errorf("shuffle modified its argument: %v", addrs)
+	}
+}
+
+func TestShuffleSeedOrderVaries(t *testing.T) {
+	var addrs []string
+	for _, a := range "abcdefghij" {
+		addrs = append(addrs, string(a))
+	}
+	orders := make(map[string]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		got := shuffleSeed(seed, addrs)
+		if !reflect.DeepEqual(got, shuffleSeed(seed, addrs)) {
+			t.Fatalf("shuffleSeed(%d) is not reproducible", seed)
+		}
+		orders[strings.Join(got, ",")] = true
+	}
+	if len(orders) < 10 {
+		t.Errorf("20 seeds produced only %d different orders", len(orders))
+	}
+}
+
+func TestShuffleIsStableForTheSameSet(t *testing.T) {
+	a := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"}
+	b := []string{"10.0.0.5", "10.0.0.3", "10.0.0.1", "10.0.0.4", "10.0.0.2"}
+	first := renderString(t, `{{ shuffle . }}`, a)
+	for i := 0; i < 5; i++ {
+		if got := renderString(t, `{{ shuffle . }}`, b); got != first {
+			t.Fatalf("re-rendering the same set gave %s, then %s", first, got)
+		}
+	}
+	if got := shuffleSeed(7, b); !reflect.DeepEqual(got, shuffleSeed(7, a)) {
+		t.Errorf("shuffleSeed depends on the order of its input: %v vs %v", got, shuffleSeed(7, a))
+	}
+}
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		fn    func(int, string) string
+		width int
+		s     string
+		want  string
+	}{
+		{padLeft, 6, "abc", "   abc"},
+		{padRight, 6, "abc", "abc   "},
+		{padLeft, 2, "abc", "abc"},
+		{padRight, 0, "abc", "abc"},
+		{padRight, 4, "", "    "},
+	}
+	for _, tt := range tests {
+		if got := tt.fn(tt.width, tt.s); got != tt.want {
+			t.Errorf("pad(%d, %q) = %q, want %q", tt.width, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	got, err := columns([][]string{
+		{"10.0.0.1", "a.example.com", "a"},
+		{"fd00::10", "bb.example.com", "b"},
+		{"10.0.0.100", "c", "c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "10.0.0.1   a.example.com  a\n" +
+		"fd00::10   bb.example.com b\n" +
+		"10.0.0.100 c              c"
+	if got != want {
+		t.Errorf("columns:\n%s\nwant:\n%s", got, want)
+	}
+
+	// rows of tab-separated fields, with differing numbers of columns
+	got, err = columns([]string{"127.0.0.1\tlocalhost", "::1\tlocalhost\tip6-localhost", "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "127.0.0.1 localhost\n" +
+		"::1       localhost ip6-localhost\n" +
+		"10.0.0.1"
+	if got != want {
+		t.Errorf("columns:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := columns(42); err == nil {
+		t.Error("columns(42) succeeded, want an error")
+	}
+}
+
+func TestColumnsTemplate(t *testing.T) {
+	got := renderString(t, `{{ padLeft 4 "ab" }}|{{ padRight 4 "ab" }}|{{ columns . }}`, []string{"a\tb", "ccc\td"})
+	if want := "  ab|ab  |a   b\nccc d"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFamilyCounts(t *testing.T) {
+	mixed := []string{"10.0.0.1", "fd00::1", "192.168.1.1", "::ffff:10.0.0.2", "2001:db8::1", "not-an-ip", "", "10.0.0.1:53"}
+	if got, want := familyCounts(mixed), (FamilyCounts{IPv4: 3, IPv6: 2}); got != want {
+		t.Errorf("familyCounts = %+v, want %+v", got, want)
+	}
+	if got := familyCounts(nil); got != (FamilyCounts{}) {
+		t.Errorf("familyCounts(nil) = %+v", got)
+	}
+
+	for family, want := range map[string]int{"ipv4": 3, "4": 3, "v4": 3, "IPv6": 2, "6": 2, "v6": 2} {
+		got, err := countFamily(family, mixed)
+		if err != nil || got != want {
+			t.Errorf("countFamily(%q) = %d, %v; want %d", family, got, err, want)
+		}
+	}
+	if _, err := countFamily("ipx", mixed); err == nil {
+		t.Error("countFamily(\"ipx\") succeeded, want an error")
+	}
+}
+
+func TestFamilyCountsTemplate(t *testing.T) {
+	got := renderString(t, `{{ countFamily "ipv4" . }} {{ countFamily "ipv6" . }} {{ (familyCounts .).IPv4 }}`,
+		[]string{"10.0.0.1", "fd00::1", "10.0.0.2"})
+	if want := "2 1 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSeq(t *testing.T) {
+	tests := []struct {
+		start, end int
+		want       []int
+	}{
+		{1, 5, []int{1, 2, 3, 4, 5}},
+		{-2, 1, []int{-2, -1, 0, 1}},
+		{3, 3, []int{3}},
+		{5, 1, []int{}},
+	}
+	for _, tt := range tests {
+		if got := seq(tt.start, tt.end); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("seq(%d, %d) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestUntil(t *testing.T) {
+	for n, want := range map[int][]int{3: {0, 1, 2}, 1: {0}, 0: {}, -1: {}} {
+		if got := until(n); !reflect.DeepEqual(got, want) {
+			t.Errorf("until(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestRangeTemplate(t *testing.T) {
+	text := `{{ range until (count .Addresses) }}worker{{ . }} {{ end }}|{{ range seq 2 4 }}{{ . }}{{ end }}`
+	got := renderString(t, text, map[string][]string{"Addresses": {"10.0.0.1", "10.0.0.2", "10.0.0.3"}})
+	if want := "worker0 worker1 worker2 |234"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := renderString(t, text, map[string][]string{}); got != "|234" {
+		t.Errorf("with no addresses got %q, want %q", got, "|234")
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	dir, restore := setupOutput(t, `{{ range .Hosts }}{{ countt .Addresses }}{{ end }}`)
+	defer restore()
+	err := validateTemplate(tmplPath)
+	if err == nil {
+		t.Fatal("a template calling an unknown function validated")
+	}
+	for _, want := range []string{`unknown function "countt"`, "available functions: ", "count", "ringGet"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+
+	good := filepath.Join(dir, "good.tmpl")
+	if err := ioutil.WriteFile(good, []byte(`{{ range .Hosts }}{{ count .Addresses }}{{ end }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateTemplate(good); err != nil {
+		t.Errorf("a valid template failed: %v", err)
+	}
+
+	// other parse errors are passed on unchanged
+	bad := filepath.Join(dir, "bad.tmpl")
+	if err := ioutil.WriteFile(bad, []byte(`{{ range .Hosts }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateTemplate(bad); err == nil || strings.Contains(err.Error(), "available functions") {
+		t.Errorf("unclosed range gave %v", err)
+	}
+}
+
+// Returns a host with the given addresses
+func hostWith(name string, addresses ...string) Host {
+	return Host{Name: name, Addresses: addresses}
+}
+
+func TestExpandArgvAddresses(t *testing.T) {
+	defer func(orig bool) { execArgvRepeat = orig }(execArgvRepeat)
+	argv := []string{"mycmd", "--server", "{{addresses}}", "--reload"}
+	tests := []struct {
+		addresses []string
+		repeat    bool
+		want      []string
+	}{
+		{nil, false, []string{"mycmd", "--server", "--reload"}},
+		{[]string{"10.0.0.1"}, false, []string{"mycmd", "--server", "10.0.0.1", "--reload"}},
+		{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, false, []string{"mycmd", "--server", "10.0.0.1", "10.0.0.2", "10.0.0.3", "--reload"}},
+		{nil, true, []string{"mycmd", "--reload"}},
+		{[]string{"10.0.0.1"}, true, []string{"mycmd", "--server", "10.0.0.1", "--reload"}},
+		{[]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, true, []string{"mycmd", "--server", "10.0.0.1", "--server", "10.0.0.2", "--server", "10.0.0.3", "--reload"}},
+	}
+	for _, tt := range tests {
+		execArgvRepeat = tt.repeat
+		hosts := []Host{hostWith("a", tt.addresses...)}
+		if got := expandArgv(argv, hosts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d addresses, repeat=%v: got %q, want %q", len(tt.addresses), tt.repeat, got, tt.want)
+		}
+	}
+}
+
+func TestExpandArgvAddressesAcrossHosts(t *testing.T) {
+	hosts := []Host{hostWith("a", "10.0.0.1", "10.0.0.2"), hostWith("b", "10.0.0.2", "10.0.0.3")}
+	got := expandArgv([]string{"mycmd", "{{addresses}}"}, hosts)
+	if want := []string{"mycmd", "10.0.0.1", "10.0.0.2", "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// only an argument that is exactly the placeholder is expanded
+	got = expandArgv([]string{"mycmd", "--servers={{addresses}}"}, hosts)
+	if want := []string{"mycmd", "--servers={{addresses}}"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunCmdArgvSkipsTheShell(t *testing.T) {
+	dir, restore := setupExec(t, `x`)
+	defer restore()
+	out := filepath.Join(dir, "args")
+	// the arguments would be split and expanded if they went through a shell; the script only
+	// records what it was given
+	argv := []string{"/bin/sh", "-c", `printf '%s|' "$@" > ` + out, "sh", "two words", "$HOME; echo injected"}
+	if err := runCmd(command{argv: argv}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := "two words|$HOME; echo injected|"
+	if got, _ := ioutil.ReadFile(out); string(got) != want {
+		t.Errorf("the command got %q, want %q", got, want)
+	}
+}
+
+func TestExpandArgvEndpoints(t *testing.T) {
+	hosts := []Host{
+		hostWith("_sip._tcp.a.example.com", "10 60 5060 sip1.example.com.", "20 0 5060 sip2.example.com."),
+		hostWith("_sip._tcp.b.example.com", "10 0 5061 sip3.example.com."),
+	}
+	got := expandArgv([]string{"kamcmd", "dispatcher.reload", "{{endpoints}}"}, hosts)
+	want := []string{"kamcmd", "dispatcher.reload", "sip1.example.com:5060", "sip2.example.com:5060", "sip3.example.com:5061"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// the old spelling is no longer a placeholder
+	if got := expandArgv([]string{"cmd", "%endpoints%"}, hosts); !reflect.DeepEqual(got, []string{"cmd", "%endpoints%"}) {
+		t.Errorf("got %q, want %%endpoints%% passed as is", got)
+	}
+}
+
+func TestExecEnvEndpoints(t *testing.T) {
+	defer func(orig string) { recordType = orig }(recordType)
+	resetStore()
+	defer resetStore()
+	updateHost(hostWith("_sip._tcp.example.com", "10 60 5060 sip1.example.com.", "20 0 5061 sip2.example.com."))
+
+	recordType = typeSRV
+	want := []string{"DNSGEN_CHANGED_HOSTS=", "DNSGEN_ENDPOINTS=sip1.example.com:5060 sip2.example.com:5061"}
+	if env := execEnv(nil, snapshot().Hosts); !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %q, want %q", env, want)
+	}
+	recordType = typeHost
+	if env := execEnv(nil, snapshot().Hosts); !reflect.DeepEqual(env, want[:1]) {
+		t.Errorf("without -type srv, env = %q", env)
+	}
+}
+
+// Points tmplPath at a template containing text and dest at a file in a new temp dir, and
+// empties the store. Returns the temp dir and a func that undoes it all.
+func setupOutput(t *testing.T, text string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dns-gen-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := filepath.Join(dir, "test.tmpl")
+	if err := ioutil.WriteFile(tmpl, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	origTmpl, origDest := tmplPath, dest
+	tmplPath, dest = tmpl, filepath.Join(dir, "out")
+	resetStore()
+	return dir, func() {
+		tmplPath, dest = origTmpl, origDest
+		resetStore()
+		os.RemoveAll(dir)
+	}
+}
+
+func resetStore() {
+	store.Lock()
+	defer store.Unlock()
+	store.hosts = make(map[string]Host)
+	store.lookups = make(map[string]lookupState)
+	store.lastExecOutput = ""
+	store.soa = nil
+	store.lastRender = time.Time{}
+	store.renders = make(map[string]renderState)
+	store.awaitingFirstLookups = false
+	store.lastReact = time.Time{}
+	store.monitors = make(map[string]monitorState)
+	store.families = make(map[string]familyLatencies)
+	store.sourceFetched = false
+	interned.Lock()
+	interned.strings = make(map[string]*internedString)
+	interned.Unlock()
+	changeTimes.Lock()
+	changeTimes.hosts = make(map[string][]time.Time)
+	changeTimes.Unlock()
+}
+
+func TestShuffleDoesNotChangeDest(t *testing.T) {
+	_, restore := setupOutput(t, `{{ range .Hosts }}{{ range shuffle .Addresses }}{{ . }}
+{{ end }}{{ end }}`)
+	defer restore()
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}})
+
+	o := commandLineOutput()
+	for i := 0; i < 5; i++ {
+		content, err := o.render(snapshot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed, err := writeFile(dest, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != (i == 0) {
+			t.Fatalf("render %d: writeFile reported changed=%v", i+1, changed)
+		}
+	}
+	if drifted, err := detectDrift(o, snapshot()); err != nil || drifted {
+		t.Errorf("detectDrift() = %v, %v; want no drift", drifted, err)
+	}
+}
+
+func TestShuffleReshufflesWhenTheSetChanges(t *testing.T) {
+	_, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }}:{{ range shuffle .Addresses }} {{ . }}{{ end }}
+{{ end }}`)
+	defer restore()
+	execOnChangeOnly = true
+	var addrs []string
+	for i := 1; i <= 10; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i))
+	}
+	g := commandLineGroup()
+	// reacts and returns the line dest has for host a, failing if the command ran when it
+	// shouldn't have or didn't when it should
+	react := func(wantChanged bool) string {
+		t.Helper()
+		os.Remove(marker)
+		result := g.react(context.Background(), []changeEvent{{}})
+		if result.Err() != nil {
+			t.Fatal(result.Err())
+		}
+		if result.Changed != wantChanged || fileExists(marker) != wantChanged {
+			t.Fatalf("react changed %v and ran the command %v, want %v", result.Changed, fileExists(marker), wantChanged)
+		}
+		// what was written is what a drift check renders, so it doesn't look like drift
+		if drifted, err := detectDrift(g.outputs[0], g.snapshot()); err != nil || drifted {
+			t.Fatalf("detectDrift() = %v, %v; want no drift", drifted, err)
+		}
+		content, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.SplitN(string(content), "\n", 2)[0]
+	}
+
+	updateHost(Host{Name: "a", Addresses: addrs})
+	first := react(true)
+
+	// neither reacting again nor a change to another host reorders a's addresses
+	if got := react(false); got != first {
+		t.Errorf("an unchanged set was reshuffled: %q, then %q", first, got)
+	}
+	for i := 0; i < 5; i++ {
+		updateHost(Host{Name: "b", Addresses: []string{fmt.Sprintf("10.1.0.%d", i)}})
+		if got := react(true); got != first {
+			t.Fatalf("b changing reshuffled a: %q, then %q", first, got)
+		}
+	}
+
+	// a set that changes is reshuffled
+	orders := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		extra := fmt.Sprintf("10.0.0.%d", 11+i%2)
+		updateHost(Host{Name: "a", Addresses: append(append([]string{}, addrs...), extra)})
+		line := strings.Replace(react(true), " "+extra, "", 1)
+		orders[line] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("5 changes to a's addresses were written in the same order every time: %v", orders)
+	}
+}
+
+func TestSingleReloadSignalReactsOnce(t *testing.T) {
+	defer resetStore()
+	// keep a stray SIGHUP from terminating the test binary before watchSignals is listening
+	guardCh := make(chan os.Signal, 1)
+	signal.Notify(guardCh, syscall.SIGHUP)
+	defer signal.Stop(guardCh)
+
+	// a few monitors running alongside, none of which should react to the signal themselves
+	r := &fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.1"}}}}
+	stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r}, hostSpec{Name: "b.example.com", Resolver: r})
+	defer stop()
+	for i := 0; i < 2; i++ {
+		if _, ok := nextChange(time.Second); !ok {
+			t.Fatal("the monitors' first lookups were never reported")
+		}
+	}
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	wg.Add(1)
+	go watchSignals(shutdown)
+	time.Sleep(50 * time.Millisecond)
+
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	reacts := 0
+	for {
+		ev, ok := nextChange(200 * time.Millisecond)
+		if !ok {
+			break
+		}
+		if ev.Host == "" {
+			reacts++
+		}
+	}
+	if reacts != 1 {
+		t.Errorf("one SIGHUP asked for %d reacts, want 1", reacts)
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("SIGTERM did not cancel the shared context")
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for name, want := range map[string]syscall.Signal{
+		"SIGHUP": syscall.SIGHUP, "HUP": syscall.SIGHUP, "sighup": syscall.SIGHUP,
+		"SIGUSR1": syscall.SIGUSR1, "usr2": syscall.SIGUSR2, "SIGALRM": syscall.SIGALRM,
+	} {
+		if got, err := parseSignal(name); err != nil || got != want {
+			t.Errorf("parseSignal(%q) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+	// shutdown signals can't double as the reload signal
+	for _, name := range []string{"SIGTERM", "SIGINT", "SIGKILL", "SIGFOO", ""} {
+		if _, err := parseSignal(name); err == nil {
+			t.Errorf("parseSignal(%q) succeeded", name)
+		}
+	}
+}
+
+func TestReloadSignalIgnoresOtherSignals(t *testing.T) {
+	defer resetStore()
+	defer func(orig syscall.Signal) { reloadSig = orig }(reloadSig)
+	reloadSig = syscall.SIGUSR2
+	// the signals watchSignals no longer listens to would otherwise terminate the test binary
+	guardCh := make(chan os.Signal, 4)
+	signal.Notify(guardCh, syscall.SIGHUP, syscall.SIGUSR1)
+	defer signal.Stop(guardCh)
+	drainChanges()
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	defer shutdown()
+	wg.Add(1)
+	go watchSignals(shutdown)
+	time.Sleep(50 * time.Millisecond)
+
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if ev, ok := nextChange(200 * time.Millisecond); ok {
+		t.Errorf("SIGHUP or SIGUSR1 asked for a react: %+v", ev)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	if _, ok := nextChange(time.Second); !ok {
+		t.Error("SIGUSR2 didn't ask for a react")
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("SIGTERM did not cancel the shared context")
+	}
+}
+
+// Sets up a template, dest and -exec command that records that it ran, clearing every other
+// react option. Returns the temp dir, the path the command touches, and a restore func.
+func setupReact(t *testing.T, text string) (string, string, func()) {
+	t.Helper()
+	dir, restoreOutput := setupOutput(t, text)
+	marker := filepath.Join(dir, "ran")
+	origExec, origLock, origGuard, origOnly := execute, reactLock, guardHost, execOnChangeOnly
+	execute, reactLock, guardHost, execOnChangeOnly = "touch "+marker, "", "", false
+	return dir, marker, func() {
+		execute, reactLock, guardHost, execOnChangeOnly = origExec, origLock, origGuard, origOnly
+		restoreOutput()
+	}
+}
+
+func stageNames(r reactResult) []string {
+	var names []string
+	for _, s := range r.Stages {
+		names = append(names, s.Stage)
+	}
+	return names
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestReactStageOrder(t *testing.T) {
+	dir, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }}{{ end }}`)
+	defer restore()
+	reactLock = filepath.Join(dir, "lock")
+	guardHost = "localhost"
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+
+	result := react(context.Background(), nil)
+	if err := result.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{stageLock, stageGuard, stageRender, stageWrite, stageExec}
+	if got := stageNames(result); !reflect.DeepEqual(got, want) {
+		t.Errorf("stages ran in order %v, want %v", got, want)
+	}
+	if !fileExists(marker) {
+		t.Error("the command did not run")
+	}
+}
+
+func TestReactShortCircuits(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(dir string)
+		text  string
+		want  []string
+	}{
+		{
+			name:  "render error",
+			text:  `{{ index .Hosts 5 }}`,
+			setup: func(string) {},
+			want:  []string{stageRender},
+		},
+		{
+			name:  "write error",
+			text:  `ok`,
+			setup: func(dir string) { dest = filepath.Join(dir, "missing", "out") },
+			want:  []string{stageRender, stageWrite},
+		},
+		{
+			name: "guard host down",
+			text: `ok`,
+			setup: func(string) {
+				guardHost = "guard.invalid"
+				systemResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return nil, errors.New("no nameserver")
+				}}
+			},
+			want: []string{stageGuard},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, marker, restore := setupReact(t, tt.text)
+			defer restore()
+			origResolver := systemResolver
+			defer func() { systemResolver = origResolver }()
+			tt.setup(dir)
+			before, _ := ioutil.ReadFile(dest)
+
+			result := react(context.Background(), nil)
+			if result.Err() == nil {
+				t.Fatal("react succeeded, want an error")
+			}
+			if got := stageNames(result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stages %v ran, want %v", got, tt.want)
+			}
+			if after, _ := ioutil.ReadFile(dest); !bytes.Equal(before, after) {
+				t.Errorf("dest changed to %q", after)
+			}
+			if fileExists(marker) {
+				t.Error("the command ran after a failed stage")
+			}
+		})
+	}
+}
+
+func TestReactSkipsCommandWhenOutputUnchanged(t *testing.T) {
+	_, marker, restore := setupReact(t, `static`)
+	defer restore()
+	execOnChangeOnly = true
+
+	react(context.Background(), nil)
+	if !fileExists(marker) {
+		t.Fatal("the command did not run after the first write")
+	}
+	os.Remove(marker)
+	result := react(context.Background(), nil)
+	if got, want := stageNames(result), []string{stageRender, stageWrite}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stages %v ran, want %v", got, want)
+	}
+	if fileExists(marker) {
+		t.Error("the command ran although dest did not change")
+	}
+}
+
+func TestWriteFileGzip(t *testing.T) {
+	_, restore := setupOutput(t, "")
+	defer restore()
+	gzipOutput = true
+	defer func() { gzipOutput = false }()
+
+	content := []byte("10.0.0.1\n10.0.0.2\n")
+	if changed, err := writeFile(dest, content); err != nil || !changed {
+		t.Fatalf("writeFile = %v, %v", changed, err)
+	}
+	data, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gunzipBytes(data)
+	if err != nil {
+		t.Fatalf("dest is not valid gzip: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("dest decompresses to %q, want %q", got, content)
+	}
+
+	// the same content compresses differently once the gzip header's timestamp moves on, but
+	// is not a change
+	time.Sleep(1100 * time.Millisecond)
+	if changed, err := writeFile(dest, content); err != nil || changed {
+		t.Errorf("rewriting the same content: writeFile = %v, %v; want no change", changed, err)
+	}
+	if changed, err := writeFile(dest, []byte("10.0.0.3\n")); err != nil || !changed {
+		t.Errorf("writing new content: writeFile = %v, %v; want a change", changed, err)
+	}
+}
+
+func TestWriteFileOverwritesInPlaceOnlyWithoutPermission(t *testing.T) {
+	dir, restore := setupOutput(t, "")
+	defer restore()
+
+	// any failure other than a permission error is returned, not worked around
+	notDir := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writeFile(filepath.Join(notDir, "out"), []byte("new\n")); err == nil || !strings.Contains(err.Error(), "temp file") {
+		t.Errorf("writeFile under a file = %v, want the temp file error", err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can create files in a read-only directory")
+	}
+	if err := ioutil.WriteFile(dest, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	if changed, err := writeFile(dest, []byte("new\n")); err != nil || !changed {
+		t.Fatalf("writeFile in a read-only directory = %v, %v", changed, err)
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "new\n" {
+		t.Errorf("dest = %q, want it overwritten in place", got)
+	}
+	if !strings.Contains(buf.String(), "[WARN] unable to create temp file") {
+		t.Errorf("the fallback wasn't logged as a warning: %q", buf.String())
+	}
+}
+
+func TestWriteFileSymlink(t *testing.T) {
+	for _, follow := range []bool{false, true} {
+		dir, restore := setupOutput(t, "")
+		target := filepath.Join(dir, "real")
+		if err := ioutil.WriteFile(target, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			t.Fatal(err)
+		}
+		followSymlink = follow
+
+		if _, err := writeFile(dest, []byte("new\n")); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		real, _ := ioutil.ReadFile(target)
+		got, _ := ioutil.ReadFile(dest)
+		if string(got) != "new\n" {
+			t.Errorf("follow=%v: dest reads %q, want %q", follow, got, "new\n")
+		}
+		if follow {
+			if fi.Mode()&os.ModeSymlink == 0 {
+				t.Error("-follow-symlink replaced the link with a regular file")
+			}
+			if string(real) != "new\n" {
+				t.Errorf("-follow-symlink left the link's target as %q", real)
+			}
+		} else {
+			if fi.Mode()&os.ModeSymlink != 0 {
+				t.Error("by default the link should be replaced with a regular file")
+			}
+			if string(real) != "old\n" {
+				t.Errorf("the link's old target was changed to %q", real)
+			}
+		}
+		followSymlink = false
+		restore()
+	}
+}
+
+// Sets up a template rendered to a dest in a temp dir, with no -exec. Returns the dir and a func
+// restoring the flags.
+func setupExec(t *testing.T, text string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dns-gen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origTmpl, origDest, origExec, origPerHost, origOnly := tmplPath, dest, execute, execPerHost, execOnChangeOnly
+	tmplPath, dest, execute, execOnChangeOnly = filepath.Join(dir, "tmpl"), filepath.Join(dir, "dest"), "", false
+	if err := ioutil.WriteFile(tmplPath, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() {
+		tmplPath, dest, execute, execPerHost, execOnChangeOnly = origTmpl, origDest, origExec, origPerHost, origOnly
+		os.RemoveAll(dir)
+	}
+}
+
+func TestExecOnChangeOnly(t *testing.T) {
+	dir, restore := setupExec(t, `static`)
+	defer restore()
+	execOnChangeOnly = true
+	log := filepath.Join(dir, "runs")
+	execute = "echo >> " + log
+
+	for i := 0; i < 2; i++ {
+		if result := react(context.Background(), nil); result.Err() != nil || result.Changed != (i == 0) {
+			t.Fatalf("react %d: changed %v, err %v", i+1, result.Changed, result.Err())
+		}
+	}
+	if got, _ := ioutil.ReadFile(log); string(got) != "\n" {
+		t.Errorf("ran %d times, want once", strings.Count(string(got), "\n"))
+	}
+}
+
+func TestMaskAddr(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"10.1.2.3", "10.1.2.x"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::x"},
+		{"::ffff:10.1.2.3", "10.1.2.x"},
+		{"sip1.example.com:5060", "sip1.example.com:5060"},
+		{"nginx", "nginx"},
+	}
+	for _, tt := range tests {
+		if got := maskAddr(tt.in); got != tt.want {
+			t.Errorf("maskAddr(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRunCmdMasksLoggedAddresses(t *testing.T) {
+	defer func(orig bool) { maskAddresses = orig }(maskAddresses)
+	maskAddresses = true
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	hosts := []Host{{Name: "a", Addresses: []string{"10.1.2.3", "10.1.2.4"}}}
+	if err := runCmd(command{argv: []string{"true", "--servers", "{{addresses}}"}}, nil, hosts); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); strings.Contains(out, "10.1.2.3") || !strings.Contains(out, "[true --servers 10.1.2.x 10.1.2.x]") {
+		t.Errorf("logged %q, want the addresses masked", out)
+	}
+}
+
+func TestRunCmdRejectsAnEmptyArgv(t *testing.T) {
+	if err := runCmd(command{argv: []string{"{{addresses}}"}}, nil, nil); err == nil {
+		t.Error("an argv that expanded to nothing was run")
+	}
+	if err := runCmd(command{argv: []string{"true", "{{addresses}}"}}, nil, nil); err != nil {
+		t.Errorf("a command with no addresses to pass failed: %v", err)
+	}
+}
+
+func TestIsArgvPlaceholder(t *testing.T) {
+	for arg, want := range map[string]bool{
+		"{{addresses}}":   true,
+		"{{endpoints}}":   true,
+		"nginx":           false,
+		"--{{addresses}}": false,
+	} {
+		if got := isArgvPlaceholder(arg); got != want {
+			t.Errorf("isArgvPlaceholder(%q) = %v, want %v", arg, got, want)
+		}
+	}
+}
+
+func TestExecPerHost(t *testing.T) {
+	dir, restore := setupExec(t, `{{ range .Hosts }}{{ .Name }}{{ end }}`)
+	defer restore()
+	log := filepath.Join(dir, "runs")
+	execute = `echo "$DNSGEN_HOST $DNSGEN_OLD_ADDRS $DNSGEN_NEW_ADDRS" >> ` + log
+
+	changes := []changeEvent{
+		{Host: "a", Old: []string{"10.0.0.1"}, New: []string{"10.0.0.2"}},
+		{Host: "b", New: []string{"10.0.1.1"}},
+		{Host: "a", Old: []string{"10.0.0.2"}, New: []string{"10.0.0.3"}},
+		{},
+	}
+	for _, tt := range []struct {
+		perHost bool
+		want    string
+	}{
+		{false, "  \n"},
+		{true, "a 10.0.0.1 10.0.0.3\nb  10.0.1.1\n"},
+	} {
+		os.Remove(log)
+		execPerHost = tt.perHost
+		if result := react(context.Background(), changes); result.Err() != nil {
+			t.Fatal(result.Err())
+		}
+		got, _ := ioutil.ReadFile(log)
+		if string(got) != tt.want {
+			t.Errorf("-exec-per-host=%v ran:\n%q\nwant:\n%q", tt.perHost, got, tt.want)
+		}
+	}
+
+	// a reaction without host changes, e.g. to a template change, still runs the command once
+	os.Remove(log)
+	execPerHost = true
+	react(context.Background(), []changeEvent{{}})
+	if got, _ := ioutil.ReadFile(log); string(got) != "  \n" {
+		t.Errorf("without host changes ran %q, want a single run", got)
+	}
+}
+
+func TestExecPerHostKeepsGoingAfterAFailure(t *testing.T) {
+	dir, restore := setupExec(t, `x`)
+	defer restore()
+	execPerHost = true
+	log := filepath.Join(dir, "runs")
+	execute = `echo "$DNSGEN_HOST" >> ` + log + `; [ "$DNSGEN_HOST" != a ]`
+
+	result := react(context.Background(), []changeEvent{{Host: "a"}, {Host: "b"}})
+	if err := result.Err(); err == nil || !strings.Contains(err.Error(), "a:") {
+		t.Errorf("error = %v, want a's failure", err)
+	}
+	if got, _ := ioutil.ReadFile(log); string(got) != "a\nb\n" {
+		t.Errorf("ran for %q, want both hosts", got)
+	}
+}
+
+func TestExecEnvChangedHosts(t *testing.T) {
+	changes := []changeEvent{
+		{Host: "a", Old: []string{"10.0.0.1"}, New: []string{"10.0.0.2"}},
+		{Host: "a", Old: []string{"10.0.0.2"}, New: []string{"10.0.0.3"}},
+	}
+	want := []string{"DNSGEN_CHANGED_HOSTS=a", "DNSGEN_HOST=a", "DNSGEN_OLD_ADDRS=10.0.0.1", "DNSGEN_NEW_ADDRS=10.0.0.3"}
+	if env := execEnv(changes, nil); !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %q, want %q", env, want)
+	}
+
+	changes = append(changes, changeEvent{Host: "b", New: []string{"10.0.0.4"}}, changeEvent{})
+	want = []string{"DNSGEN_CHANGED_HOSTS=a,b"}
+	if env := execEnv(changes, nil); !reflect.DeepEqual(env, want) {
+		t.Errorf("env = %q, want %q", env, want)
+	}
+}
+
+func setupRetries(t *testing.T, retries int, backoff time.Duration) (string, func()) {
+	dir, err := ioutil.TempDir("", "dns-gen-retries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origRetries, origBackoff := execRetries, execBackoff
+	execRetries, execBackoff = retries, backoff
+	return filepath.Join(dir, "runs"), func() {
+		execRetries, execBackoff = origRetries, origBackoff
+		os.RemoveAll(dir)
+	}
+}
+
+// counts the lines the command appended to log, i.e. the number of times it ran
+func countRuns(log string) int {
+	data, _ := ioutil.ReadFile(log)
+	return strings.Count(string(data), "\n")
+}
+
+func TestRunCmdWithRetries(t *testing.T) {
+	log, restore := setupRetries(t, 3, 10*time.Millisecond)
+	defer restore()
+
+	// fails twice, then succeeds
+	start := time.Now()
+	if err := runCmdWithRetries(context.Background(), command{shell: `echo run >> ` + log + `; [ $(wc -l < ` + log + `) -ge 3 ]`}, nil, nil); err != nil {
+		t.Fatalf("command failed: %v", err)
+	}
+	if n := countRuns(log); n != 3 {
+		t.Errorf("ran %d times, want 3", n)
+	}
+	// waited 10ms, then twice as long
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("retried after %v, want the backoff to double", elapsed)
+	}
+}
+
+func TestRunCmdWithRetriesGivesUp(t *testing.T) {
+	log, restore := setupRetries(t, 2, time.Millisecond)
+	defer restore()
+
+	c := command{shell: `echo run >> ` + log + `; false`}
+	if err := runCmdWithRetries(context.Background(), c, nil, nil); err == nil {
+		t.Error("a command that always fails succeeded")
+	}
+	if n := countRuns(log); n != 3 {
+		t.Errorf("ran %d times, want the first run and 2 retries", n)
+	}
+
+	// without -exec-retries the command runs once
+	os.Remove(log)
+	execRetries = 0
+	runCmdWithRetries(context.Background(), c, nil, nil)
+	if n := countRuns(log); n != 1 {
+		t.Errorf("without retries ran %d times, want 1", n)
+	}
+}
+
+func TestRunCmdWithRetriesStopsOnShutdown(t *testing.T) {
+	log, restore := setupRetries(t, 5, time.Hour)
+	defer restore()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() { done <- runCmdWithRetries(ctx, command{shell: `echo run >> ` + log + `; false`}, nil, nil) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("a failed command succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting to retry after shutdown")
+	}
+	if n := countRuns(log); n != 1 {
+		t.Errorf("ran %d times, want no retries after shutdown", n)
+	}
+}
+
+func TestCaptureExecOutputInTheNextRender(t *testing.T) {
+	_, _, restore := setupReact(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }} id={{ .LastExecOutput }}`)
+	defer restore()
+	defer func(orig bool) { captureExec = orig }(captureExec)
+	captureExec = true
+	render := func(addrs ...string) string {
+		t.Helper()
+		updateHost(Host{Name: "a", Addresses: addrs})
+		if result := react(context.Background(), nil); result.Err() != nil && !strings.Contains(result.Err().Error(), "exec") {
+			t.Fatal(result.Err())
+		}
+		got, _ := ioutil.ReadFile(dest)
+		return string(got)
+	}
+
+	// the command runs after the render, so its output shows up in the one after
+	execute = "echo gen-1; echo noise >&2"
+	if got, want := render("10.0.0.1"), "[10.0.0.1] id="; got != want {
+		t.Errorf("first render = %q, want %q", got, want)
+	}
+	execute = "echo gen-2"
+	if got, want := render("10.0.0.2"), "[10.0.0.2] id=gen-1\n"; got != want {
+		t.Errorf("second render = %q, want %q", got, want)
+	}
+
+	// a failed command leaves the last output in place
+	execute = "echo gen-3; exit 1"
+	render("10.0.0.3")
+	if got, want := render("10.0.0.4"), "[10.0.0.4] id=gen-2\n"; got != want {
+		t.Errorf("render after a failed command = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureExecOutputIsBounded(t *testing.T) {
+	defer resetStore()
+	setExecOutput(bytes.Repeat([]byte("x"), maxExecOutput+100))
+	if got := snapshot().LastExecOutput; len(got) != maxExecOutput {
+		t.Errorf("kept %d bytes, want %d", len(got), maxExecOutput)
+	}
+}
+
+func TestStripZones(t *testing.T) {
+	got := stripZones([]string{"fe80::2%eth0", "10.0.0.1", "fe80::1%eth0", "fe80::1%eth1", "fe80::1", "host%1.example.com"})
+	if want := []string{"10.0.0.1", "fe80::1", "fe80::2", "host%1.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMonitorWithStripZone(t *testing.T) {
+	defer func(orig bool) { stripZone = orig }(stripZone)
+	for _, strip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strip-zone=%v", strip), func(t *testing.T) {
+			defer resetStore()
+			stripZone = strip
+			// the same address, resolved with and then without its zone
+			r := &fakeResolver{results: []fakeResult{
+				{addresses: []string{"fe80::1%eth0"}},
+				{addresses: []string{"fe80::1"}},
+			}}
+			stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+			defer stop()
+
+			first, _ := nextChange(time.Second)
+			want := []string{"fe80::1%eth0"}
+			if strip {
+				want = []string{"fe80::1"}
+			}
+			if !reflect.DeepEqual(first.New, want) {
+				t.Fatalf("got %q, want %q", first.New, want)
+			}
+			if ev, ok := nextChange(100 * time.Millisecond); ok == strip {
+				t.Errorf("got change %+v, want a change %v", ev, !strip)
+			}
+		})
+	}
+}
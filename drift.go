@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"time"
+)
+
+// Renders o from ctx and reports whether it differs from what is currently in its dest
+func detectDrift(o output, ctx RenderContext) (bool, error) {
+	content, err := o.render(ctx)
+	if err != nil {
+		return false, err
+	}
+	target, err := destTarget(o.dest)
+	if err != nil {
+		return false, err
+	}
+	current, err := ioutil.ReadFile(target)
+	if err != nil {
+		// a missing dest counts as drift
+		return true, nil
+	}
+	if gzipOutput {
+		current, _ = gunzipBytes(current)
+	}
+	return !bytes.Equal(current, content), nil
+}
+
+// upper bound on the number of drift checks skipped before asking again to regenerate a dest
+// that stays drifted
+const maxDriftSkip = 64
+
+// driftRetry tracks a dest that still differed after its group was asked to regenerate it, as
+// when the write is blocked by -guard-host
+type driftRetry struct {
+	// checks left to skip before asking again, and how many were skipped last time
+	skip, wait int
+}
+
+// Periodically checks the dest of every output written to a file against what the current DNS
+// data renders to, and has the output's group react if the file was changed out of band. A dest
+// that stays drifted is regenerated again after skipping 1, 2, 4... checks rather than on every
+// one, until it matches again.
+func monitorDrift(ctx context.Context, interval time.Duration, groups []*group) {
+	defer wg.Done()
+
+	retries := make(map[string]*driftRetry)
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			for _, g := range groups {
+				for _, o := range g.outputs {
+					if o.dest == "" {
+						continue
+					}
+					drifted, err := detectDrift(o, g.snapshot())
+					r := retries[o.dest]
+					switch {
+					case err != nil:
+						logError("drift check failed: %v", err)
+					case !drifted:
+						delete(retries, o.dest)
+						if debug {
+							logDebug("drift check: %s is up to date", o.dest)
+						}
+					case r != nil && r.skip > 0:
+						r.skip--
+						if debug {
+							logDebug("drift check: %s still does not match, regenerating again in %d checks", o.dest, r.skip+1)
+						}
+					default:
+						if r == nil {
+							logChange("%s does not match the rendered output, regenerating", o.dest)
+							retries[o.dest] = &driftRetry{skip: 1, wait: 1}
+						} else {
+							logChange("%s still does not match the rendered output, regenerating", o.dest)
+							if r.wait *= 2; r.wait > maxDriftSkip {
+								r.wait = maxDriftSkip
+							}
+							r.skip = r.wait
+						}
+						requestReact(g.changes)
+					}
+				}
+			}
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// With -watch-dest, watches the dest of every output written to a file and has the output's
+// group react when anything but dns-gen changes or removes it, until ctx is cancelled
+func watchDests(ctx context.Context, groups []*group) {
+	defer wg.Done()
+	queues := make(map[string][]chan changeEvent)
+	for _, g := range groups {
+		for _, o := range g.outputs {
+			if o.dest == "" {
+				continue
+			}
+			// with -follow-symlink the file written, and so the one to watch, is the link's target
+			path, err := destTarget(o.dest)
+			if err != nil {
+				path = o.dest
+			}
+			queues[path] = append(queues[path], g.changes)
+		}
+	}
+	watchFiles(ctx, "dest", queues, true)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs g's reactor until the returned func is called, counting its reacts
+func startCountingReactor(g *group) (func() int, func()) {
+	var mu sync.Mutex
+	reacts := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runReactor(ctx, g.changes, func(ctx context.Context, changes []changeEvent) reactResult {
+			mu.Lock()
+			reacts++
+			mu.Unlock()
+			return g.react(ctx, changes)
+		})
+	}()
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return reacts
+	}
+	return count, func() {
+		cancel()
+		<-done
+	}
+}
+
+// waits up to a second for cond to hold
+func eventually(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestWatchersIgnoreOwnWrites(t *testing.T) {
+	// every reaction writes a different order, so reacting to its own write would never stop
+	_, restore := setupOutput(t, `{{ range .Hosts }}{{ range shuffle .Addresses }}{{ . }} {{ end }}{{ end }}`)
+	defer restore()
+	var addrs []string
+	for i := 1; i <= 10; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.0.%d", i))
+	}
+	updateHost(Host{Name: "a", Addresses: addrs})
+
+	// the template and dest are in the same directory, watched by both
+	g := commandLineGroup()
+	g.changes = make(chan changeEvent, 16)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(2)
+	watchTemplates(ctx, []*group{g})
+	watchDests(ctx, []*group{g})
+	defer wg.Wait()
+	defer cancel()
+	reacts, stop := startCountingReactor(g)
+	defer stop()
+
+	requestReact(g.changes)
+	if !eventually(func() bool { return fileExists(dest) }) {
+		t.Fatal("dest was never written")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := reacts(); n != 1 {
+		t.Fatalf("a single render caused %d reacts", n)
+	}
+
+	// changes made by anything else are put right
+	if err := ioutil.WriteFile(dest, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { content, _ := ioutil.ReadFile(dest); return string(content) != "edited\n" }) {
+		t.Error("an edited dest wasn't regenerated")
+	}
+	os.Remove(dest)
+	if !eventually(func() bool { return fileExists(dest) }) {
+		t.Error("a removed dest wasn't regenerated")
+	}
+	// an edit can be seen as more than one event, but none of the rewrites lead to more
+	time.Sleep(200 * time.Millisecond)
+	if n := reacts(); n > 4 {
+		t.Errorf("an edit and a removal caused %d reacts, want them to stop", n-1)
+	}
+}
+
+func TestDriftBacksOffWhileTheWriteIsBlocked(t *testing.T) {
+	_, restore := setupOutput(t, `{{ range .Hosts }}{{ .Name }} {{ end }}`)
+	defer restore()
+	stub, restoreResolver := useStubNameserver(t)
+	defer restoreResolver()
+	// the guard host doesn't resolve, so no react can put the dest right
+	defer func(orig string) { guardHost = orig }(guardHost)
+	guardHost = "guard.example.com"
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	if err := ioutil.WriteFile(dest, []byte("edited\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := commandLineGroup()
+	g.changes = make(chan changeEvent, 16)
+	reacts, stop := startCountingReactor(g)
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go monitorDrift(ctx, 10*time.Millisecond, []*group{g})
+	defer wg.Wait()
+	defer cancel()
+
+	// about 30 checks, which ask to regenerate it on the 1st, 3rd, 6th, 11th and 20th
+	time.Sleep(300 * time.Millisecond)
+	if n := reacts(); n < 2 || n > 6 {
+		t.Errorf("30 drift checks caused %d reacts, want them to back off", n)
+	}
+
+	stub.set(guardHost)
+	if !eventually(func() bool { content, _ := ioutil.ReadFile(dest); return string(content) == "a " }) {
+		t.Error("the dest wasn't regenerated once the guard host resolved")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// values for -on-empty
+const (
+	onEmptyRender   = "render"
+	onEmptyKeep     = "keep"
+	onEmptyTemplate = "template"
+)
+
+// hosts whose most recent lookup returned no addresses, with their -on-empty mode
+var emptyHosts = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+func validateOnEmpty() error {
+	return validateOnEmptyMode(onEmpty)
+}
+
+// Returns an error if mode isn't a -on-empty mode, or is template without -empty-tmpl
+func validateOnEmptyMode(mode string) error {
+	switch mode {
+	case onEmptyRender, onEmptyKeep:
+		return nil
+	case onEmptyTemplate:
+		if emptyTmplPath == "" {
+			return fmt.Errorf("-on-empty template requires -empty-tmpl")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown -on-empty mode %q (expected keep, render or template)", mode)
+}
+
+// The host's own -on-empty mode, or -on-empty
+func (h hostSpec) onEmpty() string {
+	if h.OnEmpty != "" {
+		return h.OnEmpty
+	}
+	return onEmpty
+}
+
+func setEmpty(host hostSpec, empty bool) {
+	emptyHosts.Lock()
+	defer emptyHosts.Unlock()
+	if empty {
+		emptyHosts.m[host.Name] = host.onEmpty()
+	} else {
+		delete(emptyHosts.m, host.Name)
+	}
+}
+
+// Reports whether any of hosts has no addresses and is set to render -empty-tmpl when it doesn't
+func wantEmptyTemplate(hosts []Host) bool {
+	emptyHosts.Lock()
+	defer emptyHosts.Unlock()
+	for _, h := range hosts {
+		if emptyHosts.m[h.Name] == onEmptyTemplate {
+			return true
+		}
+	}
+	return false
+}
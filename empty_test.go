@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// settableResolver answers every lookup with the addresses it was last set to
+type settableResolver struct {
+	mu      sync.Mutex
+	addrs   []string
+	lookups int
+}
+
+func (r *settableResolver) Lookup(ctx context.Context, hostname string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return append([]string(nil), r.addrs...), nil
+}
+
+// Sets the addresses and waits until a lookup has started after that, and another finished
+func (r *settableResolver) set(t *testing.T, addrs ...string) {
+	t.Helper()
+	r.mu.Lock()
+	r.addrs = addrs
+	start := r.lookups
+	r.mu.Unlock()
+	ok := eventually(func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.lookups >= start+2
+	})
+	if !ok {
+		t.Fatal("the host wasn't looked up again")
+	}
+}
+
+func setupOnEmpty(t *testing.T, mode string) func() {
+	dir, restore := setupOutput(t, `{{ range .Hosts }}{{ .Name }}:{{ range .Addresses }} {{ . }}{{ end }}
+{{ end }}`)
+	emptyTmpl := filepath.Join(dir, "empty.tmpl")
+	if err := ioutil.WriteFile(emptyTmpl, []byte("empty\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	origMode, origTmpl := onEmpty, emptyTmplPath
+	onEmpty, emptyTmplPath = mode, emptyTmpl
+	return func() {
+		onEmpty, emptyTmplPath = origMode, origTmpl
+		emptyHosts.Lock()
+		emptyHosts.m = make(map[string]string)
+		emptyHosts.Unlock()
+		restore()
+	}
+}
+
+func renderCommandLine(t *testing.T) string {
+	t.Helper()
+	content, err := commandLineOutput().render(snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestOnEmpty(t *testing.T) {
+	for _, tt := range []struct {
+		mode                 string
+		before, empty, after string
+	}{
+		{onEmptyRender, "a: 10.0.0.1\n", "a:\n", "a: 10.0.0.2\n"},
+		{onEmptyKeep, "a: 10.0.0.1\n", "a: 10.0.0.1\n", "a: 10.0.0.2\n"},
+		{onEmptyTemplate, "a: 10.0.0.1\n", "empty\n", "a: 10.0.0.2\n"},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			defer setupOnEmpty(t, tt.mode)()
+			r := &settableResolver{addrs: []string{"10.0.0.1"}}
+			stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a", Resolver: r})
+			defer stop()
+
+			r.set(t, "10.0.0.1")
+			if got := renderCommandLine(t); got != tt.before {
+				t.Errorf("before: rendered %q, want %q", got, tt.before)
+			}
+			r.set(t)
+			if got := renderCommandLine(t); got != tt.empty {
+				t.Errorf("empty: rendered %q, want %q", got, tt.empty)
+			}
+			r.set(t, "10.0.0.2")
+			if got := renderCommandLine(t); got != tt.after {
+				t.Errorf("after: rendered %q, want %q", got, tt.after)
+			}
+		})
+	}
+}
+
+func TestOnEmptyPerHost(t *testing.T) {
+	defer setupOnEmpty(t, onEmptyRender)()
+	hosts, err := parseHosts([]string{"a on-empty keep", "b", "c on-empty template"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolvers := []*settableResolver{{addrs: []string{"10.0.0.1"}}, {addrs: []string{"10.0.0.2"}}, {addrs: []string{"10.0.0.3"}}}
+	for i := range hosts {
+		hosts[i].Resolver = resolvers[i]
+	}
+	stop := startMonitors(5*time.Millisecond, hosts...)
+	defer stop()
+	for _, r := range resolvers {
+		r.set(t, r.addrs...)
+	}
+
+	// a keeps its address, b renders without one
+	resolvers[0].set(t)
+	resolvers[1].set(t)
+	if got, want := renderCommandLine(t), "a: 10.0.0.1\nb:\nc: 10.0.0.3\n"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+	// c switches the whole output to -empty-tmpl until it resolves again
+	resolvers[2].set(t)
+	if got := renderCommandLine(t); got != "empty\n" {
+		t.Errorf("rendered %q, want the empty template", got)
+	}
+	resolvers[2].set(t, "10.0.0.4")
+	if got, want := renderCommandLine(t), "a: 10.0.0.1\nb:\nc: 10.0.0.4\n"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+}
+
+func TestParseHostsOnEmpty(t *testing.T) {
+	defer func(orig string) { emptyTmplPath = orig }(emptyTmplPath)
+	emptyTmplPath = ""
+	for _, args := range [][]string{
+		{"a on-empty never"},
+		{"a on-empty"},
+		// template needs -empty-tmpl
+		{"a on-empty template"},
+	} {
+		if _, err := parseHosts(args); err == nil {
+			t.Errorf("%q was accepted", args)
+		}
+	}
+	emptyTmplPath = "empty.tmpl"
+	hosts, err := parseHosts([]string{"a on-empty template", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts[0].onEmpty() != onEmptyTemplate || hosts[1].onEmpty() != onEmpty {
+		t.Errorf("got modes %q and %q", hosts[0].onEmpty(), hosts[1].onEmpty())
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fallbackFlag collects repeated -fallback hostname=addr[,addr...] flags
+type fallbackFlag map[string][]string
+
+func (f fallbackFlag) String() string {
+	var specs []string
+	for host, addresses := range f {
+		specs = append(specs, host+"="+strings.Join(addresses, ","))
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, " ")
+}
+
+func (f fallbackFlag) Set(v string) error {
+	parts := strings.SplitN(v, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected hostname=addr[,addr...], got %q", v)
+	}
+	addresses := strings.Split(parts[1], ",")
+	sortAddresses(addresses)
+	f[parts[0]] = addresses
+	return nil
+}
+
+var fallbacks = fallbackFlag{}
+
+// Substitutes the configured fallback addresses for hostname when a lookup produced none.
+// Reports whether the fallback is in use.
+func withFallback(hostname string, addresses []string) ([]string, bool) {
+	if fb, ok := fallbacks[hostname]; ok && len(addresses) == 0 {
+		return fb, true
+	}
+	return addresses, false
+}
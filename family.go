@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// values for -prefer-family
+const (
+	preferNone = "none"
+	preferIPv4 = "ipv4"
+	preferIPv6 = "ipv6"
+)
+
+type familyResult struct {
+	addresses []string
+	err       error
+	took      time.Duration
+}
+
+func validatePreferFamily() error {
+	switch preferFamily {
+	case preferNone, preferIPv4, preferIPv6:
+		return nil
+	}
+	return fmt.Errorf("unknown -prefer-family %q (expected none, ipv4 or ipv6)", preferFamily)
+}
+
+func lookupFamily(ctx context.Context, r *net.Resolver, network, hostname string) familyResult {
+	start := time.Now()
+	ips, err := r.LookupIP(ctx, network, hostname)
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	sortAddresses(addresses)
+	return familyResult{addresses: addresses, err: err, took: time.Since(start)}
+}
+
+// Resolves hostname's A and AAAA records with separate concurrent queries, so a slow answer
+// for one family doesn't hold up the other, and merges the results according to
+// -prefer-family and -happy-eyeballs. A family that fails to resolve contributes no
+// addresses and an error is only returned if both fail, unless -strict-resolver is set.
+func lookupFamilies(ctx context.Context, r *net.Resolver, hostname string) ([]string, error) {
+	v4ch, v6ch := make(chan familyResult, 1), make(chan familyResult, 1)
+	go func() { v4ch <- lookupFamily(ctx, r, "ip4", hostname) }()
+	go func() { v6ch <- lookupFamily(ctx, r, "ip6", hostname) }()
+	v4, v6 := <-v4ch, <-v6ch
+	recordFamilies(hostname, v4, v6)
+
+	if debug {
+		logDebug("lookup [%s] A => %v in %v (err: %v), AAAA => %v in %v (err: %v)",
+			hostname, logAddrs(v4.addresses), v4.took, v4.err, logAddrs(v6.addresses), v6.took, v6.err)
+	}
+	if v4.err != nil && v6.err != nil {
+		return nil, v4.err
+	}
+	if strictResolver {
+		for _, res := range []familyResult{v4, v6} {
+			// a family with no records is an answer; anything else means the result is incomplete
+			if de, ok := res.err.(*net.DNSError); res.err != nil && !(ok && de.IsNotFound) {
+				return nil, &net.DNSError{Err: "partial lookup failure: " + res.err.Error(), Name: hostname, IsTemporary: true}
+			}
+		}
+	}
+	return mergeFamilies(v4.addresses, v6.addresses), nil
+}
+
+// Combines per-family address lists. With no preference the result is simply sorted.
+// Otherwise the preferred family comes first, or with -happy-eyeballs the two families are
+// interleaved starting with the preferred one, as recommended by RFC 8305.
+func mergeFamilies(v4, v6 []string) []string {
+	if preferFamily == preferNone {
+		merged := append(append([]string{}, v4...), v6...)
+		sortAddresses(merged)
+		return merged
+	}
+
+	first, second := v4, v6
+	if preferFamily == preferIPv6 {
+		first, second = v6, v4
+	}
+	if !happyEyeballs {
+		return append(append([]string{}, first...), second...)
+	}
+	merged := make([]string, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			merged = append(merged, first[i])
+		}
+		if i < len(second) {
+			merged = append(merged, second[i])
+		}
+	}
+	return merged
+}
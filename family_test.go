@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// familyAnswer is how a familyNameserver answers queries for one record type
+type familyAnswer struct {
+	addrs []string
+	delay time.Duration
+	rcode int
+}
+
+// Starts a nameserver on a local UDP port answering each A and AAAA query with answer(qtype).
+// Returns a resolver using it and a func that stops it.
+func startFamilyNameserver(t *testing.T, answer func(qtype uint16) familyAnswer) (*net.Resolver, func()) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		a := answer(q.Qtype)
+		time.Sleep(a.delay)
+		m := new(dns.Msg)
+		m.SetRcode(req, a.rcode)
+		for _, addr := range a.addrs {
+			rr, _ := dns.NewRR(q.Name + " 60 IN " + dns.TypeToString[q.Qtype] + " " + addr)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return newResolver(pc.LocalAddr().String()), func() { srv.Shutdown() }
+}
+
+// Answers every query with the fixed answer for its type
+func fixedAnswers(answers map[uint16]familyAnswer) func(uint16) familyAnswer {
+	return func(qtype uint16) familyAnswer { return answers[qtype] }
+}
+
+func TestLookupFamiliesResolvesEachFamilyIndependently(t *testing.T) {
+	defer resetStore()
+	r, stop := startFamilyNameserver(t, fixedAnswers(map[uint16]familyAnswer{
+		dns.TypeA:    {addrs: []string{"10.0.0.2", "10.0.0.1"}},
+		dns.TypeAAAA: {addrs: []string{"fd00::1"}, delay: 200 * time.Millisecond},
+	}))
+	defer stop()
+	updateHost(Host{Name: "a.example.com"})
+
+	addresses, err := lookupFamilies(context.Background(), r, "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1", "10.0.0.2", "fd00::1"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("got %q, want %q", addresses, want)
+	}
+
+	// the slow AAAA answer didn't hold up the A one, and status shows how long each took
+	hs := currentStatus().Hosts[0]
+	if hs.Families == nil {
+		t.Fatal("status doesn't report the families' latencies")
+	}
+	if f := *hs.Families; f.IPv4MS >= 100 || f.IPv6MS < 200 {
+		t.Errorf("A took %vms and AAAA %vms, want A fast and AAAA about 200ms", f.IPv4MS, f.IPv6MS)
+	}
+}
+
+func TestLookupFamiliesWithAFailedFamily(t *testing.T) {
+	defer resetStore()
+	defer func(orig bool) { strictResolver = orig }(strictResolver)
+	r, stop := startFamilyNameserver(t, fixedAnswers(map[uint16]familyAnswer{
+		dns.TypeA:    {addrs: []string{"10.0.0.1"}},
+		dns.TypeAAAA: {rcode: dns.RcodeServerFailure},
+	}))
+	defer stop()
+
+	// the family that resolved is used on its own
+	strictResolver = false
+	addresses, err := lookupFamilies(context.Background(), r, "a.example.com")
+	if err != nil || !reflect.DeepEqual(addresses, []string{"10.0.0.1"}) {
+		t.Errorf("got %q, %v; want just the A record", addresses, err)
+	}
+	if f := store.families["a.example.com"]; f.IPv4Error != "" || f.IPv6Error == "" {
+		t.Errorf("recorded %+v, want only the AAAA lookup to have failed", f)
+	}
+
+	// unless -strict-resolver treats a partial answer as a failure
+	strictResolver = true
+	if _, err := lookupFamilies(context.Background(), r, "a.example.com"); err == nil || !isTemporary(err) {
+		t.Errorf("with -strict-resolver got %v, want a temporary error", err)
+	}
+}
+
+func TestMonitorWithAFailedFamily(t *testing.T) {
+	defer func(orig bool) { strictResolver = orig }(strictResolver)
+	for _, tt := range []struct {
+		strict bool
+		want   []string // the host's addresses once its AAAA lookups start failing
+	}{
+		{false, []string{"10.0.0.1"}},
+		{true, []string{"10.0.0.1", "fd00::1"}},
+	} {
+		t.Run(fmt.Sprintf("strict=%v", tt.strict), func(t *testing.T) {
+			defer resetStore()
+			strictResolver = tt.strict
+			var mu sync.Mutex
+			aaaa := familyAnswer{addrs: []string{"fd00::1"}}
+			r, stop := startFamilyNameserver(t, func(qtype uint16) familyAnswer {
+				if qtype == dns.TypeA {
+					return familyAnswer{addrs: []string{"10.0.0.1"}}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				return aaaa
+			})
+			defer stop()
+			stopMonitors := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: netResolver{r: r, rtype: typeHost}})
+			defer stopMonitors()
+
+			if ev, ok := nextChange(time.Second); !ok || !reflect.DeepEqual(ev.New, []string{"10.0.0.1", "fd00::1"}) {
+				t.Fatalf("got %+v, want both families' addresses", ev)
+			}
+			mu.Lock()
+			aaaa = familyAnswer{rcode: dns.RcodeServerFailure}
+			mu.Unlock()
+
+			ev, changed := nextChange(200 * time.Millisecond)
+			if changed != !tt.strict {
+				t.Fatalf("got change %+v, want a change %v", ev, !tt.strict)
+			}
+			if got := snapshot().Hosts[0].Addresses; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("host has %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupFamiliesBothFail(t *testing.T) {
+	defer resetStore()
+	r, stop := startFamilyNameserver(t, fixedAnswers(map[uint16]familyAnswer{
+		dns.TypeA:    {rcode: dns.RcodeServerFailure},
+		dns.TypeAAAA: {rcode: dns.RcodeServerFailure},
+	}))
+	defer stop()
+	if addresses, err := lookupFamilies(context.Background(), r, "a.example.com"); err == nil {
+		t.Errorf("got %q, want an error", addresses)
+	}
+}
+
+func TestMergeFamilies(t *testing.T) {
+	defer func(prefer string, eyeballs bool) { preferFamily, happyEyeballs = prefer, eyeballs }(preferFamily, happyEyeballs)
+	v4 := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	v6 := []string{"fd00::1", "fd00::2"}
+	tests := []struct {
+		prefer   string
+		eyeballs bool
+		want     []string
+	}{
+		{preferNone, false, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1", "fd00::2"}},
+		{preferIPv4, false, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "fd00::1", "fd00::2"}},
+		{preferIPv6, false, []string{"fd00::1", "fd00::2", "10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{preferIPv4, true, []string{"10.0.0.1", "fd00::1", "10.0.0.2", "fd00::2", "10.0.0.3"}},
+		{preferIPv6, true, []string{"fd00::1", "10.0.0.1", "fd00::2", "10.0.0.2", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		preferFamily, happyEyeballs = tt.prefer, tt.eyeballs
+		if got := mergeFamilies(v4, v6); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("-prefer-family %s -happy-eyeballs=%v: got %q, want %q", tt.prefer, tt.eyeballs, got, tt.want)
+		}
+	}
+	preferFamily, happyEyeballs = preferIPv6, true
+	if got := mergeFamilies(v4, nil); !reflect.DeepEqual(got, v4) {
+		t.Errorf("with no IPv6 addresses got %q", got)
+	}
+}
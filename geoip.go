@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoAddress is a resolved address along with what -geoip-db knows about it. Fields are
+// empty when the address isn't in any of the databases.
+type GeoAddress struct {
+	Address string `json:"address"`
+	Country string `json:"country,omitempty"`
+	City    string `json:"city,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// the fields read from GeoIP2/GeoLite2 City, Country and ASN databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// databases opened from -geoip-db
+var geoDBs []*maxminddb.Reader
+
+// Opens each database in a comma separated list, e.g. a City and an ASN database
+func openGeoDBs(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			return err
+		}
+		geoDBs = append(geoDBs, db)
+	}
+	return nil
+}
+
+// Looks up each address in every -geoip-db database. Returns nil if none are configured.
+func geoLookup(addresses []string) []GeoAddress {
+	if len(geoDBs) == 0 {
+		return nil
+	}
+	enriched := make([]GeoAddress, len(addresses))
+	for i, addr := range addresses {
+		enriched[i].Address = addr
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		for _, db := range geoDBs {
+			var rec geoRecord
+			if err := db.Lookup(ip, &rec); err != nil {
+				continue
+			}
+			if rec.Country.ISOCode != "" {
+				enriched[i].Country = rec.Country.ISOCode
+			}
+			if name := rec.City.Names["en"]; name != "" {
+				enriched[i].City = name
+			}
+			if rec.ASN != 0 {
+				enriched[i].ASN, enriched[i].ASOrg = rec.ASN, rec.ASOrg
+			}
+		}
+	}
+	return enriched
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Encoders for the few MaxMind DB data types the test databases need
+func mmdbString(s string) []byte {
+	if len(s) < 29 {
+		return append([]byte{2<<5 | byte(len(s))}, s...)
+	}
+	// longer strings give their size as 29 plus the following byte
+	return append([]byte{2<<5 | 29, byte(len(s) - 29)}, s...)
+}
+
+func mmdbUint32(v uint32) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{6<<5 | byte(len(b))}, b...)
+}
+
+// Encodes a map from alternating keys and values
+func mmdbMap(kv ...[]byte) []byte {
+	m := []byte{7<<5 | byte(len(kv)/2)}
+	for _, b := range kv {
+		m = append(m, b...)
+	}
+	return m
+}
+
+type mmdbNetwork struct {
+	cidr string
+	data []byte
+}
+
+// Builds an IPv4 MaxMind DB with 24 bit records mapping each network to its data. Networks
+// mustn't overlap.
+func buildMMDB(t *testing.T, networks ...mmdbNetwork) []byte {
+	t.Helper()
+	// each node's left and right records: a node index, 0 for no data (the root is never a
+	// child), or -(offset+1) for data at offset in the data section
+	nodes := [][2]int{{}}
+	var data []byte
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipnet.IP.To4()
+		ones, _ := ipnet.Mask.Size()
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = -(len(data) + 1)
+				break
+			}
+			if nodes[node][bit] <= 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		data = append(data, n.data...)
+	}
+
+	count := len(nodes)
+	var db []byte
+	for _, node := range nodes {
+		for _, rec := range node {
+			v := rec
+			switch {
+			case rec == 0:
+				v = count
+			case rec < 0:
+				v = count + 16 + -rec - 1
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	return append(db, mmdbMap(
+		mmdbString("binary_format_major_version"), mmdbUint32(2),
+		mmdbString("ip_version"), mmdbUint32(4),
+		mmdbString("node_count"), mmdbUint32(uint32(count)),
+		mmdbString("record_size"), mmdbUint32(24),
+	)...)
+}
+
+// Writes a City and an ASN database and opens them as -geoip-db. Returns a func that closes
+// and removes them.
+func setupGeoDBs(t *testing.T) func() {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dns-gen-geoip-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	city := buildMMDB(t,
+		mmdbNetwork{"10.0.0.0/8", mmdbMap(
+			mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("NL")),
+			mmdbString("city"), mmdbMap(mmdbString("names"), mmdbMap(mmdbString("en"), mmdbString("Amsterdam"))),
+		)},
+		mmdbNetwork{"192.0.2.0/24", mmdbMap(
+			mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString("US")),
+		)},
+	)
+	asn := buildMMDB(t,
+		mmdbNetwork{"10.0.0.0/16", mmdbMap(
+			mmdbString("autonomous_system_number"), mmdbUint32(64500),
+			mmdbString("autonomous_system_organization"), mmdbString("Example Networks"),
+		)},
+	)
+	for name, db := range map[string][]byte{"city.mmdb": city, "asn.mmdb": asn} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), db, 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	if err := openGeoDBs(filepath.Join(dir, "city.mmdb") + ", " + filepath.Join(dir, "asn.mmdb")); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return func() {
+		for _, db := range geoDBs {
+			db.Close()
+		}
+		geoDBs = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGeoLookup(t *testing.T) {
+	if got := geoLookup([]string{"10.0.0.1"}); got != nil {
+		t.Errorf("without -geoip-db got %+v", got)
+	}
+
+	cleanup := setupGeoDBs(t)
+	defer cleanup()
+	got := geoLookup([]string{"10.0.0.1", "10.1.0.1", "192.0.2.1", "172.16.0.1", "fd00::1", "a.example.com"})
+	want := []GeoAddress{
+		// what each database knows about the address is combined
+		{Address: "10.0.0.1", Country: "NL", City: "Amsterdam", ASN: 64500, ASOrg: "Example Networks"},
+		{Address: "10.1.0.1", Country: "NL", City: "Amsterdam"},
+		{Address: "192.0.2.1", Country: "US"},
+		// addresses the databases don't know or can't look up are listed without anything
+		{Address: "172.16.0.1"},
+		{Address: "fd00::1"},
+		{Address: "a.example.com"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
+
+func TestOpenGeoDBsErrors(t *testing.T) {
+	defer func() { geoDBs = nil }()
+	if err := openGeoDBs(filepath.Join(os.TempDir(), "no-such-db.mmdb")); err == nil {
+		t.Error("a missing database opened")
+	}
+}
@@ -4,6 +4,13 @@ go 1.13
 
 require (
 	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/golang/protobuf v1.3.3
+	github.com/miekg/dns v1.1.50
+	github.com/nats-io/nats.go v1.13.0
+	github.com/oschwald/maxminddb-golang v1.10.0
+	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985
 	golang.org/x/sys v0.1.0 // indirect
+	google.golang.org/grpc v1.29.1
 	gopkg.in/fsnotify.v1 v1.4.2
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// group is a set of hosts that are monitored together and rendered to the same output. The
+// command line describes a single group; -config describes several, which run side by side in
+// this process with their own monitors and reactor, sharing everything else (resolvers,
+// status, metrics...).
+type group struct {
+	name     string
+	hosts    []hostSpec
+	interval time.Duration
+	outputs  []output
+	// run after a reaction that wrote its output
+	exec command
+	// the group's change queue, read by its reactor
+	changes chan changeEvent
+	// the hosts rendered for this group; nil renders every host in the store, which is what the
+	// command line group does so that hosts found by -axfr, -k8s-service etc. are included
+	names map[string]bool
+	// stage every output before replacing any, see writeTogether
+	transactional bool
+
+	seedMu sync.Mutex
+	// the shuffle seeds of the last reaction that changed an output, which renders reuse for
+	// the address sets that haven't changed since, so that shuffling alone never changes a dest
+	shuffleSeeds map[uint64]int64
+
+	// what each output written to a file was last rendered from, by dest, see renderOutput.
+	// Only used by reactions, which never overlap.
+	sections map[string]*sectionState
+}
+
+// output is a rendering of a group's hosts: the template at tmpl, or with json or simple, the
+// -json or -simple format. It is written to dest, or stdout when dest is empty, and exec is run
+// when a reaction changed it.
+type output struct {
+	tmpl   string
+	json   bool
+	simple bool
+	dest   string
+	exec   command
+}
+
+// command is what runs after a reaction: a shell command, or argv run directly. Either may be
+// empty, in which case nothing runs.
+type command struct {
+	shell string
+	argv  []string
+}
+
+func (c command) empty() bool {
+	return c.shell == "" && len(c.argv) == 0
+}
+
+// number of formats (-tmpl, -json, -simple) the output is set to render
+func (o output) modes() int {
+	n := 0
+	for _, enabled := range []bool{o.tmpl != "", o.json, o.simple} {
+		if enabled {
+			n++
+		}
+	}
+	return n
+}
+
+// Produces the output's content from ctx: the rendered template or, with -json, a JSON
+// document of ctx, or with -simple, the -simple-format output
+func (o output) render(ctx RenderContext) ([]byte, error) {
+	switch {
+	case o.simple:
+		return renderSimple(ctx.Hosts), nil
+	case o.json:
+		content, err := json.MarshalIndent(ctx, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(content, '\n'), nil
+	case wantEmptyTemplate(ctx.Hosts):
+		return ctx.execTemplateFile(emptyTmplPath)
+	default:
+		return ctx.execTemplateFile(o.tmpl)
+	}
+}
+
+// Names the output for logs and metrics: the template's path, or -json or -simple. Empty when
+// nothing is rendered.
+func (o output) name() string {
+	switch {
+	case o.tmpl != "":
+		return o.tmpl
+	case o.json:
+		return "-json"
+	case o.simple:
+		return "-simple"
+	}
+	return ""
+}
+
+// The output described by -tmpl, -json, -simple and -dest
+func commandLineOutput() output {
+	return output{tmpl: tmplPath, json: jsonOutput, simple: simple, dest: dest}
+}
+
+// outputsFlag collects repeated -output tmpl=PATH,dest=PATH[,exec=CMD] flags
+type outputsFlag []output
+
+func (f *outputsFlag) String() string {
+	var specs []string
+	for _, o := range *f {
+		spec := "tmpl=" + o.tmpl + ",dest=" + o.dest
+		if o.exec.shell != "" {
+			spec += ",exec=" + o.exec.shell
+		}
+		specs = append(specs, spec)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (f *outputsFlag) Set(v string) error {
+	var o output
+	for rest := v; rest != ""; {
+		kv := strings.SplitN(rest, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("expected tmpl=PATH,dest=PATH[,exec=CMD], got %q", v)
+		}
+		// the command comes last and may itself contain commas
+		value := kv[1]
+		rest = ""
+		if kv[0] != "exec" {
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value, rest = value[:i], value[i+1:]
+			}
+		}
+		if value == "" {
+			return fmt.Errorf("expected tmpl=PATH,dest=PATH[,exec=CMD], got %q", v)
+		}
+		switch kv[0] {
+		case "tmpl":
+			o.tmpl = value
+		case "dest":
+			o.dest = value
+		case "exec":
+			o.exec.shell = value
+		default:
+			return fmt.Errorf("unknown -output field %q", kv[0])
+		}
+	}
+	if o.tmpl == "" || o.dest == "" {
+		return fmt.Errorf("expected tmpl=PATH,dest=PATH[,exec=CMD], got %q", v)
+	}
+	*f = append(*f, o)
+	return nil
+}
+
+var extraOutputs outputsFlag
+
+// The command described by -exec or -exec-argv
+func commandLineCommand() command {
+	return command{shell: execute, argv: execArgv}
+}
+
+// The group described by the command line: its hosts come from the arguments and -hosts-file,
+// its outputs from -tmpl, -json or -simple followed by each -output, and its changes go to the
+// package-level queue
+func commandLineGroup() *group {
+	g := &group{interval: interval, exec: commandLineCommand(), changes: changes, transactional: transactional}
+	if o := commandLineOutput(); o.modes() > 0 {
+		g.outputs = []output{o}
+	}
+	g.outputs = append(g.outputs, extraOutputs...)
+	return g
+}
+
+// Builds the groups in a -config file. Settings a group leaves out are taken from the command
+// line, so -inter, -tmpl, -dest and -exec act as defaults for every group.
+func configGroups(cfg *config) ([]*group, error) {
+	var groups []*group
+	for _, gc := range cfg.Groups {
+		hosts, err := parseHosts(gc.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %v", gc.Name, err)
+		}
+		g := &group{
+			name:          gc.Name,
+			hosts:         hosts,
+			interval:      interval,
+			exec:          commandLineCommand(),
+			changes:       make(chan changeEvent, cap(changes)),
+			names:         make(map[string]bool, len(hosts)),
+			transactional: transactional || gc.Transactional,
+		}
+		for _, h := range hosts {
+			g.names[h.Name] = true
+		}
+		if gc.Interval != 0 {
+			g.interval = gc.Interval
+		}
+		o := commandLineOutput()
+		if gc.Template != "" {
+			o.tmpl = gc.Template
+		}
+		if gc.Dest != "" {
+			o.dest = gc.Dest
+		}
+		if o.modes() > 1 {
+			return nil, fmt.Errorf("group %q: template can't be combined with -json or -simple", gc.Name)
+		}
+		if o.modes() > 0 {
+			g.outputs = []output{o}
+		}
+		for _, oc := range gc.Outputs {
+			if oc.Template == "" || oc.Dest == "" {
+				return nil, fmt.Errorf("group %q: outputs need a template and a dest", gc.Name)
+			}
+			g.outputs = append(g.outputs, output{tmpl: oc.Template, dest: oc.Dest, exec: command{shell: oc.Exec}})
+		}
+		if gc.Exec != "" {
+			g.exec = command{shell: gc.Exec}
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// Returns a snapshot of the group's hosts, seeded to shuffle them as the last reaction did
+func (g *group) snapshot() RenderContext {
+	rc := snapshotHosts(g.names)
+	g.seedMu.Lock()
+	rc.seeds = newShuffleSeeds(g.shuffleSeeds)
+	g.seedMu.Unlock()
+	return rc
+}
+
+func (g *group) setShuffleSeeds(seeds map[uint64]int64) {
+	g.seedMu.Lock()
+	defer g.seedMu.Unlock()
+	g.shuffleSeeds = seeds
+}
+
+// Starts a monitor for each of the group's hosts, reporting their changes to the group's
+// reactor
+func (g *group) monitor(ctx context.Context) {
+	names := make([]string, 0, len(g.hosts))
+	for _, h := range g.hosts {
+		if h.Server != "" {
+			names = append(names, h.Name+" via "+h.Server)
+		} else {
+			names = append(names, h.Name)
+		}
+	}
+	registerHosts(g.hosts)
+	if g.name != "" {
+		logInfo("Monitoring %d hosts of group %s every %v: %+v", len(g.hosts), g.name, g.interval, names)
+	} else {
+		logInfo("Monitoring %d hosts every %v: %+v", len(g.hosts), g.interval, names)
+	}
+	for i, host := range g.hosts {
+		// spread the first lookups evenly over -startup-spread so they don't all hit the
+		// resolver at once
+		host.StartOffset = startupSpread * time.Duration(i) / time.Duration(len(g.hosts))
+		host.Changes = g.changes
+		wg.Add(1)
+		go monitor(ctx, host, g.interval)
+	}
+}
+
+// Returns an error if two outputs of groups write to the same dest
+func checkDests(groups []*group) error {
+	seen := make(map[string]string)
+	for _, g := range groups {
+		for _, o := range g.outputs {
+			if o.dest == "" {
+				continue
+			}
+			if other, ok := seen[o.dest]; ok {
+				return fmt.Errorf("%s and %s are both rendered to %s", other, o.name(), o.dest)
+			}
+			seen[o.dest] = o.name()
+		}
+	}
+	return nil
+}
+
+// Returns every template rendered by groups, each once and sorted
+func groupTemplates(groups []*group) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, g := range groups {
+		for _, o := range g.outputs {
+			if o.tmpl != "" && !seen[o.tmpl] {
+				seen[o.tmpl] = true
+				paths = append(paths, o.tmpl)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Returns the name of every output of groups, for reporting each before its first render
+func groupOutputNames(groups []*group) []string {
+	var names []string
+	for _, g := range groups {
+		for _, o := range g.outputs {
+			if name := o.name(); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOutputsFlag(t *testing.T) {
+	var f outputsFlag
+	if err := f.Set("tmpl=a.tmpl,dest=/etc/a.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (outputsFlag{{tmpl: "a.tmpl", dest: "/etc/a.conf"}}); !reflect.DeepEqual(f, want) {
+		t.Errorf("got %+v, want %+v", f, want)
+	}
+	if err := f.Set("tmpl=b.tmpl,exec=nginx -s reload, or else,dest=/etc/b.conf"); err == nil {
+		t.Error("a field after exec was accepted")
+	}
+	if err := f.Set("dest=/etc/b.conf,tmpl=b.tmpl,exec=reload b,c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := f[1]; got.tmpl != "b.tmpl" || got.dest != "/etc/b.conf" || got.exec.shell != "reload b,c" {
+		t.Errorf("got %+v, want the command to keep its comma", got)
+	}
+	for _, v := range []string{"a.tmpl", "tmpl=a.tmpl", "dest=/etc/a.conf", "tmpl=a.tmpl,dest=", "tmpl=a.tmpl,dest=a,mode=0644", "tmpl=a.tmpl,dest=a,exec="} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("-output %q was accepted", v)
+		}
+	}
+}
+
+func TestCheckDests(t *testing.T) {
+	groups := []*group{
+		{outputs: []output{{tmpl: "a.tmpl", dest: "/etc/a.conf"}, {json: true}}},
+		{outputs: []output{{tmpl: "b.tmpl", dest: "/etc/b.conf"}, {simple: true}}},
+	}
+	if err := checkDests(groups); err != nil {
+		t.Errorf("distinct dests were rejected: %v", err)
+	}
+	groups[1].outputs[0].dest = "/etc/a.conf"
+	if err := checkDests(groups); err == nil {
+		t.Error("two outputs rendered to the same dest were accepted")
+	}
+}
+
+func TestOutputsRenderFromOneSnapshot(t *testing.T) {
+	dir, restore := setupOutput(t, `{{ range .Hosts }}{{ mutate }}{{ .Name }} {{ .Addresses }}
+{{ end }}`)
+	defer restore()
+	second := filepath.Join(dir, "second.tmpl")
+	if err := ioutil.WriteFile(second, []byte(`{{ range .Hosts }}{{ .Name }} {{ .Addresses }}
+{{ end }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secondDest := filepath.Join(dir, "second.out")
+	defer func() { extraOutputs = nil }()
+	extraOutputs = outputsFlag{{tmpl: second, dest: secondDest}}
+
+	// the first template changes the store while it renders; the second must not see it
+	Funcs["mutate"] = func() string {
+		updateHost(Host{Name: "a", Addresses: []string{"10.0.0.2"}})
+		return ""
+	}
+	defer delete(Funcs, "mutate")
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	first, _ := ioutil.ReadFile(dest)
+	got, _ := ioutil.ReadFile(secondDest)
+	if want := "a [10.0.0.1]\n"; string(first) != want || string(got) != want {
+		t.Errorf("outputs are %q and %q, want both %q", first, got, want)
+	}
+}
+
+func TestOutputExecRunsOnlyWhenItsOutputChanged(t *testing.T) {
+	dir, restore := setupOutput(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }}`)
+	defer restore()
+	static := filepath.Join(dir, "static.tmpl")
+	if err := ioutil.WriteFile(static, []byte("static\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ran := filepath.Join(dir, "ran")
+	defer func() { extraOutputs = nil }()
+	extraOutputs = outputsFlag{
+		{tmpl: tmplPath, dest: filepath.Join(dir, "a.out"), exec: command{shell: "echo a >> " + ran}},
+		{tmpl: static, dest: filepath.Join(dir, "b.out"), exec: command{shell: "echo b >> " + ran}},
+	}
+
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	if got, _ := ioutil.ReadFile(ran); string(got) != "a\nb\n" {
+		t.Errorf("after creating both outputs, ran %q; want both commands", got)
+	}
+
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.2"}})
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	if got, _ := ioutil.ReadFile(ran); string(got) != "a\nb\na\n" {
+		t.Errorf("after changing only a.out, ran %q; want only its command", got)
+	}
+
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	if got, _ := ioutil.ReadFile(ran); string(got) != "a\nb\na\n" {
+		t.Errorf("after a reaction that changed nothing, ran %q", got)
+	}
+}
+
+func TestTransactionalWriteCommitsAllOrNothing(t *testing.T) {
+	dir, restore := setupOutput(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }}`)
+	defer restore()
+	second := filepath.Join(dir, "second.tmpl")
+	if err := ioutil.WriteFile(second, []byte(`{{ range .Hosts }}{{ .Addresses }}{{ end }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	secondDest := filepath.Join(dir, "second.out")
+	defer func() { extraOutputs, transactional = nil, false }()
+	extraOutputs = outputsFlag{{tmpl: second, dest: secondDest}}
+	transactional = true
+
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+
+	// the second template breaks, so neither file may take the new addresses
+	if err := ioutil.WriteFile(second, []byte(`{{ .Missing.Field }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.2"}})
+	if result := react(context.Background(), nil); result.Err() == nil {
+		t.Fatal("react succeeded with a broken template")
+	}
+	for _, path := range []string{dest, secondDest} {
+		if got, _ := ioutil.ReadFile(path); string(got) != "[10.0.0.1]" {
+			t.Errorf("%s = %q after a failed render, want it unchanged", filepath.Base(path), got)
+		}
+	}
+
+	// so does a -check that rejects only the second, after the first was staged, and no temp
+	// files are left behind
+	if err := ioutil.WriteFile(second, []byte(`second {{ range .Hosts }}{{ .Addresses }}{{ end }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { checkTmpl = nil }()
+	if err := parseCheck(`! grep -q second {{.}} || test -e ` + filepath.Join(dir, "ok")); err != nil {
+		t.Fatal(err)
+	}
+	if result := react(context.Background(), nil); result.Err() == nil {
+		t.Fatal("react succeeded with a failing -check")
+	}
+	for _, path := range []string{dest, secondDest} {
+		if got, _ := ioutil.ReadFile(path); string(got) != "[10.0.0.1]" {
+			t.Errorf("%s = %q after a failed check, want it unchanged", filepath.Base(path), got)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 4 {
+		t.Errorf("temp files were left in %s: %d entries", dir, len(entries))
+	}
+
+	// once everything passes, both are updated
+	if err := ioutil.WriteFile(filepath.Join(dir, "ok"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result := react(context.Background(), nil); result.Err() != nil || !result.Changed {
+		t.Fatalf("react = %v, changed %v", result.Err(), result.Changed)
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "[10.0.0.2]" {
+		t.Errorf("out = %q, want the new addresses", got)
+	}
+	if got, _ := ioutil.ReadFile(secondDest); string(got) != "second [10.0.0.2]" {
+		t.Errorf("second.out = %q, want the new addresses", got)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	_, restore := setupOutput(t, "")
+	defer restore()
+	defer func(tmpl string, enabled bool) { tmplPath, jsonOutput = tmpl, enabled }(tmplPath, jsonOutput)
+	tmplPath, jsonOutput = "", true
+
+	type jsonHost struct {
+		Name          string   `json:"name"`
+		Addresses     []string `json:"addresses"`
+		UsingFallback bool     `json:"using_fallback"`
+	}
+	read := func() []jsonHost {
+		t.Helper()
+		content, err := ioutil.ReadFile(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc struct {
+			Hosts []jsonHost `json:"hosts"`
+		}
+		if err := json.Unmarshal(content, &doc); err != nil {
+			t.Fatalf("%s isn't JSON: %v\n%s", dest, err, content)
+		}
+		return doc.Hosts
+	}
+
+	updateHost(Host{Name: "b", Addresses: []string{"10.0.0.2"}})
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1", "fd00::1"}, UsingFallback: true})
+	if result := react(context.Background(), nil); result.Err() != nil || !result.Changed {
+		t.Fatalf("react = %v, changed %v", result.Err(), result.Changed)
+	}
+	want := []jsonHost{
+		{Name: "a", Addresses: []string{"10.0.0.1", "fd00::1"}, UsingFallback: true},
+		{Name: "b", Addresses: []string{"10.0.0.2"}},
+	}
+	if got := read(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// an unchanged document isn't rewritten
+	if result := react(context.Background(), nil); result.Err() != nil || result.Changed {
+		t.Errorf("re-rendering the same hosts: react = %v, changed %v", result.Err(), result.Changed)
+	}
+
+	updateHost(Host{Name: "b", Addresses: []string{"10.0.0.3"}})
+	if result := react(context.Background(), nil); result.Err() != nil || !result.Changed {
+		t.Fatalf("react = %v, changed %v", result.Err(), result.Changed)
+	}
+	want[1].Addresses = []string{"10.0.0.3"}
+	if got := read(); !reflect.DeepEqual(got, want) {
+		t.Errorf("after a change got %+v, want %+v", got, want)
+	}
+}
+
+// firstLookupResolver records when it was first asked to look a host up
+type firstLookupResolver struct {
+	at chan time.Time
+}
+
+func (r firstLookupResolver) Lookup(ctx context.Context, hostname string) ([]string, error) {
+	select {
+	case r.at <- time.Now():
+	default:
+	}
+	return []string{"10.0.0.1"}, nil
+}
+
+func TestStartupSpread(t *testing.T) {
+	defer resetStore()
+	defer func(delay, spread time.Duration) { startupDelay, startupSpread = delay, spread }(startupDelay, startupSpread)
+	startupDelay, startupSpread = 0, 200*time.Millisecond
+
+	g := &group{interval: time.Hour, changes: make(chan changeEvent, 16)}
+	var resolvers []firstLookupResolver
+	for _, name := range []string{"a", "b", "c", "d"} {
+		r := firstLookupResolver{at: make(chan time.Time, 1)}
+		resolvers = append(resolvers, r)
+		g.hosts = append(g.hosts, hostSpec{Name: name, Resolver: r})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	g.monitor(ctx)
+	defer wg.Wait()
+	defer cancel()
+
+	// the hosts are looked up 0, 50, 100 and 150ms in, all within the window
+	for i, r := range resolvers {
+		select {
+		case at := <-r.at:
+			want := startupSpread * time.Duration(i) / time.Duration(len(resolvers))
+			if offset := at.Sub(start); offset < want || offset > want+40*time.Millisecond {
+				t.Errorf("host %d was first looked up %v in, want %v", i, offset, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("host %d was never looked up", i)
+		}
+	}
+}
+
+func TestStartupSpreadZeroLooksUpAtOnce(t *testing.T) {
+	defer resetStore()
+	defer func(delay, spread time.Duration) { startupDelay, startupSpread = delay, spread }(startupDelay, startupSpread)
+	startupDelay, startupSpread = 0, 0
+
+	r := firstLookupResolver{at: make(chan time.Time, 3)}
+	g := &group{interval: time.Hour, changes: make(chan changeEvent, 16)}
+	for _, name := range []string{"a", "b", "c"} {
+		g.hosts = append(g.hosts, hostSpec{Name: name, Resolver: r})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.monitor(ctx)
+	defer wg.Wait()
+	defer cancel()
+
+	for i := range g.hosts {
+		select {
+		case <-r.at:
+		case <-time.After(50 * time.Millisecond):
+			t.Fatalf("only %d of %d hosts were looked up right away", i, len(g.hosts))
+		}
+	}
+}
+
+func TestStartupDelay(t *testing.T) {
+	defer resetStore()
+	defer func(delay, spread time.Duration) { startupDelay, startupSpread = delay, spread }(startupDelay, startupSpread)
+	startupDelay, startupSpread = 100*time.Millisecond, 0
+
+	r := firstLookupResolver{at: make(chan time.Time, 1)}
+	g := &group{interval: time.Hour, changes: make(chan changeEvent, 16), hosts: []hostSpec{{Name: "a", Resolver: r}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	start := time.Now()
+	g.monitor(ctx)
+	defer wg.Wait()
+	defer cancel()
+
+	select {
+	case at := <-r.at:
+		if offset := at.Sub(start); offset < startupDelay {
+			t.Errorf("first lookup was %v in, want it put off for %v", offset, startupDelay)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the host was never looked up")
+	}
+}
+
+func TestStartupDelayStopsOnShutdown(t *testing.T) {
+	defer resetStore()
+	defer func(delay, spread time.Duration) { startupDelay, startupSpread = delay, spread }(startupDelay, startupSpread)
+	startupDelay, startupSpread = time.Hour, 0
+
+	r := firstLookupResolver{at: make(chan time.Time, 1)}
+	g := &group{interval: time.Hour, changes: make(chan changeEvent, 16), hosts: []hostSpec{{Name: "a", Resolver: r}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	g.monitor(ctx)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the monitor didn't stop during -startup-delay")
+	}
+	select {
+	case <-r.at:
+		t.Error("the host was looked up though dns-gen stopped during -startup-delay")
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// WatchRequest and HostChange are the messages of dnsgen.proto
+type WatchRequest struct {
+	Hosts []string `protobuf:"bytes,1,rep,name=hosts,proto3" json:"hosts,omitempty"`
+}
+
+func (m *WatchRequest) Reset()         { *m = WatchRequest{} }
+func (m *WatchRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()    {}
+
+type HostChange struct {
+	Host         string          `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+	OldAddresses []string        `protobuf:"bytes,2,rep,name=old_addresses,json=oldAddresses,proto3" json:"old_addresses,omitempty"`
+	NewAddresses []string        `protobuf:"bytes,3,rep,name=new_addresses,json=newAddresses,proto3" json:"new_addresses,omitempty"`
+	At           *tspb.Timestamp `protobuf:"bytes,4,opt,name=at,proto3" json:"at,omitempty"`
+}
+
+func (m *HostChange) Reset()         { *m = HostChange{} }
+func (m *HostChange) String() string { return proto.CompactTextString(m) }
+func (*HostChange) ProtoMessage()    {}
+
+// dnsgenServer is the DNSGen service of dnsgen.proto
+type dnsgenServer interface {
+	Watch(*WatchRequest, grpc.ServerStream) error
+}
+
+var dnsgenServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dnsgen.DNSGen",
+	HandlerType: (*dnsgenServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Watch",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := new(WatchRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(dnsgenServer).Watch(req, stream)
+		},
+		ServerStreams: true,
+	}},
+	Metadata: "dnsgen.proto",
+}
+
+// how many changes a Watch stream can fall behind by before it's dropped
+const watchQueueSize = 256
+
+// watcher is a Watch stream's subscription to changes
+type watcher struct {
+	// the hosts it wants changes to, nil for every host
+	hosts map[string]bool
+	// changes not sent yet
+	queue chan *HostChange
+	// closed when the stream is dropped for falling behind
+	dropped chan struct{}
+}
+
+// every Watch stream currently open
+var watchers = struct {
+	sync.Mutex
+	set map[*watcher]bool
+}{set: make(map[*watcher]bool)}
+
+func addWatcher(hosts []string) *watcher {
+	w := &watcher{queue: make(chan *HostChange, watchQueueSize), dropped: make(chan struct{})}
+	if len(hosts) > 0 {
+		w.hosts = make(map[string]bool, len(hosts))
+		for _, h := range hosts {
+			w.hosts[h] = true
+		}
+	}
+	watchers.Lock()
+	defer watchers.Unlock()
+	watchers.set[w] = true
+	return w
+}
+
+func removeWatcher(w *watcher) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	delete(watchers.set, w)
+}
+
+// Queues ev for every Watch stream that wants it, without waiting: a stream whose queue is full
+// because its client isn't keeping up is dropped instead, so a slow client never holds up the
+// monitors or the other streams
+func broadcastChange(ev changeEvent) {
+	watchers.Lock()
+	defer watchers.Unlock()
+	if len(watchers.set) == 0 {
+		return
+	}
+	at, err := ptypes.TimestampProto(ev.At)
+	if err != nil {
+		logError("failed to stream change to %s: %v", ev.Host, err)
+		return
+	}
+	msg := &HostChange{Host: ev.Host, OldAddresses: ev.Old, NewAddresses: ev.New, At: at}
+	for w := range watchers.set {
+		if w.hosts != nil && !w.hosts[ev.Host] {
+			continue
+		}
+		select {
+		case w.queue <- msg:
+		default:
+			logWarn("dropping a -grpc-addr Watch stream that fell %d changes behind", watchQueueSize)
+			delete(watchers.set, w)
+			close(w.dropped)
+		}
+	}
+}
+
+// grpcServer implements dnsgenServer
+type grpcServer struct{}
+
+// Sends the changes to req's hosts to stream as they happen, until the client goes away or
+// falls too far behind
+func (grpcServer) Watch(req *WatchRequest, stream grpc.ServerStream) error {
+	w := addWatcher(req.Hosts)
+	defer removeWatcher(w)
+	for {
+		select {
+		case msg := <-w.queue:
+			if err := stream.SendMsg(msg); err != nil {
+				return err
+			}
+		case <-w.dropped:
+			return grpcstatus.Errorf(codes.ResourceExhausted, "fell more than %d changes behind", watchQueueSize)
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func newGRPCServer() *grpc.Server {
+	s := grpc.NewServer()
+	s.RegisterService(&dnsgenServiceDesc, grpcServer{})
+	return s
+}
+
+// Starts serving the gRPC API of dnsgen.proto on addr
+func serveGRPC(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go newGRPCServer().Serve(l)
+	return nil
+}
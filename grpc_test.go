@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func watcherCount() int {
+	watchers.Lock()
+	defer watchers.Unlock()
+	return len(watchers.set)
+}
+
+// Serves the gRPC API in-process and connects a client to it. Returns the connection and a
+// func that closes it and stops the server.
+func startGRPC(t *testing.T) (*grpc.ClientConn, func()) {
+	t.Helper()
+	l := bufconn.Listen(1 << 16)
+	s := newGRPCServer()
+	go s.Serve(l)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.Dial() }))
+	if err != nil {
+		s.Stop()
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Stop()
+	}
+}
+
+// Calls Watch for hosts and waits for the server to subscribe it
+func watch(t *testing.T, ctx context.Context, conn *grpc.ClientConn, hosts ...string) grpc.ClientStream {
+	t.Helper()
+	before := watcherCount()
+	stream, err := conn.NewStream(ctx, &dnsgenServiceDesc.Streams[0], "/dnsgen.DNSGen/Watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&WatchRequest{Hosts: hosts}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return watcherCount() == before+1 }) {
+		t.Fatal("the Watch call wasn't subscribed")
+	}
+	return stream
+}
+
+func TestGRPCWatch(t *testing.T) {
+	conn, stop := startGRPC(t)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	all := watch(t, ctx, conn)
+	onlyB := watch(t, ctx, conn, "b.example.com")
+
+	reportChange(context.Background(), nil, "a.example.com", nil, []string{"10.0.0.1"})
+	reportChange(context.Background(), nil, "b.example.com", []string{"10.0.0.1"}, []string{"10.0.0.2", "10.0.0.3"})
+	if len(changes) != 2 {
+		t.Errorf("%d changes queued for the reactor, want both", len(changes))
+	}
+	<-changes
+	<-changes
+
+	recv := func(stream grpc.ClientStream) HostChange {
+		t.Helper()
+		var got HostChange
+		if err := stream.RecvMsg(&got); err != nil {
+			t.Fatal(err)
+		}
+		if at, err := ptypes.Timestamp(got.At); err != nil || time.Since(at) > time.Minute {
+			t.Errorf("change to %s at %v (%v)", got.Host, got.At, err)
+		}
+		got.At = nil
+		return got
+	}
+	a := HostChange{Host: "a.example.com", NewAddresses: []string{"10.0.0.1"}}
+	b := HostChange{Host: "b.example.com", OldAddresses: []string{"10.0.0.1"}, NewAddresses: []string{"10.0.0.2", "10.0.0.3"}}
+	for _, want := range []HostChange{a, b} {
+		if got := recv(all); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	if got := recv(onlyB); !reflect.DeepEqual(got, b) {
+		t.Errorf("watching b, got %+v, want %+v", got, b)
+	}
+
+	// a client that goes away is unsubscribed
+	cancel()
+	if !eventually(func() bool { return watcherCount() == 0 }) {
+		t.Errorf("%d watchers left after the clients went away", watcherCount())
+	}
+}
+
+func TestGRPCWatchDropsASlowClient(t *testing.T) {
+	conn, stop := startGRPC(t)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream := watch(t, ctx, conn)
+	watchers.Lock()
+	var w *watcher
+	for w = range watchers.set {
+	}
+	watchers.Unlock()
+
+	// the client doesn't read, so once the connection's buffers are full the server can't send
+	// and the changes back up
+	addrs := make([]string, 1000)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+	}
+	sent := 0
+	for dropped := false; !dropped; sent++ {
+		if sent > 100*watchQueueSize {
+			t.Fatal("the slow client was never dropped")
+		}
+		broadcastChange(changeEvent{Host: "a.example.com", New: addrs, At: time.Now()})
+		select {
+		case <-w.dropped:
+			dropped = true
+		default:
+		}
+	}
+	if n := watcherCount(); n != 0 {
+		t.Errorf("%d watchers left after dropping the slow one", n)
+	}
+
+	// it may still get some of the changes queued before the drop, then the stream ends
+	received := 0
+	for {
+		var got HostChange
+		err := stream.RecvMsg(&got)
+		if err == nil {
+			received++
+			continue
+		}
+		if code := grpcstatus.Code(err); code != codes.ResourceExhausted {
+			t.Errorf("stream ended with %v, want RESOURCE_EXHAUSTED", err)
+		}
+		break
+	}
+	if received >= sent {
+		t.Errorf("received all %d changes, want the ones after the drop missing", sent)
+	}
+}
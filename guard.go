@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// set when a react was skipped because the guard host didn't resolve
+var guard struct {
+	sync.Mutex
+	pending bool
+}
+
+// Reports an error if -guard-host doesn't currently resolve. The failed react is remembered
+// so it can be applied once the guard host recovers.
+func checkGuard() error {
+	addresses, err := lookupAddrs(guardHost)
+	guard.Lock()
+	defer guard.Unlock()
+	if err != nil || len(addresses) == 0 {
+		guard.pending = true
+		return fmt.Errorf("guard host %s does not resolve (%v), keeping existing output", guardHost, err)
+	}
+	guard.pending = false
+	return nil
+}
+
+// Reports whether a react is waiting for -guard-host to resolve again
+func guardPending() bool {
+	guard.Lock()
+	defer guard.Unlock()
+	return guard.pending
+}
+
+// Polls the guard host while a react is pending and triggers it once the guard host resolves
+func monitorGuard(ctx context.Context, interval time.Duration) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(interval)
+	for {
+		select {
+		case <-ticker.C:
+			if !guardPending() {
+				continue
+			}
+			if addresses, err := lookupAddrs(guardHost); err == nil && len(addresses) > 0 {
+				logChange("guard host %s resolves again, applying deferred reaction", guardHost)
+				triggerReact()
+			}
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
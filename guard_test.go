@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGuardDefersReactUntilItResolves(t *testing.T) {
+	_, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }}{{ end }}`)
+	defer restore()
+	stub, restoreResolver := useStubNameserver(t)
+	defer restoreResolver()
+	guardHost = "guard.example.com"
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	drainChanges()
+
+	// while the guard host doesn't resolve nothing is written or run
+	if result := react(context.Background(), nil); result.Changed {
+		t.Error("react wrote the output while the guard host was down")
+	}
+	if fileExists(dest) || fileExists(marker) {
+		t.Fatal("the output was written or the command run while the guard host was down")
+	}
+	if !guardPending() {
+		t.Error("the deferred react isn't pending")
+	}
+	if st := currentStatus(); st.Guard == nil || st.Guard.Host != guardHost || !st.Guard.Pending {
+		t.Errorf("status reports guard %+v, want it pending", st.Guard)
+	}
+
+	reacts, stop := startCountingReactor(commandLineGroup())
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go monitorGuard(ctx, 10*time.Millisecond)
+	defer wg.Wait()
+	defer cancel()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := reacts(); n != 0 {
+		t.Errorf("%d reacts while the guard host was still down", n)
+	}
+
+	// once it resolves the pending react is applied
+	stub.set(guardHost)
+	if !eventually(func() bool { return fileExists(dest) && fileExists(marker) }) {
+		t.Fatal("the deferred react wasn't applied once the guard host resolved")
+	}
+	if guardPending() {
+		t.Error("the react is still pending after it was applied")
+	}
+	if st := currentStatus(); st.Guard == nil || st.Guard.Pending {
+		t.Errorf("status reports guard %+v, want it no longer pending", st.Guard)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// HistoryEntry is an address set that a host used to resolve to
+type HistoryEntry struct {
+	Addresses []string `json:"addresses"`
+	// when the host stopped resolving to this set
+	Replaced time.Time `json:"replaced"`
+}
+
+// Recent address sets per host, for templates that keep draining backends after they
+// disappear from DNS. Only kept when -history-size is set.
+var history = struct {
+	sync.Mutex
+	current map[string][]string
+	past    map[string][]HistoryEntry
+}{current: make(map[string][]string), past: make(map[string][]HistoryEntry)}
+
+// Records that hostname changed to addresses. The previous set is kept for -history-ttl, and a
+// react is scheduled for when it expires so that it drops out of the rendered output.
+func recordHistory(hostname string, addresses []string) {
+	if historySize <= 0 {
+		return
+	}
+	history.Lock()
+	defer history.Unlock()
+
+	old, ok := history.current[hostname]
+	history.current[hostname] = addresses
+	if !ok || len(old) == 0 {
+		return
+	}
+
+	entries := []HistoryEntry{{Addresses: old, Replaced: time.Now()}}
+	for _, e := range history.past[hostname] {
+		if !equivalent(e.Addresses, old) && len(entries) < historySize {
+			entries = append(entries, e)
+		}
+	}
+	history.past[hostname] = entries
+	time.AfterFunc(historyTTL, func() { triggerReact() })
+}
+
+// Returns the unexpired address sets hostname has resolved to before, most recent first
+func addressHistory(hostname string) []HistoryEntry {
+	history.Lock()
+	defer history.Unlock()
+	var entries []HistoryEntry
+	for _, e := range history.past[hostname] {
+		if time.Since(e.Replaced) < historyTTL {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// Returns addresses hostname resolved to within -history-ttl that it no longer resolves to
+func draining(hostname string) []string {
+	var old []string
+	for _, e := range addressHistory(hostname) {
+		old = append(old, e.Addresses...)
+	}
+	history.Lock()
+	current := history.current[hostname]
+	history.Unlock()
+	return difference(old, current)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func setupHistory(size int, ttl time.Duration) func() {
+	origSize, origTTL := historySize, historyTTL
+	historySize, historyTTL = size, ttl
+	return func() {
+		historySize, historyTTL = origSize, origTTL
+		history.Lock()
+		history.current = make(map[string][]string)
+		history.past = make(map[string][]HistoryEntry)
+		history.Unlock()
+		resetStore()
+	}
+}
+
+// Changes hostname to addresses, as a monitor does
+func changeHost(hostname string, addresses ...string) {
+	updateHost(Host{Name: hostname, Addresses: addresses})
+	recordHistory(hostname, addresses)
+}
+
+func TestDrainingWindow(t *testing.T) {
+	defer setupHistory(2, 100*time.Millisecond)()
+	drainChanges()
+
+	changeHost("a", "10.0.0.1", "10.0.0.2")
+	changeHost("a", "10.0.0.2", "10.0.0.3")
+	h := snapshot().Hosts[0]
+	if want := []string{"10.0.0.1"}; !reflect.DeepEqual(h.Draining, want) {
+		t.Errorf("draining %q, want the removed address %q", h.Draining, want)
+	}
+	if len(h.History) != 1 || !reflect.DeepEqual(h.History[0].Addresses, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("history %+v, want the previous set", h.History)
+	}
+
+	// the expiry asks for a react, which no longer renders the removed address
+	if _, ok := nextChange(time.Second); !ok {
+		t.Fatal("no react when the history expired")
+	}
+	h = snapshot().Hosts[0]
+	if len(h.Draining) != 0 || len(h.History) != 0 {
+		t.Errorf("after -history-ttl draining %q and history %+v, want both empty", h.Draining, h.History)
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	defer setupHistory(2, time.Minute)()
+
+	changeHost("a", "10.0.0.1")
+	changeHost("a", "10.0.0.2")
+	changeHost("a", "10.0.0.3")
+	changeHost("a", "10.0.0.4")
+	// only the 2 most recent previous sets are kept, most recent first
+	var got [][]string
+	for _, e := range addressHistory("a") {
+		got = append(got, e.Addresses)
+	}
+	if want := [][]string{{"10.0.0.3"}, {"10.0.0.2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history %q, want %q", got, want)
+	}
+
+	// going back to a set that's in the history doesn't drain its addresses
+	changeHost("a", "10.0.0.3")
+	got = nil
+	for _, e := range addressHistory("a") {
+		got = append(got, e.Addresses)
+	}
+	if want := [][]string{{"10.0.0.4"}, {"10.0.0.3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("history %q, want %q", got, want)
+	}
+	if got := draining("a"); !reflect.DeepEqual(got, []string{"10.0.0.4"}) {
+		t.Errorf("draining %q, want only the address no longer resolved", got)
+	}
+}
+
+func TestHistoryOff(t *testing.T) {
+	defer setupHistory(0, time.Minute)()
+
+	changeHost("a", "10.0.0.1")
+	changeHost("a", "10.0.0.2")
+	if h := snapshot().Hosts[0]; h.History != nil || len(h.Draining) != 0 {
+		t.Errorf("without -history-size got history %+v and draining %q", h.History, h.Draining)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"os"
+	"strings"
+)
+
+// hostnames read from -hosts-file at startup
+var fileHosts []string
+
+// Reads one hostname per line, with the same "via"/"watch" syntax as arguments. Blank lines
+// and lines starting with # are skipped.
+func loadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fileHosts = append(fileHosts, line)
+	}
+	return scanner.Err()
+}
+
+// Returns the hostname arguments followed by the hostnames from -hosts-file
+func hostArgs() []string {
+	return append(append([]string(nil), flag.Args()...), fileHosts...)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Returns a random fraction in [-1, 1)
+func jitterFraction() float64 {
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return jitterRand.Float64()*2 - 1
+}
+
+// Returns d moved randomly by up to -jitter of itself in either direction, so hosts polled on
+// the same interval drift apart instead of querying the resolver in bursts
+func withJitter(d time.Duration) time.Duration {
+	if jitter <= 0 {
+		return d
+	}
+	return d + time.Duration(float64(d)*jitter*jitterFraction())
+}
+
+// Returns a random extra delay of up to -jitter of interval for a host's first lookup
+func initialJitter(interval time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(float64(interval) * jitter * (jitterFraction() + 1) / 2)
+}
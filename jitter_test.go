@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithJitter(t *testing.T) {
+	defer func(orig float64) { jitter = orig }(jitter)
+	d := 10 * time.Second
+
+	jitter = 0
+	if got := withJitter(d); got != d {
+		t.Errorf("without -jitter got %v, want %v", got, d)
+	}
+	if got := initialJitter(d); got != 0 {
+		t.Errorf("without -jitter the first lookup is delayed by %v", got)
+	}
+
+	// with -jitter 0.1 every wait is within ±1s, and they aren't all the same
+	jitter = 0.1
+	seen := make(map[time.Duration]bool)
+	var early, late bool
+	for i := 0; i < 1000; i++ {
+		got := withJitter(d)
+		if got < 9*time.Second || got >= 11*time.Second {
+			t.Fatalf("withJitter(%v) = %v, want within ±10%%", d, got)
+		}
+		seen[got] = true
+		early, late = early || got < d, late || got > d
+		if delay := initialJitter(d); delay < 0 || delay >= time.Second {
+			t.Fatalf("initialJitter(%v) = %v, want within [0, 1s)", d, delay)
+		}
+	}
+	if len(seen) < 100 || !early || !late {
+		t.Errorf("1000 waits took %d distinct values (early %v, late %v), want them spread both ways", len(seen), early, late)
+	}
+}
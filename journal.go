@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// syslog priorities for each log level
+var journalPriorities = map[string]int{
+	levelError:  3,
+	levelWarn:   4,
+	levelChange: 5,
+	levelInfo:   6,
+	levelDebug:  7,
+}
+
+// journalWriter sends log events to the systemd journal using its native protocol
+type journalWriter struct {
+	conn *net.UnixConn
+	addr *net.UnixAddr
+}
+
+// Connects to the journal socket, returning an error if dns-gen is not running under systemd
+func newJournalWriter() (*journalWriter, error) {
+	if _, err := os.Stat(journalSocket); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalWriter{conn: conn, addr: &net.UnixAddr{Name: journalSocket, Net: "unixgram"}}, nil
+}
+
+// the journal logEvent sends to with -journal; nil logs to stderr
+var journalLog *journalWriter
+
+// Sends a log event to the journal, falling back to stderr if it can't be delivered
+func (w *journalWriter) send(level, msg string, fields logFields) {
+	if _, err := w.conn.WriteToUnix(journalMessage(level, msg, fields), w.addr); err != nil {
+		fmt.Fprintln(os.Stderr, levelPrefixes[level]+msg)
+	}
+}
+
+// Builds the journal entry for a log event: the message, the priority of its level, and each of
+// its fields as a DNSGEN_ field, e.g. host as DNSGEN_HOST
+func journalMessage(level, msg string, fields logFields) []byte {
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", msg)
+	journalField(&buf, "PRIORITY", strconv.Itoa(journalPriorities[level]))
+	journalField(&buf, "SYSLOG_IDENTIFIER", "dns-gen")
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		journalField(&buf, "DNSGEN_"+strings.ToUpper(k), journalValue(fields[k]))
+	}
+	return buf.Bytes()
+}
+
+// Formats a field value for the journal; lists of addresses are comma separated
+func journalValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// Appends a single field in the journal's native format. Values containing newlines
+// must be sent length-prefixed rather than as KEY=value.
+func journalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(key + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(key + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
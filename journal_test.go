@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Parses an entry in the journal's native format
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	t.Helper()
+	fields := make(map[string]string)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			t.Fatalf("unterminated field %q", data)
+		}
+		line := string(data[:i])
+		data = data[i+1:]
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+			continue
+		}
+		n := binary.LittleEndian.Uint64(data[:8])
+		fields[line] = string(data[8 : 8+n])
+		data = data[8+n+1:]
+	}
+	return fields
+}
+
+func TestJournalMessage(t *testing.T) {
+	got := parseJournalEntry(t, journalMessage(levelChange, "a.example.com A/AAAA [] -> [10.0.0.1]\nsecond line",
+		logFields{"host": "a.example.com", "new": []string{"10.0.0.1", "10.0.0.2"}, "duration_ms": 1.5}))
+	want := map[string]string{
+		"MESSAGE":            "a.example.com A/AAAA [] -> [10.0.0.1]\nsecond line",
+		"PRIORITY":           "5",
+		"SYSLOG_IDENTIFIER":  "dns-gen",
+		"DNSGEN_HOST":        "a.example.com",
+		"DNSGEN_NEW":         "10.0.0.1,10.0.0.2",
+		"DNSGEN_DURATION_MS": "1.5",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLogEventSendsToTheJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns-gen-journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "socket"), Net: "unixgram"}
+	journald, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journald.Close()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	journalLog = &journalWriter{conn: conn, addr: addr}
+	defer func() { journalLog = nil }()
+
+	logEvent(levelWarn, logFields{"host": "a.example.com"}, "something odd about %s", "a.example.com")
+	journald.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, err := journald.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseJournalEntry(t, buf[:n])
+	if got["PRIORITY"] != "4" || got["DNSGEN_HOST"] != "a.example.com" || got["MESSAGE"] != "something odd about a.example.com" {
+		t.Errorf("journal got %q", got)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// where the service account credentials are mounted in every pod
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Endpoint is a single address backing a Kubernetes Service, as listed in its EndpointSlices
+type Endpoint struct {
+	Address string            `json:"address"`
+	Ready   bool              `json:"ready"`
+	Pod     string            `json:"pod,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// the parts of the discovery.k8s.io/v1 EndpointSliceList response dns-gen uses
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+			TargetRef *struct {
+				Kind            string `json:"kind"`
+				Name            string `json:"name"`
+				UID             string `json:"uid"`
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"targetRef"`
+		} `json:"endpoints"`
+	} `json:"items"`
+}
+
+// k8sClient talks to the API server with the pod's service account
+type k8sClient struct {
+	base   string
+	token  string
+	client *http.Client
+
+	mu sync.Mutex
+	// the labels of the pods found by the last poll, by pod UID and resourceVersion, so that
+	// polls only fetch pods that are new or have changed since
+	labels map[string]map[string]string
+}
+
+// Builds a client from the environment and credentials Kubernetes provides to every pod
+func newK8sClient() (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s/ca.crt", serviceAccountDir)
+	}
+	return &k8sClient{
+		base:  "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (c *k8sClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Lists the endpoints of a Service from its EndpointSlices, along with the labels of the pods
+// behind them, sorted by address. An address in more than one slice, as while an endpoint moves
+// between them, is listed once, and is ready if it's ready in any of them.
+func (c *k8sClient) endpoints(namespace, service string) ([]Endpoint, error) {
+	var slices endpointSliceList
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?labelSelector=%s",
+		url.PathEscape(namespace), url.QueryEscape("kubernetes.io/service-name="+service))
+	if err := c.get(path, &slices); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the labels of the pods in this poll, which replace the cache so that pods that are gone
+	// drop out of it
+	labels := make(map[string]map[string]string)
+	var endpoints []Endpoint
+	seen := make(map[string]int)
+	for _, slice := range slices.Items {
+		for _, ep := range slice.Endpoints {
+			// a missing ready condition means the endpoint is ready
+			ready := ep.Conditions.Ready == nil || *ep.Conditions.Ready
+			var pod string
+			var podLabels map[string]string
+			if ref := ep.TargetRef; ref != nil && ref.Kind == "Pod" {
+				pod = ref.Name
+				// a pod's labels can only have changed if its resourceVersion has, and a pod
+				// recreated under the same name has a new UID
+				key := ref.UID + "@" + ref.ResourceVersion
+				if ref.UID == "" {
+					key = "@" + pod
+				}
+				var ok bool
+				if podLabels, ok = labels[key]; !ok {
+					// without a UID a pod can't be told apart from one recreated under its name,
+					// so its labels are fetched again on every poll
+					if podLabels, ok = c.labels[key]; !ok || ref.UID == "" {
+						var err error
+						if podLabels, err = c.podLabels(namespace, pod); err != nil {
+							return nil, err
+						}
+					}
+					labels[key] = podLabels
+				}
+			}
+			for _, addr := range ep.Addresses {
+				e := Endpoint{Address: addr, Ready: ready, Pod: pod, Labels: podLabels}
+				if i, ok := seen[addr]; ok {
+					if ready && !endpoints[i].Ready {
+						endpoints[i] = e
+					}
+					continue
+				}
+				seen[addr] = len(endpoints)
+				endpoints = append(endpoints, e)
+			}
+		}
+	}
+	c.labels = labels
+	sort.SliceStable(endpoints, func(i, j int) bool { return addressLess(endpoints[i].Address, endpoints[j].Address) })
+	return endpoints, nil
+}
+
+// Fetches the labels of a pod
+func (c *k8sClient) podLabels(namespace, pod string) (map[string]string, error) {
+	var p struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := c.get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(namespace), url.PathEscape(pod)), &p); err != nil {
+		return nil, err
+	}
+	return p.Metadata.Labels, nil
+}
+
+// Splits a -k8s-service namespace/name argument
+func parseK8sService(s string) (namespace, name string, err error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected namespace/name, got %q", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// Polls a Service's EndpointSlices and stores it as a host named namespace/name. Its
+// Addresses are the ready endpoints; every endpoint, ready or not, is in Endpoints.
+func monitorK8sService(ctx context.Context, c *k8sClient, namespace, service string, interval time.Duration) {
+	defer wg.Done()
+
+	name := namespace + "/" + service
+	var known []Endpoint
+	next := time.After(startupDelay)
+
+	for {
+		select {
+		case <-next:
+			next = time.After(interval)
+			start := time.Now()
+			endpoints, err := c.endpoints(namespace, service)
+			recordLookup(name, err)
+			if err != nil {
+				logError("error listing endpoints of %s: %v", name, err)
+				continue
+			}
+			if debug {
+				logDebug("endpoints [%s] => %d in %v", name, len(endpoints), time.Since(start))
+			}
+			if reflect.DeepEqual(known, endpoints) {
+				continue
+			}
+			ready := readyAddresses(endpoints)
+			old := readyAddresses(known)
+			logEvent(levelChange, logFields{"host": name, "old": logAddrs(old), "new": logAddrs(ready)},
+				"service %s: %s ready of %d endpoints", name, logAddrs(ready), len(endpoints))
+			known = endpoints
+			updateHost(Host{Name: name, Addresses: ready, Endpoints: endpoints})
+			recordHistory(name, ready)
+			if old != nil {
+				recordChange(name)
+			}
+			reportChange(ctx, nil, name, old, ready)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func readyAddresses(endpoints []Endpoint) []string {
+	var addrs []string
+	for _, ep := range endpoints {
+		if ep.Ready {
+			addrs = append(addrs, ep.Address)
+		}
+	}
+	return addrs
+}
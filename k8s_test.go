@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakePod struct {
+	uid, resourceVersion string
+	labels               map[string]string
+}
+
+// fakeAPIServer serves the EndpointSlices of one Service and the pods behind them, and counts the
+// pods it's asked for
+type fakeAPIServer struct {
+	mu       sync.Mutex
+	slices   string
+	pods     map[string]fakePod
+	podGets  int
+	lastAuth string
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAuth = r.Header.Get("Authorization")
+	switch {
+	case r.URL.Path == "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices":
+		if r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+			http.Error(w, "unexpected selector", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(s.slices))
+	case strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/default/pods/"):
+		p, ok := s.pods[strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/default/pods/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		s.podGets++
+		json.NewEncoder(w).Encode(map[string]interface{}{"metadata": map[string]interface{}{"labels": p.labels}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Sets the EndpointSlices served to one slice with an endpoint for each of the pods, numbered
+// 10.0.0.1 onwards, the first of them not ready
+func (s *fakeAPIServer) setPods(pods map[string]fakePod, names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pods = pods
+	var endpoints []interface{}
+	for i, name := range names {
+		endpoints = append(endpoints, map[string]interface{}{
+			"addresses":  []string{fmt.Sprintf("10.0.0.%d", i+1)},
+			"conditions": map[string]bool{"ready": i > 0},
+			"targetRef": map[string]string{
+				"kind":            "Pod",
+				"name":            name,
+				"uid":             pods[name].uid,
+				"resourceVersion": pods[name].resourceVersion,
+			},
+		})
+	}
+	slices, _ := json.Marshal(map[string]interface{}{"items": []interface{}{map[string]interface{}{"endpoints": endpoints}}})
+	s.slices = string(slices)
+}
+
+func (s *fakeAPIServer) gets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.podGets
+}
+
+func TestK8sEndpoints(t *testing.T) {
+	api := &fakeAPIServer{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	c := &k8sClient{base: srv.URL, token: "secret", client: srv.Client()}
+
+	api.setPods(map[string]fakePod{
+		"web-a": {uid: "1", resourceVersion: "10", labels: map[string]string{"app": "web", "zone": "a"}},
+		"web-b": {uid: "2", resourceVersion: "20", labels: map[string]string{"app": "web", "zone": "b"}},
+	}, "web-a", "web-b")
+	endpoints, err := c.endpoints("default", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Endpoint{
+		{Address: "10.0.0.1", Ready: false, Pod: "web-a", Labels: map[string]string{"app": "web", "zone": "a"}},
+		{Address: "10.0.0.2", Ready: true, Pod: "web-b", Labels: map[string]string{"app": "web", "zone": "b"}},
+	}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("got %+v, want %+v", endpoints, want)
+	}
+	if api.lastAuth != "Bearer secret" {
+		t.Errorf("sent Authorization %q, want the service account token", api.lastAuth)
+	}
+	if n := api.gets(); n != 2 {
+		t.Errorf("fetched %d pods, want 2", n)
+	}
+
+	// unchanged pods aren't fetched again
+	if _, err := c.endpoints("default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.gets(); n != 2 {
+		t.Errorf("fetched %d pods after a second poll, want the labels of both reused", n)
+	}
+
+	// a relabelled pod has a new resourceVersion, and a recreated one a new UID
+	api.setPods(map[string]fakePod{
+		"web-a": {uid: "1", resourceVersion: "11", labels: map[string]string{"app": "web", "zone": "c"}},
+		"web-b": {uid: "3", resourceVersion: "30", labels: map[string]string{"app": "web"}},
+	}, "web-a", "web-b")
+	if endpoints, err = c.endpoints("default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if n := api.gets(); n != 4 {
+		t.Errorf("fetched %d pods, want both fetched again", n)
+	}
+	if got := endpoints[0].Labels["zone"]; got != "c" {
+		t.Errorf("web-a has zone %q, want its new label", got)
+	}
+	if _, ok := endpoints[1].Labels["zone"]; ok {
+		t.Errorf("recreated web-b has the old pod's labels %v", endpoints[1].Labels)
+	}
+
+	// pods that are gone drop out of the cache
+	api.setPods(map[string]fakePod{"web-a": {uid: "1", resourceVersion: "11"}}, "web-a")
+	if _, err := c.endpoints("default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.labels) != 1 {
+		t.Errorf("cached the labels of %d pods, want only the remaining one", len(c.labels))
+	}
+}
+
+func TestK8sEndpointsOrderAndDuplicates(t *testing.T) {
+	api := &fakeAPIServer{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	c := &k8sClient{base: srv.URL, client: srv.Client()}
+
+	// 10.0.0.2 is moving from the first slice, where it's no longer ready, to the second
+	api.slices = `{"items": [
+		{"endpoints": [
+			{"addresses": ["10.0.0.10"]},
+			{"addresses": ["10.0.0.2"], "conditions": {"ready": false}}
+		]},
+		{"endpoints": [
+			{"addresses": ["10.0.0.2"], "conditions": {"ready": true}},
+			{"addresses": ["10.0.0.1"]}
+		]}
+	]}`
+	endpoints, err := c.endpoints("default", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Endpoint{
+		{Address: "10.0.0.1", Ready: true},
+		{Address: "10.0.0.2", Ready: true},
+		{Address: "10.0.0.10", Ready: true},
+	}
+	if !reflect.DeepEqual(endpoints, want) {
+		t.Errorf("got %+v, want %+v", endpoints, want)
+	}
+	if got := readyAddresses(endpoints); !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2", "10.0.0.10"}) {
+		t.Errorf("ready addresses %q, want them in numeric order", got)
+	}
+}
+
+func TestK8sEndpointsError(t *testing.T) {
+	api := &fakeAPIServer{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+	c := &k8sClient{base: srv.URL, client: srv.Client()}
+
+	// the pod behind the endpoint doesn't exist
+	api.setPods(map[string]fakePod{"web-a": {uid: "1"}}, "web-a")
+	api.pods = nil
+	if _, err := c.endpoints("default", "web"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("error = %v, want the API server's 404", err)
+	}
+}
+
+func TestParseK8sService(t *testing.T) {
+	if ns, name, err := parseK8sService("default/web"); err != nil || ns != "default" || name != "web" {
+		t.Errorf("got %q, %q, %v", ns, name, err)
+	}
+	for _, s := range []string{"web", "/web", "default/", ""} {
+		if _, _, err := parseK8sService(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Returns the lock file used for -react-lock. A bare name is placed in the temp directory so
+// that every instance on the host using that name shares the same file.
+func reactLockPath(name string) string {
+	if strings.ContainsRune(name, os.PathSeparator) {
+		return name
+	}
+	return filepath.Join(os.TempDir(), "dns-gen-"+name+".lock")
+}
+
+// whether this instance currently holds the -react-lock lock, for /status
+var reactLockHeld struct {
+	sync.Mutex
+	held bool
+}
+
+func setReactLockHeld(held bool) {
+	reactLockHeld.Lock()
+	defer reactLockHeld.Unlock()
+	reactLockHeld.held = held
+}
+
+func isReactLockHeld() bool {
+	reactLockHeld.Lock()
+	defer reactLockHeld.Unlock()
+	return reactLockHeld.held
+}
+
+// Takes the -react-lock file lock, waiting for other instances to release it unless
+// -react-lock-skip is set. The returned func releases it.
+func acquireReactLock() (func(), error) {
+	path := reactLockPath(reactLock)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %v", err)
+	}
+	how := syscall.LOCK_EX
+	if reactLockSkip {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is held by another instance, skipping", path)
+		}
+		return nil, fmt.Errorf("error locking %s: %v", path, err)
+	}
+	setReactLockHeld(true)
+	return func() {
+		setReactLockHeld(false)
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
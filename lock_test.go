@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Not a test: run by holdReactLock as another dns-gen instance that takes -react-lock and holds
+// it until its stdin is closed
+func TestReactLockHolder(t *testing.T) {
+	if os.Getenv("DNSGEN_HOLD_LOCK") == "" {
+		t.Skip("only run as a helper process")
+	}
+	reactLock, reactLockSkip = os.Getenv("DNSGEN_HOLD_LOCK"), false
+	release, err := acquireReactLock()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	io.Copy(ioutil.Discard, os.Stdin)
+	release()
+	os.Exit(0)
+}
+
+// Starts another process holding the lock at path. Returns a func that has it release the lock
+// and exit.
+func holdReactLock(t *testing.T, path string) func() {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestReactLockHolder$")
+	cmd.Env = append(os.Environ(), "DNSGEN_HOLD_LOCK="+path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); strings.TrimSpace(line) != "locked" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("the other instance didn't take the lock: %q", line)
+	}
+	return func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+}
+
+func TestReactLockSkipsWhileAnotherInstanceHoldsIt(t *testing.T) {
+	dir, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }}`)
+	defer restore()
+	defer func(orig bool) { reactLockSkip = orig }(reactLockSkip)
+	reactLock, reactLockSkip = filepath.Join(dir, "react.lock"), true
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+
+	release := holdReactLock(t, reactLock)
+	result := react(context.Background(), nil)
+	if err := result.Err(); err == nil || !strings.Contains(err.Error(), "held by another instance") {
+		t.Errorf("react = %v, want it skipped", err)
+	}
+	if fileExists(dest) || fileExists(marker) {
+		t.Error("the output was written or the command run without the lock")
+	}
+	if st := currentStatus(); st.ReactLockHeld == nil || *st.ReactLockHeld {
+		t.Errorf("status reports the lock held = %v, want false", st.ReactLockHeld)
+	}
+
+	release()
+	if result := react(context.Background(), nil); result.Err() != nil || !result.Changed {
+		t.Fatalf("react after the other instance let go = %v, changed %v", result.Err(), result.Changed)
+	}
+	if !fileExists(marker) {
+		t.Error("the command didn't run once the lock was free")
+	}
+	if isReactLockHeld() {
+		t.Error("the lock is still held after the react")
+	}
+}
+
+func TestReactLockWaitsForAnotherInstance(t *testing.T) {
+	dir, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }}`)
+	defer restore()
+	defer func(orig bool) { reactLockSkip = orig }(reactLockSkip)
+	reactLock, reactLockSkip = filepath.Join(dir, "react.lock"), false
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+
+	release := holdReactLock(t, reactLock)
+	done := make(chan reactResult, 1)
+	go func() { done <- react(context.Background(), nil) }()
+	select {
+	case result := <-done:
+		release()
+		t.Fatalf("react = %v while another instance held the lock, want it to wait", result.Err())
+	case <-time.After(100 * time.Millisecond):
+	}
+	if fileExists(dest) || fileExists(marker) {
+		t.Error("the output was written or the command run without the lock")
+	}
+
+	release()
+	select {
+	case result := <-done:
+		if result.Err() != nil || !result.Changed {
+			t.Errorf("react = %v, changed %v", result.Err(), result.Changed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("react didn't go ahead once the other instance let go")
+	}
+	if !fileExists(marker) {
+		t.Error("the command didn't run once the lock was free")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// values for -log-format
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// log levels, in the order of the journal priorities they map to
+const (
+	levelError  = "error"
+	levelWarn   = "warn"
+	levelChange = "change"
+	levelInfo   = "info"
+	levelDebug  = "debug"
+)
+
+// prefixes that mark each level in text output
+var levelPrefixes = map[string]string{
+	levelError:  "[ERROR] ",
+	levelWarn:   "[WARN] ",
+	levelChange: "[CHANGE] ",
+	levelInfo:   "[INFO] ",
+	levelDebug:  "[DEBUG] ",
+}
+
+// logFields are the details of a log event that get their own keys with -log-format json,
+// such as host, old, new and duration_ms. Text output only has the message, which should
+// already mention them.
+type logFields map[string]interface{}
+
+func validateLogFormat() error {
+	switch logFormat {
+	case logFormatText, logFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid -log-format %q: must be text or json", logFormat)
+}
+
+// Logs a message at level: as a prefixed line with -log-format text, or as a JSON object
+// holding the level, message and fields with -log-format json. With -journal, it's sent to the
+// journal with its fields instead.
+func logEvent(level string, fields logFields, format string, args ...interface{}) {
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	if journalLog != nil {
+		journalLog.send(level, msg, fields)
+		return
+	}
+	if logFormat != logFormatJSON {
+		log.Print(levelPrefixes[level] + msg)
+		return
+	}
+	ev := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		ev[k] = v
+	}
+	ev["time"] = time.Now().Format(time.RFC3339Nano)
+	ev["level"] = level
+	ev["msg"] = msg
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(ev); err != nil {
+		buf.Reset()
+		enc.Encode(map[string]string{"time": ev["time"].(string), "level": level, "msg": msg})
+	}
+	log.Print(buf.String())
+}
+
+func logError(format string, args ...interface{})  { logEvent(levelError, nil, format, args...) }
+func logWarn(format string, args ...interface{})   { logEvent(levelWarn, nil, format, args...) }
+func logChange(format string, args ...interface{}) { logEvent(levelChange, nil, format, args...) }
+func logInfo(format string, args ...interface{})   { logEvent(levelInfo, nil, format, args...) }
+func logDebug(format string, args ...interface{})  { logEvent(levelDebug, nil, format, args...) }
+
+// Logs an error and exits with status 1
+func logFatal(format string, args ...interface{}) {
+	logError(format, args...)
+	os.Exit(1)
+}
+
+// Returns d in milliseconds, for the duration_ms field
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"runtime"
+	runtimedebug "runtime/debug"
+	"sync"
+	"time"
+)
+
+// how often heap usage is compared with -max-memory-hint
+const memoryCheckInterval = 30 * time.Second
+
+// Canonical copies of every address currently in the store, so hosts that share addresses (and
+// successive lookups of the same host) don't each hold their own copy of the strings. Each copy
+// counts the hosts holding it and is dropped once none do, so addresses that have gone away
+// don't accumulate.
+var interned = struct {
+	sync.Mutex
+	strings map[string]*internedString
+}{strings: make(map[string]*internedString)}
+
+type internedString struct {
+	s    string
+	refs int
+}
+
+// Replaces each address with its canonical copy, taking a reference to it. Every call must be
+// matched by a releaseAddresses of the same addresses once they leave the store.
+func internAddresses(addresses []string) []string {
+	interned.Lock()
+	defer interned.Unlock()
+	for i, addr := range addresses {
+		is, ok := interned.strings[addr]
+		if !ok {
+			is = &internedString{s: addr}
+			interned.strings[addr] = is
+		}
+		is.refs++
+		addresses[i] = is.s
+	}
+	return addresses
+}
+
+func releaseAddresses(addresses []string) {
+	interned.Lock()
+	defer interned.Unlock()
+	for _, addr := range addresses {
+		if is, ok := interned.strings[addr]; ok {
+			if is.refs--; is.refs <= 0 {
+				delete(interned.strings, addr)
+			}
+		}
+	}
+}
+
+// memoryCounts describes the amount of data dns-gen is holding on to
+type memoryCounts struct {
+	Hosts          int `json:"hosts"`
+	Addresses      int `json:"addresses"`
+	HistoryEntries int `json:"history_entries"`
+	// distinct addresses across every host
+	InternedAddresses int `json:"interned_addresses"`
+}
+
+func currentMemoryCounts() memoryCounts {
+	var c memoryCounts
+	store.Lock()
+	c.Hosts = len(store.hosts)
+	for _, h := range store.hosts {
+		c.Addresses += len(h.Addresses)
+	}
+	store.Unlock()
+	history.Lock()
+	for _, entries := range history.past {
+		c.HistoryEntries += len(entries)
+	}
+	history.Unlock()
+	interned.Lock()
+	c.InternedAddresses = len(interned.strings)
+	interned.Unlock()
+	return c
+}
+
+// Drops data that only enriches the output, address history and recent change times, so it
+// can be rebuilt from scratch. Monitored hosts and their current addresses are kept.
+func trimOptionalData() {
+	history.Lock()
+	history.past = make(map[string][]HistoryEntry)
+	history.Unlock()
+	changeTimes.Lock()
+	changeTimes.hosts = make(map[string][]time.Time)
+	changeTimes.Unlock()
+	runtimedebug.FreeOSMemory()
+}
+
+// Periodically checks the heap against -max-memory-hint (in MiB), trimming optional data
+// whenever it's exceeded
+func monitorMemory() {
+	limit := uint64(maxMemoryHint) << 20
+	for range time.Tick(memoryCheckInterval) {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		if m.HeapAlloc <= limit {
+			continue
+		}
+		c := currentMemoryCounts()
+		logInfo("heap is %d MiB, over -max-memory-hint %d MiB; dropping history (%d hosts, %d addresses, %d history entries)",
+			m.HeapAlloc>>20, maxMemoryHint, c.Hosts, c.Addresses, c.HistoryEntries)
+		trimOptionalData()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInternedAddressesAreReleased(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1", "10.0.0.2"}})
+	updateHost(Host{Name: "b", Addresses: []string{"10.0.0.2"}})
+	if c := currentMemoryCounts(); c.InternedAddresses != 2 {
+		t.Fatalf("interned %d addresses, want 2", c.InternedAddresses)
+	}
+
+	// a's addresses rotate through many values; only the ones still held should remain
+	for i := 0; i < 1000; i++ {
+		updateHost(Host{Name: "a", Addresses: []string{fmt.Sprintf("10.1.%d.%d", i/256, i%256)}})
+	}
+	c := currentMemoryCounts()
+	if c.InternedAddresses != 2 {
+		t.Errorf("interned %d addresses after rotating, want 2 (a's current address and b's)", c.InternedAddresses)
+	}
+	if c.Hosts != 2 || c.Addresses != 2 {
+		t.Errorf("counts = %+v, want 2 hosts with 2 addresses", c)
+	}
+	if st := currentStatus(); st.Memory != c {
+		t.Errorf("/status memory = %+v, want %+v", st.Memory, c)
+	}
+}
+
+// Every host's addresses change on each round, so without releasing replaced addresses the
+// interned set would grow with every round rather than staying at the number of hosts
+func BenchmarkUpdateHostRotatingAddresses(b *testing.B) {
+	resetStore()
+	defer resetStore()
+	const hosts = 10000
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h := i % hosts
+		updateHost(Host{
+			Name:      fmt.Sprintf("host-%d.example.com", h),
+			Addresses: []string{fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)},
+		})
+	}
+	b.StopTimer()
+	if c := currentMemoryCounts(); c.InternedAddresses > hosts {
+		b.Fatalf("interned %d addresses for %d hosts", c.InternedAddresses, hosts)
+	}
+}
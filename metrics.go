@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of the duration histograms' buckets, in seconds
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	s := d.Seconds()
+	for i, le := range durationBuckets {
+		if s <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += s
+}
+
+// Everything -metrics-addr reports, apart from the address counts which are read from the
+// store when scraped
+var metrics = struct {
+	sync.Mutex
+	changes         map[string]uint64
+	lookupErrors    map[string]uint64
+	monitorRestarts map[string]uint64
+	reactions       uint64
+	failedReactions uint64
+	lookups         histogram
+	renders         histogram
+	commands        histogram
+}{changes: make(map[string]uint64), lookupErrors: make(map[string]uint64), monitorRestarts: make(map[string]uint64)}
+
+func countChange(host string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.changes[host]++
+}
+
+func countMonitorRestart(host string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.monitorRestarts[host]++
+}
+
+func countReaction(result reactResult) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.reactions++
+	if result.Err() != nil {
+		metrics.failedReactions++
+	}
+}
+
+func observeLookup(host string, d time.Duration, err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.lookups.observe(d)
+	if err != nil {
+		metrics.lookupErrors[host]++
+	}
+}
+
+func observeRender(d time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.renders.observe(d)
+}
+
+func observeCommand(d time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.commands.observe(d)
+}
+
+// Starts serving /metrics on addr in the Prometheus text format
+func serveMetrics(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	go http.Serve(l, mux)
+	return nil
+}
+
+func writeMetrics(w io.Writer) {
+	counts := addressCounts()
+	renders := renderStates()
+	stability := make(map[string]string, len(counts))
+	for host := range counts {
+		stability[host] = hostStability(host)
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	writeCounter(w, "dnsgen_dns_changes_total", "Changes to a host's addresses since dns-gen started.", metrics.changes)
+	writeCounter(w, "dnsgen_lookup_errors_total", "Failed lookups of a host.", metrics.lookupErrors)
+	writeCounter(w, "dnsgen_monitor_restarts_total", "Restarts of a host's monitor after it panicked.", metrics.monitorRestarts)
+	fmt.Fprintf(w, "# HELP dnsgen_reactions_total Reactions to changes, each one rendering and running the command.\n# TYPE dnsgen_reactions_total counter\n")
+	fmt.Fprintf(w, "dnsgen_reactions_total %d\n", metrics.reactions)
+	fmt.Fprintf(w, "# HELP dnsgen_reaction_failures_total Reactions in which a stage failed.\n# TYPE dnsgen_reaction_failures_total counter\n")
+	fmt.Fprintf(w, "dnsgen_reaction_failures_total %d\n", metrics.failedReactions)
+	writeHistogram(w, "dnsgen_lookup_duration_seconds", "Time taken to look up a host.", &metrics.lookups)
+	writeHistogram(w, "dnsgen_render_duration_seconds", "Time taken to render the template.", &metrics.renders)
+	writeHistogram(w, "dnsgen_command_duration_seconds", "Time taken by each run of -exec or -exec-argv.", &metrics.commands)
+
+	fmt.Fprintf(w, "# HELP dnsgen_addresses Addresses a host currently resolves to.\n# TYPE dnsgen_addresses gauge\n")
+	hosts := make([]string, 0, len(counts))
+	for host := range counts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "dnsgen_addresses{host=\"%s\"} %d\n", escapeLabel(host), counts[host])
+	}
+
+	fmt.Fprintf(w, "# HELP dnsgen_host_stability Whether a host is stable, changing or flapping; 1 for its current stability.\n# TYPE dnsgen_host_stability gauge\n")
+	for _, host := range hosts {
+		for _, st := range []string{stable, changing, flapping} {
+			v := 0
+			if stability[host] == st {
+				v = 1
+			}
+			fmt.Fprintf(w, "dnsgen_host_stability{host=\"%s\",stability=\"%s\"} %d\n", escapeLabel(host), st, v)
+		}
+	}
+
+	outputs := make([]string, 0, len(renders))
+	for output := range renders {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	fmt.Fprintf(w, "# HELP dnsgen_render_error Whether the most recent render or write of an output failed.\n# TYPE dnsgen_render_error gauge\n")
+	for _, output := range outputs {
+		failing := 0
+		if renders[output].Err != nil {
+			failing = 1
+		}
+		fmt.Fprintf(w, "dnsgen_render_error{template=\"%s\"} %d\n", escapeLabel(output), failing)
+	}
+	fmt.Fprintf(w, "# HELP dnsgen_render_last_success_timestamp_seconds When an output's dest was last written successfully, 0 if it hasn't been yet.\n# TYPE dnsgen_render_last_success_timestamp_seconds gauge\n")
+	for _, output := range outputs {
+		var ts float64
+		if at := renders[output].LastSuccess; !at.IsZero() {
+			ts = float64(at.UnixNano()) / 1e9
+		}
+		fmt.Fprintf(w, "dnsgen_render_last_success_timestamp_seconds{template=\"%s\"} %g\n", escapeLabel(output), ts)
+	}
+}
+
+func writeCounter(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	hosts := make([]string, 0, len(values))
+	for host := range values {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s{host=\"%s\"} %d\n", name, escapeLabel(host), values[host])
+	}
+}
+
+func writeHistogram(w io.Writer, name, help string, h *histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, le := range durationBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %g\n%s_count %d\n", name, h.count, name, h.sum, name, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMetricsReactionsRestartsAndStability(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	updateHost(Host{Name: "a.example.com", Addresses: []string{"10.0.0.1"}})
+	metrics.Lock()
+	reactions, failures := metrics.reactions, metrics.failedReactions
+	restarts := metrics.monitorRestarts["a.example.com"]
+	metrics.Unlock()
+
+	countReaction(reactResult{})
+	countReaction(reactResult{Stages: []stageResult{{Stage: stageRender, Err: errors.New("broken template")}}})
+	countMonitorRestart("a.example.com")
+
+	m := metricsText()
+	for _, want := range []string{
+		"# TYPE dnsgen_reactions_total counter",
+		"dnsgen_reactions_total " + strconv.FormatUint(reactions+2, 10),
+		"dnsgen_reaction_failures_total " + strconv.FormatUint(failures+1, 10),
+		`dnsgen_monitor_restarts_total{host="a.example.com"} ` + strconv.FormatUint(restarts+1, 10),
+		"# TYPE dnsgen_host_stability gauge",
+		`dnsgen_host_stability{host="a.example.com",stability="stable"} 1`,
+		`dnsgen_host_stability{host="a.example.com",stability="flapping"} 0`,
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("metrics are missing %q:\n%s", want, m)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// Looks up every host once, reacts once and returns the exit status: 0 if every stage of the
+// reaction succeeded, 1 otherwise. With -summary-format, a summary of the run is written
+// before returning. Used by -once instead of the monitors.
+func runOnce() int {
+	hosts, err := parseHosts(hostArgs())
+	if err != nil {
+		logError("invalid hostname arguments: %v", err)
+		return 1
+	}
+	registerHosts(hosts)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make(map[string]error)
+	)
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host hostSpec) {
+			defer wg.Done()
+			r := host.lookup()
+			addresses, err := r.addresses, r.err
+			if err != nil {
+				logError("error resolving %s: %v", host.Name, err)
+				mu.Lock()
+				errs[host.Name] = err
+				mu.Unlock()
+			}
+			addresses, usingFallback := withFallback(host.Name, addresses)
+			setEmpty(host, len(addresses) == 0)
+			updateHost(Host{Name: host.Name, Addresses: addresses, UsingFallback: usingFallback})
+		}(host)
+	}
+	wg.Wait()
+
+	result := react(context.Background(), nil)
+	if summaryFormat != "" {
+		if err := writeSummary(summarize(errs, result)); err != nil {
+			logError("error writing summary: %v", err)
+			return 1
+		}
+	}
+	if err := result.Err(); err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"plugin"
+	"sort"
+)
+
+// Loads additional template functions from a Go plugin built with -buildmode=plugin. The
+// plugin must export
+//
+//	func Funcs() template.FuncMap
+//
+// Go plugins only work on Linux, macOS and FreeBSD, in binaries built with cgo enabled (the
+// static release image is not), and the plugin must be built with the same Go version and
+// dependency versions as dns-gen itself.
+func loadFuncPlugin(path string) error {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return err
+	}
+	sym, err := p.Lookup("Funcs")
+	if err != nil {
+		return err
+	}
+
+	var funcs template.FuncMap
+	switch f := sym.(type) {
+	case func() template.FuncMap:
+		funcs = f()
+	case func() map[string]interface{}:
+		funcs = f()
+	default:
+		return fmt.Errorf("%s: Funcs has type %T, expected func() template.FuncMap", path, sym)
+	}
+
+	// check every name before adding any, so a conflicting plugin adds nothing
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := Funcs[name]; ok {
+			return fmt.Errorf("%s: function %q conflicts with a built-in function", path, name)
+		}
+	}
+	for name, fn := range funcs {
+		Funcs[name] = fn
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testPlugin = `package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+func Funcs() template.FuncMap {
+	return template.FuncMap{
+		"shout":   func(s string) string { return strings.ToUpper(s) + "!" },
+		"whisper": func(s string) string { return strings.ToLower(s) + "..." },
+	}
+}
+`
+
+// the test plugin, built at most once per test binary: a process can't load two plugins
+// with the same package path, even from different files
+var builtPlugin struct {
+	once sync.Once
+	dir  string
+	path string
+	skip string
+	err  error
+}
+
+// Builds a plugin exporting "shout" and "whisper" template functions, skipping the test where
+// Go plugins can't be built or loaded. Returns its path.
+func buildTestPlugin(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("building a plugin is slow")
+	}
+	if raceEnabled {
+		t.Skip("a plugin built without -race can't be loaded by a race-enabled binary")
+	}
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+	default:
+		t.Skipf("Go plugins aren't supported on %s", runtime.GOOS)
+	}
+	builtPlugin.once.Do(func() {
+		goTool := filepath.Join(runtime.GOROOT(), "bin", "go")
+		if out, err := exec.Command(goTool, "env", "CGO_ENABLED").Output(); err != nil || strings.TrimSpace(string(out)) != "1" {
+			builtPlugin.skip = "Go plugins need cgo"
+			return
+		}
+		dir, err := ioutil.TempDir("", "dns-gen-plugin-")
+		if err != nil {
+			builtPlugin.err = err
+			return
+		}
+		builtPlugin.dir = dir
+		for name, content := range map[string]string{
+			"go.mod":    "module shout\n\ngo 1.13\n",
+			"plugin.go": testPlugin,
+		} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				builtPlugin.err = err
+				return
+			}
+		}
+		path := filepath.Join(dir, "shout.so")
+		cmd := exec.Command(goTool, "build", "-buildmode=plugin", "-o", path, ".")
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			builtPlugin.skip = fmt.Sprintf("can't build a plugin here: %v\n%s", err, out)
+			return
+		}
+		builtPlugin.path = path
+	})
+	if builtPlugin.skip != "" {
+		t.Skip(builtPlugin.skip)
+	}
+	if builtPlugin.err != nil {
+		t.Fatal(builtPlugin.err)
+	}
+	return builtPlugin.path
+}
+
+// Removes the test plugin, if one was built. Called once every test has run.
+func removeTestPlugin() {
+	if builtPlugin.dir != "" {
+		os.RemoveAll(builtPlugin.dir)
+	}
+}
+
+func TestLoadFuncPlugin(t *testing.T) {
+	path := buildTestPlugin(t)
+	defer delete(Funcs, "shout")
+	defer delete(Funcs, "whisper")
+
+	// a plugin with a function that conflicts adds none of its functions
+	Funcs["whisper"] = strings.ToLower
+	if err := loadFuncPlugin(path); err == nil || !strings.Contains(err.Error(), `"whisper"`) {
+		t.Errorf("loading the plugin gave %v, want a conflict", err)
+	}
+	if _, ok := Funcs["shout"]; ok {
+		t.Error("a conflicting plugin added some of its functions")
+	}
+	delete(Funcs, "whisper")
+
+	if err := loadFuncPlugin(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := renderString(t, `{{ shout "reload" }} {{ whisper "Quiet" }}`, nil); got != "RELOAD! quiet..." {
+		t.Errorf("got %q, want %q", got, "RELOAD! quiet...")
+	}
+	// a function can't be registered twice
+	if err := loadFuncPlugin(path); err == nil {
+		t.Error("loading the plugin again didn't conflict")
+	}
+}
+
+func TestLoadFuncPluginErrors(t *testing.T) {
+	if err := loadFuncPlugin(filepath.Join(os.TempDir(), "no-such-plugin.so")); err == nil {
+		t.Error("a missing plugin loaded")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	nats "github.com/nats-io/nats.go"
+)
+
+// connection used by -publish, nil when publishing is disabled
+var publisher *nats.Conn
+
+// publishEvent is the message published on each change. Type is "change" for a host whose
+// addresses changed, or "render" for newly rendered content when -publish-content is set.
+type publishEvent struct {
+	Type    string    `json:"type"`
+	Host    string    `json:"host,omitempty"`
+	Old     []string  `json:"old,omitempty"`
+	New     []string  `json:"new,omitempty"`
+	Content []byte    `json:"content,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Connects to the NATS server at url. The connection retries and reconnects in the background;
+// messages published while disconnected are buffered by the client and sent on reconnect.
+func setupPublisher(url string) error {
+	nc, err := nats.Connect(url,
+		nats.Name("dns-gen"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			logError("disconnected from %s: %v", url, err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			logInfo("reconnected to %s", nc.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	publisher = nc
+	return nil
+}
+
+// Publishes ev without waiting for the server. Failures are logged and otherwise ignored, so
+// a broker outage never holds up rendering.
+func publish(ev publishEvent) {
+	if publisher == nil {
+		return
+	}
+	ev.Time = time.Now()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		logError("failed to encode %s event: %v", ev.Type, err)
+		return
+	}
+	if err := publisher.Publish(publishSubject, data); err != nil {
+		logError("failed to publish %s event: %v", ev.Type, err)
+	}
+}
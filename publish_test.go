@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker speaks just enough of the NATS protocol to accept connections and record what is
+// published to it
+type fakeBroker struct {
+	addr string
+	l    net.Listener
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	messages []fakeMessage
+}
+
+type fakeMessage struct {
+	subject string
+	data    []byte
+}
+
+func startFakeBroker(t *testing.T, addr string) *fakeBroker {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{addr: l.Addr().String(), l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	host, port, _ := net.SplitHostPort(b.addr)
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.9.0\",\"host\":%q,\"port\":%s,\"max_payload\":1048576,\"proto\":1}\r\n", host, port)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			io.WriteString(conn, "PONG\r\n")
+		case "PUB":
+			// PUB <subject> [reply-to] <size>, followed by the payload
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.messages = append(b.messages, fakeMessage{subject: fields[1], data: data[:n]})
+			b.mu.Unlock()
+		}
+	}
+}
+
+// Stops accepting connections and drops the open ones, as a broker outage would
+func (b *fakeBroker) stop() {
+	b.l.Close()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// Returns the events published on subject so far
+func (b *fakeBroker) events(t *testing.T, subject string) []publishEvent {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []publishEvent
+	for _, m := range b.messages {
+		if m.subject != subject {
+			continue
+		}
+		var ev publishEvent
+		if err := json.Unmarshal(m.data, &ev); err != nil {
+			t.Fatalf("published %q, which isn't an event: %v", m.data, err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// Connects -publish to a fake broker, returning it and a func that disconnects
+func setupPublish(t *testing.T) (*fakeBroker, func()) {
+	t.Helper()
+	b := startFakeBroker(t, "127.0.0.1:0")
+	if err := setupPublisher("nats://" + b.addr); err != nil {
+		t.Fatal(err)
+	}
+	return b, func() {
+		publisher.Close()
+		publisher = nil
+		b.stop()
+	}
+}
+
+func TestPublishChanges(t *testing.T) {
+	defer resetStore()
+	b, stop := setupPublish(t)
+	defer stop()
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10.0.0.1"}},
+		{addresses: []string{"10.0.0.2"}},
+	}}
+	stopMonitors := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stopMonitors()
+
+	want := []publishEvent{
+		{Type: "change", Host: "a.example.com", New: []string{"10.0.0.1"}},
+		{Type: "change", Host: "a.example.com", Old: []string{"10.0.0.1"}, New: []string{"10.0.0.2"}},
+	}
+	if !eventually(func() bool { publisher.Flush(); return len(b.events(t, publishSubject)) >= len(want) }) {
+		t.Fatalf("published %+v, want %d changes", b.events(t, publishSubject), len(want))
+	}
+	for i, ev := range b.events(t, publishSubject)[:len(want)] {
+		if ev.Time.IsZero() {
+			t.Errorf("change %d has no time", i+1)
+		}
+		ev.Time = time.Time{}
+		if !reflect.DeepEqual(ev, want[i]) {
+			t.Errorf("change %d = %+v, want %+v", i+1, ev, want[i])
+		}
+	}
+}
+
+func TestPublishContent(t *testing.T) {
+	_, _, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }} {{ end }}`)
+	defer restore()
+	b, stop := setupPublish(t)
+	defer stop()
+	defer func(orig bool) { publishContent = orig }(publishContent)
+	publishContent = true
+
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	// an unchanged render isn't published again
+	react(context.Background(), nil)
+	publisher.Flush()
+	events := b.events(t, publishSubject)
+	if len(events) != 1 || events[0].Type != "render" || string(events[0].Content) != "a " {
+		t.Errorf("published %+v, want the rendered content once", events)
+	}
+}
+
+func TestPublishBuffersWhileDisconnected(t *testing.T) {
+	b, stop := setupPublish(t)
+	defer stop()
+	b.stop()
+	if !eventually(func() bool { return !publisher.IsConnected() }) {
+		t.Fatal("the publisher never noticed the broker was gone")
+	}
+
+	// publishing doesn't wait for the broker to come back
+	start := time.Now()
+	publish(publishEvent{Type: "change", Host: "a.example.com", New: []string{"10.0.0.1"}})
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("publishing while disconnected took %v", took)
+	}
+
+	// and the event is sent once it does
+	restarted := startFakeBroker(t, b.addr)
+	defer restarted.stop()
+	for deadline := time.Now().Add(10 * time.Second); len(restarted.events(t, publishSubject)) == 0; time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the event published while disconnected was never sent")
+		}
+	}
+	if ev := restarted.events(t, publishSubject)[0]; ev.Host != "a.example.com" {
+		t.Errorf("got %+v after reconnecting", ev)
+	}
+}
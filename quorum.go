@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// resolvers queried by -quorum-resolvers, built once at startup
+var quorumPool []Resolver
+
+func setupQuorum(servers string) error {
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			quorumPool = append(quorumPool, netResolver{r: newResolver(server), rtype: recordType})
+		}
+	}
+	if len(quorumPool) < 2 {
+		return fmt.Errorf("at least two resolvers are required")
+	}
+	if quorum == 0 {
+		quorum = len(quorumPool)/2 + 1
+	}
+	if quorum < 1 || quorum > len(quorumPool) {
+		return fmt.Errorf("-quorum must be between 1 and %d", len(quorumPool))
+	}
+	return nil
+}
+
+// Looks up hostname with every resolver in the pool, returning the address set that at least
+// -quorum of them agree on. If no set reaches the quorum the disagreement is logged and a
+// temporary error is returned, so the monitor keeps the last agreed set.
+func lookupQuorum(ctx context.Context, hostname string) ([]string, error) {
+	results := make([][]string, len(quorumPool))
+	errs := make([]error, len(quorumPool))
+	var wg sync.WaitGroup
+	for i, r := range quorumPool {
+		wg.Add(1)
+		go func(i int, r Resolver) {
+			defer wg.Done()
+			qctx, cancel := queryContext(ctx)
+			defer cancel()
+			results[i], errs[i] = r.Lookup(qctx, hostname)
+		}(i, r)
+	}
+	wg.Wait()
+
+	votes := make(map[string]int)
+	var views []string
+	for i, addresses := range results {
+		if errs[i] != nil {
+			views = append(views, fmt.Sprintf("error: %v", errs[i]))
+			continue
+		}
+		key := strings.Join(addresses, ",")
+		if votes[key]++; votes[key] >= quorum {
+			return addresses, nil
+		}
+		views = append(views, fmt.Sprintf("%v", logAddrs(addresses)))
+	}
+
+	logError("resolvers disagree on %s, no set reached a quorum of %d: %s", hostname, quorum, strings.Join(views, "; "))
+	return nil, &net.DNSError{Err: "no quorum among resolvers", Name: hostname, IsTemporary: true}
+}
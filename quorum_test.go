@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Makes the pool fakeResolvers answering with results, one each, and requires n of them to agree
+func setupQuorumPool(n int, results ...[]fakeResult) func() {
+	origPool, origQuorum := quorumPool, quorum
+	quorumPool, quorum = nil, n
+	for _, r := range results {
+		quorumPool = append(quorumPool, &fakeResolver{results: r})
+	}
+	return func() { quorumPool, quorum = origPool, origQuorum }
+}
+
+func TestLookupQuorum(t *testing.T) {
+	one := fakeResult{addresses: []string{"10.0.0.1"}}
+	two := fakeResult{addresses: []string{"10.0.0.2", "10.0.0.1"}}
+	failed := fakeResult{err: errors.New("timeout")}
+	tests := []struct {
+		name    string
+		quorum  int
+		results []fakeResult
+		want    []string
+	}{
+		{"all agree", 2, []fakeResult{one, one, one}, []string{"10.0.0.1"}},
+		{"a majority agrees", 2, []fakeResult{one, two, one}, []string{"10.0.0.1"}},
+		{"the order of the addresses doesn't matter", 2, []fakeResult{two, one, {addresses: []string{"10.0.0.1", "10.0.0.2"}}}, []string{"10.0.0.1", "10.0.0.2"}},
+		{"a failed resolver doesn't vote", 2, []fakeResult{failed, one, one}, []string{"10.0.0.1"}},
+		{"every set disagrees", 2, []fakeResult{one, two, {addresses: []string{"10.0.0.3"}}}, nil},
+		{"too many failures", 2, []fakeResult{failed, one, failed}, nil},
+		{"short of a higher quorum", 3, []fakeResult{one, one, two}, nil},
+	}
+	for _, tt := range tests {
+		var results [][]fakeResult
+		for _, r := range tt.results {
+			results = append(results, []fakeResult{r})
+		}
+		restore := setupQuorumPool(tt.quorum, results...)
+		got, err := lookupQuorum(context.Background(), "a.example.com")
+		restore()
+		if tt.want == nil {
+			if err == nil || !isTemporary(err) {
+				t.Errorf("%s: got %v, %v; want a temporary error", tt.name, got, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, %v; want %v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestMonitorKeepsTheLastAgreedSet(t *testing.T) {
+	defer resetStore()
+	one := fakeResult{addresses: []string{"10.0.0.1"}}
+	two := fakeResult{addresses: []string{"10.0.0.2"}}
+	// the resolvers agree, then split, then agree on a new set
+	defer setupQuorumPool(2,
+		[]fakeResult{one, one, one, two},
+		[]fakeResult{one, two, two, two},
+		[]fakeResult{one, {addresses: []string{"10.0.0.3"}}, {addresses: []string{"10.0.0.3"}}, two},
+	)()
+	stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com"})
+	defer stop()
+
+	ev, ok := nextChange(time.Second)
+	if !ok || !reflect.DeepEqual(ev.New, []string{"10.0.0.1"}) {
+		t.Fatalf("first change = %+v, want the agreed set", ev)
+	}
+	// the two lookups without a quorum don't change anything
+	ev, ok = nextChange(time.Second)
+	if !ok || !reflect.DeepEqual(ev.Old, []string{"10.0.0.1"}) || !reflect.DeepEqual(ev.New, []string{"10.0.0.2"}) {
+		t.Fatalf("second change = %+v, want 10.0.0.1 -> 10.0.0.2", ev)
+	}
+}
+
+func TestSetupQuorum(t *testing.T) {
+	defer setupQuorumPool(0)()
+	if err := setupQuorum("10.0.0.1,10.0.0.2,10.0.0.3"); err != nil || quorum != 2 || len(quorumPool) != 3 {
+		t.Errorf("three resolvers: err %v, quorum %d of %d, want 2 of 3", err, quorum, len(quorumPool))
+	}
+
+	quorumPool, quorum = nil, 0
+	if err := setupQuorum("10.0.0.1"); err == nil {
+		t.Error("a single resolver was accepted")
+	}
+	quorumPool, quorum = nil, 3
+	if err := setupQuorum("10.0.0.1, 10.0.0.2"); err == nil {
+		t.Error("a quorum larger than the pool was accepted")
+	}
+}
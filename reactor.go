@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// changeEvent asks the reactor to react. Host is set for a host whose addresses changed, so
+// the change can be audited along with the outcome of the react that handled it. Expired is set
+// instead for a host whose records' TTL ran out under -regen-on-ttl; the react it leads to runs
+// the command even if the output didn't change.
+type changeEvent struct {
+	Host     string
+	Old, New []string
+	At       time.Time
+	Expired  string
+}
+
+// the command line group's changes are sent here and handled by its reactor
+var changes = make(chan changeEvent, 256)
+
+// the queue of every running reactor: changes for the command line group, or one per -config group
+var reactorQueues = []chan changeEvent{changes}
+
+// Asks every reactor for a react without a host change to audit, e.g. after a reload signal
+func triggerReact() {
+	for _, q := range reactorQueues {
+		requestReact(q)
+	}
+}
+
+// Asks the reactor reading q for a react without a host change to audit
+func requestReact(q chan changeEvent) {
+	select {
+	case q <- changeEvent{}:
+	default:
+		// the queue is full, so a react is already pending and will see this change too
+	}
+}
+
+// Asks for a react after hostname's addresses changed from old to new. to is the queue of the
+// reactor that renders hostname; nil means the command line group's. Gives up if ctx is
+// cancelled while the queue is full, as its reactor may already have stopped.
+func reportChange(ctx context.Context, to chan changeEvent, hostname string, old, new []string) {
+	if old != nil {
+		countChange(hostname)
+	}
+	ev := changeEvent{Host: hostname, Old: old, New: new, At: time.Now()}
+	broadcastChange(ev)
+	queueChange(ctx, to, ev)
+}
+
+// Asks for a react that runs the command whether or not the output changes, after the TTL of
+// hostname's records ran out. to is the queue of the reactor that renders hostname; nil means the
+// command line group's.
+func reportExpiry(ctx context.Context, to chan changeEvent, hostname string) {
+	queueChange(ctx, to, changeEvent{Expired: hostname, At: time.Now()})
+}
+
+// Queues ev for the reactor reading to, or the command line group's if to is nil, unless ctx is
+// cancelled first
+func queueChange(ctx context.Context, to chan changeEvent, ev changeEvent) {
+	if to == nil {
+		to = changes
+	}
+	select {
+	case to <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// Reports whether any of changes is for an expired TTL
+func anyExpired(changes []changeEvent) bool {
+	for _, c := range changes {
+		if c.Expired != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Collects a group's changes from queue and reacts to them with react. All changes that are
+// pending when a react starts are handled by that one react: with -debounce it waits until no
+// change has arrived for the debounce window (but no longer than -render-debounce-max after the
+// first of them), and -min-react-interval puts off a react that would follow
+// the previous one too closely. This is the only place a group reacts while monitoring, so its
+// reacts never overlap. Returns once ctx is cancelled, after any react in progress has finished;
+// changes still pending then are dropped.
+func runReactor(ctx context.Context, queue <-chan changeEvent, react func(context.Context, []changeEvent) reactResult) {
+	var (
+		pending []changeEvent
+		dirty   bool
+		// when the first of the pending changes arrived
+		first    time.Time
+		last     time.Time
+		settled  <-chan time.Time
+		deferred <-chan time.Time
+	)
+	for {
+		select {
+		case ev := <-queue:
+			if !dirty {
+				first = time.Now()
+			}
+			pending, dirty = append(pending, ev), true
+			if debounce > 0 {
+				if settled == nil && debug {
+					logDebug("waiting %v for changes to settle before reacting", debounce)
+				}
+				wait := debounce
+				if debounceMax > 0 {
+					// a host that keeps changing mustn't put the reaction off forever
+					if left := debounceMax - time.Since(first); left < wait {
+						wait = left
+					}
+				}
+				settled = time.After(wait)
+			}
+		case <-settled:
+			settled = nil
+		case <-deferred:
+			deferred = nil
+		case <-ctx.Done():
+			return
+		}
+		if !dirty || settled != nil || deferred != nil {
+			continue
+		}
+		if wait := minReactInterval - time.Since(last); minReactInterval > 0 && wait > 0 {
+			logInfo("deferring reaction for %v due to -min-react-interval", wait)
+			deferred = time.After(wait)
+			continue
+		}
+
+		// pick up anything else that arrived in the meantime
+	drain:
+		for {
+			select {
+			case ev := <-queue:
+				pending = append(pending, ev)
+			default:
+				break drain
+			}
+		}
+		last = time.Now()
+		setLastReact(last)
+		result := react(ctx, pending)
+		countReaction(result)
+		for _, ev := range pending {
+			if ev.Host != "" {
+				audit(ev, result)
+			}
+		}
+		pending, dirty = nil, false
+	}
+}
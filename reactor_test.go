@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reactRecorder stands in for react, recording when it was called and with which changes
+type reactRecorder struct {
+	mu    sync.Mutex
+	calls []recordedReact
+	ch    chan struct{}
+}
+
+type recordedReact struct {
+	at      time.Time
+	changes []changeEvent
+}
+
+func (r *reactRecorder) react(ctx context.Context, changes []changeEvent) reactResult {
+	r.mu.Lock()
+	r.calls = append(r.calls, recordedReact{at: time.Now(), changes: changes})
+	r.mu.Unlock()
+	r.ch <- struct{}{}
+	return reactResult{}
+}
+
+func (r *reactRecorder) reacts() []recordedReact {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]recordedReact(nil), r.calls...)
+}
+
+// Waits for the next react, failing the test if there's none within timeout
+func (r *reactRecorder) wait(t *testing.T, timeout time.Duration) {
+	t.Helper()
+	select {
+	case <-r.ch:
+	case <-time.After(timeout):
+		t.Fatalf("no react within %v", timeout)
+	}
+}
+
+// Runs a reactor on the package-level queue that records its reactions instead of reacting.
+// Returns the recorder and a func that stops the reactor.
+func startReactor() (*reactRecorder, func()) {
+	drainChanges()
+	rec := &reactRecorder{ch: make(chan struct{}, 100)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runReactor(ctx, changes, rec.react)
+		close(done)
+	}()
+	return rec, func() {
+		cancel()
+		<-done
+		drainChanges()
+	}
+}
+
+func TestReactorDebounceCoalescesABurst(t *testing.T) {
+	orig := debounce
+	debounce = 60 * time.Millisecond
+	defer func() { debounce = orig }()
+	rec, stop := startReactor()
+	defer stop()
+
+	var last time.Time
+	for i := 0; i < 5; i++ {
+		reportChange(context.Background(), nil, "a.example.com", nil, []string{"10.0.0.1"})
+		last = time.Now()
+		time.Sleep(20 * time.Millisecond)
+	}
+	rec.wait(t, time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	reacts := rec.reacts()
+	if len(reacts) != 1 {
+		t.Fatalf("a burst of 5 changes caused %d reacts, want 1", len(reacts))
+	}
+	if n := len(reacts[0].changes); n != 5 {
+		t.Errorf("the react handled %d changes, want all 5", n)
+	}
+	if quiet := reacts[0].at.Sub(last); quiet < debounce {
+		t.Errorf("reacted %v after the last change, before the %v debounce window passed", quiet, debounce)
+	}
+}
+
+func TestReactorMinReactInterval(t *testing.T) {
+	orig := minReactInterval
+	minReactInterval = 150 * time.Millisecond
+	defer func() { minReactInterval = orig }()
+	rec, stop := startReactor()
+	defer stop()
+
+	reportChange(context.Background(), nil, "a.example.com", nil, []string{"10.0.0.1"})
+	rec.wait(t, time.Second)
+	for i := 0; i < 3; i++ {
+		reportChange(context.Background(), nil, "a.example.com", nil, []string{"10.0.0.2"})
+	}
+	rec.wait(t, time.Second)
+	time.Sleep(200 * time.Millisecond)
+
+	reacts := rec.reacts()
+	if len(reacts) != 2 {
+		t.Fatalf("got %d reacts, want 2: one immediately and one for the deferred changes", len(reacts))
+	}
+	if gap := reacts[1].at.Sub(reacts[0].at); gap < minReactInterval {
+		t.Errorf("reacts were %v apart, less than -min-react-interval %v", gap, minReactInterval)
+	}
+	if n := len(reacts[1].changes); n != 3 {
+		t.Errorf("the deferred react handled %d changes, want the 3 collapsed into it", n)
+	}
+}
+
+func TestReactorDebounceMax(t *testing.T) {
+	origDebounce, origMax := debounce, debounceMax
+	debounce, debounceMax = 50*time.Millisecond, 150*time.Millisecond
+	defer func() { debounce, debounceMax = origDebounce, origMax }()
+	rec, stop := startReactor()
+	defer stop()
+
+	// changes keep arriving faster than the debounce window, so they never settle
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for time.Since(start) < 400*time.Millisecond {
+			reportChange(context.Background(), nil, "a.example.com", nil, []string{"10.0.0.1"})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	rec.wait(t, time.Second)
+	<-done
+
+	reacts := rec.reacts()
+	if delay := reacts[0].at.Sub(start); delay > debounceMax+50*time.Millisecond {
+		t.Errorf("first react came %v after the first change, later than -render-debounce-max %v", delay, debounceMax)
+	}
+	// by the time the changes stop, the ceiling has passed again, so there must have been a
+	// second react while they were still arriving
+	if len(reacts) < 2 {
+		t.Errorf("%d reacts during 400ms of constant changes, want at least 2", len(reacts))
+	}
+}
+
+func TestReportChangeStopsOnShutdown(t *testing.T) {
+	// a full queue whose reactor has stopped
+	queue := make(chan changeEvent, 1)
+	queue <- changeEvent{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reportChange(ctx, queue, "a.example.com", nil, []string{"10.0.0.1"})
+		reportExpiry(ctx, queue, "a.example.com")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still blocked on the queue after shutdown")
+	}
+}
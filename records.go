@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// values for -type
+const (
+	typeHost  = "host"
+	typeSRV   = "srv"
+	typeMX    = "mx"
+	typeTXT   = "txt"
+	typeCNAME = "cname"
+)
+
+func validateRecordType() error {
+	switch recordType {
+	case typeHost, typeSRV, typeMX, typeTXT, typeCNAME:
+		return nil
+	}
+	return fmt.Errorf("unknown -type %q (expected host, srv, mx, txt or cname)", recordType)
+}
+
+// Looks up hostname's records of type rtype and returns them as sorted strings, so they can be
+// compared like address sets:
+//
+//	host:  the A and AAAA addresses
+//	srv:   "priority weight port target" (hostname is the full _service._proto.name)
+//	mx:    "preference host"
+//	txt:   each TXT string
+//	cname: the canonical name
+func lookupRecords(ctx context.Context, r *net.Resolver, rtype, hostname string) ([]string, error) {
+	var records []string
+	switch rtype {
+	case typeHost:
+		return lookupWith(ctx, r, hostname)
+	case typeSRV:
+		_, srvs, err := r.LookupSRV(ctx, "", "", hostname)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			records = append(records, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	case typeMX:
+		mxs, err := r.LookupMX(ctx, hostname)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			records = append(records, strconv.Itoa(int(mx.Pref))+" "+mx.Host)
+		}
+	case typeTXT:
+		txts, err := r.LookupTXT(ctx, hostname)
+		if err != nil {
+			return nil, err
+		}
+		records = txts
+	case typeCNAME:
+		cname, err := r.LookupCNAME(ctx, hostname)
+		if err != nil {
+			return nil, err
+		}
+		records = []string{cname}
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", rtype)
+	}
+	sort.Strings(records)
+	return records, nil
+}
+
+// names of the fields of each record type that -watch-fields can select, in the order
+// lookupRecords writes them
+var recordFields = map[string][]string{
+	typeSRV: {"priority", "weight", "port", "target"},
+	typeMX:  {"preference", "host"},
+}
+
+// Parses a comma separated list of -type record field names into field indexes
+func parseWatchFields(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	names, ok := recordFields[recordType]
+	if !ok {
+		return nil, fmt.Errorf("watched fields are only supported with -type srv or mx")
+	}
+	var fields []int
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		i := indexOf(names, name)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown %s field %q (expected %s)", recordTypeLabel(), name, strings.Join(names, ", "))
+		}
+		fields = append(fields, i)
+	}
+	sort.Ints(fields)
+	return fields, nil
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Reduces each record to the given fields, so records that only differ in other fields compare
+// as equal. The result is sorted; records are returned unchanged if fields is nil.
+func projectRecords(records []string, fields []int) []string {
+	if fields == nil || records == nil {
+		return records
+	}
+	projected := make([]string, len(records))
+	for i, r := range records {
+		parts := strings.Fields(r)
+		var kept []string
+		for _, f := range fields {
+			if f < len(parts) {
+				kept = append(kept, parts[f])
+			}
+		}
+		projected[i] = strings.Join(kept, " ")
+	}
+	sort.Strings(projected)
+	return projected
+}
+
+// SRVRecord is an SRV record of a host, as found in its .SRV
+type SRVRecord struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+}
+
+// Parses an SRV record in "priority weight port target" form
+func parseSRV(record string) (SRVRecord, bool) {
+	fields := strings.Fields(record)
+	if len(fields) != 4 {
+		return SRVRecord{}, false
+	}
+	var nums [3]uint16
+	for i := range nums {
+		n, err := strconv.ParseUint(fields[i], 10, 16)
+		if err != nil {
+			return SRVRecord{}, false
+		}
+		nums[i] = uint16(n)
+	}
+	return SRVRecord{Priority: nums[0], Weight: nums[1], Port: nums[2], Target: fields[3]}, true
+}
+
+// Returns "target:port" for each SRV record in "priority weight port target" form. Anything
+// else is skipped.
+func srvEndpoints(records []string) []string {
+	var endpoints []string
+	for _, r := range records {
+		srv, ok := parseSRV(r)
+		if !ok {
+			continue
+		}
+		endpoints = append(endpoints, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+	}
+	return endpoints
+}
+
+// Sets h's .A, .AAAA, .SRV or .TXT from its records, depending on the -type being monitored.
+// The fields of other types are left nil.
+func setTypedRecords(h *Host) {
+	switch recordType {
+	case typeHost:
+		for _, addr := range h.Addresses {
+			if ip := net.ParseIP(addr); ip == nil {
+				continue
+			} else if ip.To4() != nil {
+				h.A = append(h.A, addr)
+			} else {
+				h.AAAA = append(h.AAAA, addr)
+			}
+		}
+	case typeSRV:
+		for _, r := range h.Addresses {
+			if srv, ok := parseSRV(r); ok {
+				h.SRV = append(h.SRV, srv)
+			}
+		}
+	case typeTXT:
+		h.TXT = append([]string(nil), h.Addresses...)
+	}
+}
+
+// label used for the record type in log messages
+func recordTypeLabel() string {
+	if recordType == typeHost {
+		return "A/AAAA"
+	}
+	return strings.ToUpper(recordType)
+}
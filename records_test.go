@@ -0,0 +1,196 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSRVEndpoints(t *testing.T) {
+	records := []string{
+		"10 60 5060 sip1.example.com.",
+		"20 0 5061 sip2.example.com",
+		// not SRV data, so skipped
+		"10.0.0.1",
+		"10 60 2001:db8::1.",
+	}
+	got := srvEndpoints(records)
+	if want := []string{"sip1.example.com:5060", "sip2.example.com:5061"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("srvEndpoints = %q, want %q", got, want)
+	}
+	if got := srvEndpoints([]string{"10 60 443 2001:db8::1"}); !reflect.DeepEqual(got, []string{"[2001:db8::1]:443"}) {
+		t.Errorf("an IPv6 target = %q, want it bracketed", got)
+	}
+}
+
+func TestTypedRecords(t *testing.T) {
+	defer func(orig string) { recordType = orig }(recordType)
+	const text = `{{ range .Hosts }}{{ .Name }} A={{ .A }} AAAA={{ .AAAA }} TXT={{ .TXT }}` +
+		`{{ range .SRV }} SRV={{ .Target }}:{{ .Port }}/{{ .Priority }}/{{ .Weight }}{{ end }}
+{{ end }}`
+
+	for _, tt := range []struct {
+		rtype     string
+		addresses []string
+		want      string
+	}{
+		{typeHost, []string{"10.0.0.1", "2001:db8::1", "10.0.0.2"},
+			"a.example.com A=[10.0.0.1 10.0.0.2] AAAA=[2001:db8::1] TXT=[]\n"},
+		{typeSRV, []string{"10 60 5060 sip1.example.com.", "20 0 5061 sip2.example.com."},
+			"a.example.com A=[] AAAA=[] TXT=[] SRV=sip1.example.com.:5060/10/60 SRV=sip2.example.com.:5061/20/0\n"},
+		{typeTXT, []string{"v=spf1 -all"},
+			"a.example.com A=[] AAAA=[] TXT=[v=spf1 -all]\n"},
+		// types without a namespace of their own leave them all empty
+		{typeMX, []string{"10 mx.example.com."},
+			"a.example.com A=[] AAAA=[] TXT=[]\n"},
+	} {
+		recordType = tt.rtype
+		resetStore()
+		updateHost(Host{Name: "a.example.com", Addresses: tt.addresses})
+		if got := renderString(t, text, snapshotHosts(nil)); got != tt.want {
+			t.Errorf("-type %s rendered %q, want %q", tt.rtype, got, tt.want)
+		}
+	}
+	resetStore()
+}
+
+func TestParseSRV(t *testing.T) {
+	if got, ok := parseSRV("10 60 5060 sip.example.com."); !ok || got != (SRVRecord{10, 60, 5060, "sip.example.com."}) {
+		t.Errorf("got %+v, %v", got, ok)
+	}
+	for _, r := range []string{"10.0.0.1", "10 60 sip.example.com.", "10 60 70000 sip.example.com.", "a b c d"} {
+		if _, ok := parseSRV(r); ok {
+			t.Errorf("%q parsed as an SRV record", r)
+		}
+	}
+}
+
+func TestNormalizeRecord(t *testing.T) {
+	defer func(orig string) { recordType = orig }(recordType)
+	recordType = typeSRV
+	tests := []struct {
+		record, want string
+	}{
+		{"10 60 5060 SIP1.Example.COM.", "10 60 5060 sip1.example.com"},
+		{"10 60 5060 sip1.example.com", "10 60 5060 sip1.example.com"},
+		{"Mail.Example.com.", "mail.example.com"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"FD00::1", "FD00::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeRecord(tt.record); got != tt.want {
+			t.Errorf("normalizeRecord(%q) = %q, want %q", tt.record, got, tt.want)
+		}
+	}
+
+	recordType = typeTXT
+	if got := normalizeRecord("Hello.World."); got != "Hello.World." {
+		t.Errorf("TXT data was normalized to %q", got)
+	}
+}
+
+func TestEquivalentIgnoresCaseAndTrailingDots(t *testing.T) {
+	defer func(orig string) { recordType = orig }(recordType)
+	recordType = typeMX
+	a := []string{"10 MX1.example.com.", "20 mx2.EXAMPLE.com"}
+	b := []string{"10 mx1.example.com", "20 mx2.example.com."}
+	if !equivalent(a, b) {
+		t.Errorf("%q and %q compare as different", a, b)
+	}
+	if c := []string{"10 mx1.example.com", "30 mx2.example.com"}; equivalent(a, c) {
+		t.Errorf("%q and %q compare as equal", a, c)
+	}
+
+	recordType = typeTXT
+	if equivalent([]string{"v=spf1 -all"}, []string{"V=SPF1 -ALL"}) {
+		t.Error("TXT records differing in case compare as equal")
+	}
+}
+
+func TestProjectRecords(t *testing.T) {
+	records := []string{"20 0 5061 sip2.example.com", "10 60 5060 sip1.example.com", "10 5"}
+	if got := projectRecords(records, nil); !reflect.DeepEqual(got, records) {
+		t.Errorf("without fields got %q, want the records unchanged", got)
+	}
+	// fields a record doesn't have are left out
+	want := []string{"", "5060 sip1.example.com", "5061 sip2.example.com"}
+	if got := projectRecords(records, []int{2, 3}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// records that only differ in the fields left out compare as equal
+	a := projectRecords([]string{"10 60 5060 sip1.example.com"}, []int{2, 3})
+	b := projectRecords([]string{"30 0 5060 sip1.example.com"}, []int{2, 3})
+	if !equivalent(a, b) {
+		t.Errorf("%q and %q compare as different", a, b)
+	}
+}
+
+func TestParseWatchFields(t *testing.T) {
+	defer func(orig string) { recordType = orig }(recordType)
+	recordType = typeSRV
+	tests := []struct {
+		spec string
+		want []int
+	}{
+		{"", nil},
+		{"target", []int{3}},
+		{"Target, port", []int{2, 3}},
+		{"priority,weight,port,target", []int{0, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		if got, err := parseWatchFields(tt.spec); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseWatchFields(%q) = %v, %v; want %v", tt.spec, got, err, tt.want)
+		}
+	}
+	if _, err := parseWatchFields("port,host"); err == nil {
+		t.Error("an unknown field was accepted")
+	}
+
+	recordType = typeMX
+	if got, err := parseWatchFields("host"); err != nil || !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("MX host = %v, %v; want [1]", got, err)
+	}
+	recordType = typeHost
+	if _, err := parseWatchFields("target"); err == nil {
+		t.Error("watched fields were accepted for address lookups")
+	}
+}
+
+func TestMonitorOnlyReportsChangesToWatchedFields(t *testing.T) {
+	defer resetStore()
+	defer func(orig string) { recordType = orig }(recordType)
+	recordType = typeSRV
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10 60 5060 sip1.example.com"}},
+		// only the priority and weight change, which aren't watched
+		{addresses: []string{"20 0 5060 sip1.example.com"}},
+		{addresses: []string{"20 0 5060 sip2.example.com"}},
+	}}
+	hosts, err := parseHosts([]string{"_sip._tcp.example.com watch port,target"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts[0].Resolver = r
+	stop := startMonitors(5*time.Millisecond, hosts...)
+	defer stop()
+
+	// the unwatched change is still kept, so it's what the next change is from
+	want := []changeEvent{
+		{Host: "_sip._tcp.example.com", New: []string{"10 60 5060 sip1.example.com"}},
+		{Host: "_sip._tcp.example.com", Old: []string{"20 0 5060 sip1.example.com"}, New: []string{"20 0 5060 sip2.example.com"}},
+	}
+	for i, w := range want {
+		ev, ok := nextChange(time.Second)
+		if !ok {
+			t.Fatalf("change %d was never reported", i+1)
+		}
+		if ev.Host != w.Host || !reflect.DeepEqual(ev.Old, w.Old) || !reflect.DeepEqual(ev.New, w.New) {
+			t.Errorf("change %d = %+v, want %+v", i+1, ev, w)
+		}
+	}
+	if ev, ok := nextChange(50 * time.Millisecond); ok {
+		t.Errorf("unexpected change %+v", ev)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// Resolver looks up the records dns-gen monitors for a hostname (its addresses, or its
+// -type records), returned as sorted strings
+type Resolver interface {
+	Lookup(ctx context.Context, hostname string) ([]string, error)
+}
+
+// netResolver is a Resolver backed by a net.Resolver
+type netResolver struct {
+	r     *net.Resolver
+	rtype string
+}
+
+func (n netResolver) Lookup(ctx context.Context, hostname string) ([]string, error) {
+	return lookupRecords(ctx, n.r, n.rtype, hostname)
+}
+
+var (
+	// resolver used by lookup(), and so by every host without a "via" server
+	resolver Resolver = netResolver{r: net.DefaultResolver, rtype: typeHost}
+
+	// the net.Resolver behind resolver, used directly for plain address lookups
+	systemResolver = net.DefaultResolver
+
+	// if set by -proxy, DNS queries and health check connections are made through it
+	proxyDialer proxy.ContextDialer
+
+	// connects to the nameserver for queries dns-gen builds itself, like -soa, over the same
+	// transport as systemResolver's lookups
+	dialExchange = func(ctx context.Context) (net.Conn, error) {
+		server, err := defaultNameserver()
+		if err != nil {
+			return nil, err
+		}
+		return dialDNS(ctx, "udp", server)
+	}
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// Returns the first nameserver in resolv.conf
+func defaultNameserver() (string, error) {
+	conf, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return "", err
+	}
+	if len(conf.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in %s", resolvConf)
+	}
+	return net.JoinHostPort(conf.Servers[0], conf.Port), nil
+}
+
+// Sends m to the nameserver lookups use, over their transport (plain DNS, -dot or -proxy),
+// and returns the response. This is for queries net.Resolver can't make, such as SOA.
+func exchange(m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := queryContext(context.Background())
+	defer cancel()
+	conn, err := dialExchange(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// dns.Conn uses TCP framing for connections that aren't a net.PacketConn, just like
+	// net.Resolver, so this works for UDP, TCP through the proxy and TLS alike
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		co.SetDeadline(deadline)
+	}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	resp, err := co.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != m.Id {
+		return nil, dns.ErrId
+	}
+	return resp, nil
+}
+
+// Routes DNS queries and health check dials through the SOCKS5 proxy at proxyURL
+func setupProxy(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "socks5" {
+		return fmt.Errorf("unsupported proxy scheme %q, only socks5 is supported", u.Scheme)
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return fmt.Errorf("proxy dialer does not support contexts")
+	}
+	proxyDialer = cd
+
+	// the system resolver is rebuilt so it dials the nameservers from resolv.conf through the proxy
+	systemResolver = &net.Resolver{PreferGo: true, Dial: dialNameserver}
+	dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return proxyDialer.DialContext(ctx, network, address)
+	}
+	return nil
+}
+
+var (
+	// the CAs the -dot server's certificate is verified against; nil uses the system's. Set in
+	// tests.
+	dotRootCAs *x509.CertPool
+	// how long connecting to the -dot server is put off after a failed connection, doubling
+	// with every further failure up to maxDoTBackoff. Shortened in tests.
+	dotBackoff = time.Second
+)
+
+// upper bound on the delay between connections to a failing -dot server
+const maxDoTBackoff = time.Minute
+
+// Sends all queries for hosts without a "via" server over DNS-over-TLS to server. The
+// certificate is verified against serverName, or the server's host if it's empty.
+func setupDoT(server, serverName string) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "853")
+	}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(server)
+	}
+	cfg := &tls.Config{ServerName: serverName, RootCAs: dotRootCAs}
+
+	// after a failed connection, lookups fail straight away until the backoff has passed
+	// rather than each trying the server again
+	var (
+		mu      sync.Mutex
+		backoff time.Duration
+		retryAt time.Time
+		lastErr error
+	)
+	connect := func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialDNS(ctx, "tcp", server)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if deadline, ok := ctx.Deadline(); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			// reported as a dial error so the resolver treats it as temporary and the
+			// monitor keeps its last known addresses and retries
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: conn.RemoteAddr(), Err: err}
+		}
+		return tlsConn, nil
+	}
+	dialExchange = func(ctx context.Context) (net.Conn, error) {
+		mu.Lock()
+		if wait := time.Until(retryAt); wait > 0 {
+			err := lastErr
+			mu.Unlock()
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("not connecting for another %v after: %v", wait.Round(time.Millisecond), err)}
+		}
+		mu.Unlock()
+
+		conn, err := connect(ctx)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if time.Now().Before(retryAt) {
+				// a concurrent connection already failed and set the backoff
+				return nil, err
+			}
+			if backoff *= 2; backoff == 0 {
+				backoff = dotBackoff
+			} else if backoff > maxDoTBackoff {
+				backoff = maxDoTBackoff
+			}
+			retryAt, lastErr = time.Now().Add(backoff), err
+			logError("error connecting to DNS-over-TLS server %s: %v. retrying in %v", server, err, backoff)
+			return nil, err
+		}
+		backoff = 0
+		return conn, nil
+	}
+	systemResolver = &net.Resolver{
+		PreferGo: true,
+		// the resolver uses TCP framing for connections that aren't a net.PacketConn
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			conn, err := dialExchange(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return recordTTLs(ctx, conn), nil
+		},
+	}
+}
+
+// Dials a nameserver, directly or through the proxy. SOCKS5 can only carry TCP, so
+// queries sent through the proxy use DNS over TCP.
+func dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	if proxyDialer != nil {
+		return proxyDialer.DialContext(ctx, "tcp", address)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// Dials a nameserver for a net.Resolver, recording the TTLs of the responses for the lookup
+func dialNameserver(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := dialDNS(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return recordTTLs(ctx, conn), nil
+}
+
+// Points resolver at the nameserver configured by -resolver, -dot or -proxy (or the system's
+// nameservers), looking up -type records
+func setupResolver(server string) {
+	if server != "" {
+		systemResolver = newResolver(server)
+		addr := nameserverAddr(server)
+		dialExchange = func(ctx context.Context) (net.Conn, error) {
+			return dialDNS(ctx, "udp", addr)
+		}
+	} else if systemResolver == net.DefaultResolver && (ttlPolling || regenOnTTL) {
+		// TTLs are read from the responses, which the cgo resolver doesn't expose, so the system's
+		// nameservers are queried with the pure Go resolver instead
+		systemResolver = &net.Resolver{PreferGo: true, Dial: dialNameserver}
+	}
+	resolver = netResolver{r: systemResolver, rtype: recordType}
+}
+
+// hostSpec is a hostname to monitor along with the resolver used to look it up
+type hostSpec struct {
+	Name   string
+	Server string
+	// nil for hosts without a "via" server, which use the package-level resolver
+	Resolver Resolver
+	// indexes of the record fields compared when looking for changes; nil compares whole records
+	Fields []int
+	// how long after -startup-delay the host's first lookup happens
+	StartOffset time.Duration
+	// the shortest TTL its records are taken to have; 0 uses -min-ttl
+	MinTTL time.Duration
+	// what to do when it resolves to no addresses; empty uses -on-empty
+	OnEmpty string
+	// the queue of the reactor that renders the host; nil for the package-level one
+	Changes chan changeEvent
+}
+
+// Looks up the host's -type records, waiting for a free -concurrency worker if that's set
+func (h hostSpec) lookup() lookupResult {
+	if lookupJobs == nil {
+		return h.resolve()
+	}
+	result := make(chan lookupResult, 1)
+	lookupJobs <- lookupJob{host: h, result: result}
+	return <-result
+}
+
+// Looks up the host's -type records with its "via" resolver if it has one, otherwise with the
+// -quorum-resolvers pool or the default resolver. The result includes the lowest TTL of the
+// answers the lookup got.
+func (h hostSpec) resolve() lookupResult {
+	ctx, ttl := withTTLRecorder(context.Background())
+	var r lookupResult
+	switch {
+	case h.Resolver != nil:
+		qctx, cancel := queryContext(ctx)
+		defer cancel()
+		r.addresses, r.err = h.Resolver.Lookup(qctx, h.Name)
+	case len(quorumPool) > 0:
+		r.addresses, r.err = lookupQuorum(ctx, h.Name)
+	default:
+		r.addresses, r.err = lookup(ctx, h.Name)
+	}
+	if stripZone && r.err == nil {
+		r.addresses = stripZones(r.addresses)
+	}
+	if r.err == nil {
+		r.ttl, r.ttlKnown = ttl.TTL()
+		if floor := h.minTTL(); r.ttlKnown && r.ttl < floor {
+			r.ttl = floor
+		}
+	}
+	return r
+}
+
+// The floor of the host's TTLs: its own min-ttl, or -min-ttl
+func (h hostSpec) minTTL() time.Duration {
+	if h.MinTTL > 0 {
+		return h.MinTTL
+	}
+	return minTTL
+}
+
+// Returns a resolver that sends every query to server instead of the system's nameservers
+func newResolver(server string) *net.Resolver {
+	server = nameserverAddr(server)
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialNameserver(ctx, network, server)
+		},
+	}
+}
+
+// Adds the default DNS port to server if it doesn't have one
+func nameserverAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, "53")
+	}
+	return server
+}
+
+// the words that may follow a hostname argument, each with an argument of its own
+var hostKeywords = map[string]bool{"via": true, "watch": true, "min-ttl": true, "on-empty": true}
+
+// Parses hostname arguments. A hostname may be followed by "via <server>" to resolve it
+// using that nameserver, either as separate arguments or quoted as a single one, e.g.
+//
+//	dns-gen api.example.com internal.example.com via 10.0.0.2
+//
+// "watch <fields>" sets the host's -watch-fields, "min-ttl <duration>" its -min-ttl and
+// "on-empty <mode>" its -on-empty.
+// Resolvers are built once here and shared by every lookup of that host.
+func parseHosts(args []string) ([]hostSpec, error) {
+	var tokens []string
+	for _, arg := range args {
+		tokens = append(tokens, strings.Fields(arg)...)
+	}
+
+	defaultFields, err := parseWatchFields(watchFields)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []hostSpec
+	for i := 0; i < len(tokens); i++ {
+		if hostKeywords[tokens[i]] {
+			return nil, fmt.Errorf("\"%s\" must follow a hostname", tokens[i])
+		}
+		h := hostSpec{Name: tokens[i], Fields: defaultFields}
+		for i+1 < len(tokens) && hostKeywords[tokens[i+1]] {
+			keyword := tokens[i+1]
+			if i+2 >= len(tokens) {
+				return nil, fmt.Errorf("missing argument after \"%s %s\"", h.Name, keyword)
+			}
+			switch keyword {
+			case "via":
+				h.Server = tokens[i+2]
+				h.Resolver = netResolver{r: newResolver(h.Server), rtype: recordType}
+			case "watch":
+				if h.Fields, err = parseWatchFields(tokens[i+2]); err != nil {
+					return nil, fmt.Errorf("%s: %v", h.Name, err)
+				}
+			case "min-ttl":
+				if h.MinTTL, err = time.ParseDuration(tokens[i+2]); err != nil || h.MinTTL <= 0 {
+					return nil, fmt.Errorf("%s: invalid min-ttl %q", h.Name, tokens[i+2])
+				}
+			case "on-empty":
+				h.OnEmpty = tokens[i+2]
+				if err := validateOnEmptyMode(h.OnEmpty); err != nil {
+					return nil, fmt.Errorf("%s: %v", h.Name, err)
+				}
+			}
+			i += 2
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+type fakeResult struct {
+	addresses []string
+	err       error
+	// if set, reported as the TTL of the answer
+	ttl uint32
+}
+
+// fakeResolver answers each lookup with the next of its results, sorted like a real
+// Resolver's, repeating the last one once they run out
+type fakeResolver struct {
+	mu      sync.Mutex
+	results []fakeResult
+	calls   int
+}
+
+func (f *fakeResolver) Lookup(ctx context.Context, hostname string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := f.results[len(f.results)-1]
+	if f.calls < len(f.results) {
+		r = f.results[f.calls]
+	}
+	f.calls++
+	if r.ttl > 0 {
+		recordTTL(ctx, r.ttl)
+	}
+	addresses := append([]string(nil), r.addresses...)
+	sortAddresses(addresses)
+	return addresses, r.err
+}
+
+func (f *fakeResolver) lookups() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// Discards any changes left over from an earlier test
+func drainChanges() {
+	for {
+		select {
+		case <-changes:
+		default:
+			return
+		}
+	}
+}
+
+// Returns the next change sent to the reactor, or false if none arrives within timeout
+func nextChange(timeout time.Duration) (changeEvent, bool) {
+	select {
+	case ev := <-changes:
+		return ev, true
+	case <-time.After(timeout):
+		return changeEvent{}, false
+	}
+}
+
+// Runs a monitor for each host, polling every interval. Returns a func that stops them all and
+// waits for them to return.
+func startMonitors(interval time.Duration, hosts ...hostSpec) func() {
+	origDelay := startupDelay
+	startupDelay = 0
+	drainChanges()
+	registerHosts(hosts)
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, host := range hosts {
+		wg.Add(1)
+		go monitor(ctx, host, interval)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+		startupDelay = origDelay
+		drainChanges()
+	}
+}
+
+func TestMonitorReportsEachChange(t *testing.T) {
+	defer resetStore()
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10.0.0.1"}},
+		{addresses: []string{"10.0.0.1"}},
+		{addresses: []string{"10.0.0.2", "10.0.0.1"}},
+		{addresses: []string{"10.0.0.1", "10.0.0.2"}},
+		{addresses: []string{"10.0.0.2"}},
+	}}
+	stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+
+	want := []changeEvent{
+		{Host: "a.example.com", Old: nil, New: []string{"10.0.0.1"}},
+		{Host: "a.example.com", Old: []string{"10.0.0.1"}, New: []string{"10.0.0.1", "10.0.0.2"}},
+		{Host: "a.example.com", Old: []string{"10.0.0.1", "10.0.0.2"}, New: []string{"10.0.0.2"}},
+	}
+	for i, w := range want {
+		ev, ok := nextChange(time.Second)
+		if !ok {
+			t.Fatalf("change %d was never reported", i+1)
+		}
+		if ev.Host != w.Host || !reflect.DeepEqual(ev.Old, w.Old) || !reflect.DeepEqual(ev.New, w.New) {
+			t.Fatalf("change %d = %s %v -> %v, want %s %v -> %v", i+1, ev.Host, ev.Old, ev.New, w.Host, w.Old, w.New)
+		}
+	}
+	// the last result repeats, which is not a change
+	if ev, ok := nextChange(50 * time.Millisecond); ok {
+		t.Errorf("unexpected change %v -> %v", ev.Old, ev.New)
+	}
+	if got := snapshot().Hosts[0].Addresses; !reflect.DeepEqual(got, []string{"10.0.0.2"}) {
+		t.Errorf("store has %v, want [10.0.0.2]", got)
+	}
+}
+
+func TestMonitorUsesEachHostsResolver(t *testing.T) {
+	defer resetStore()
+	internal, stopInternal := startNameserver(t, "10.0.0.2", 60)
+	defer stopInternal()
+	public, stopPublic := startNameserver(t, "10.0.0.1", 60)
+	defer stopPublic()
+	defer func(orig Resolver) { resolver = orig }(resolver)
+	resolver = netResolver{r: newResolver(public), rtype: typeHost}
+
+	hosts, err := parseHosts([]string{"a.example.com", "internal.example.com via " + internal, "b.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hosts[0].Resolver != nil || hosts[1].Resolver == nil || hosts[2].Resolver != nil {
+		t.Fatalf("only the host with a \"via\" server should have its own resolver: %+v", hosts)
+	}
+	stop := startMonitors(time.Hour, hosts...)
+	defer stop()
+
+	got := make(map[string][]string)
+	for range hosts {
+		ev, ok := nextChange(time.Second)
+		if !ok {
+			t.Fatalf("only %d of %d hosts were looked up", len(got), len(hosts))
+		}
+		got[ev.Host] = ev.New
+	}
+	want := map[string][]string{
+		"a.example.com":        {"10.0.0.1"},
+		"internal.example.com": {"10.0.0.2"},
+		"b.example.com":        {"10.0.0.1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	// keywords may be separate arguments or quoted along with the hostname
+	hosts, err := parseHosts([]string{"a.example.com", "b.example.com via 10.0.0.2", "c.example.com", "via", "10.0.0.3:5353", "d.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range hosts {
+		got = append(got, h.Name+"@"+h.Server)
+	}
+	if want := []string{"a.example.com@", "b.example.com@10.0.0.2", "c.example.com@10.0.0.3:5353", "d.example.com@"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if hosts[0].Resolver != nil || hosts[2].Resolver == nil {
+		t.Error("only hosts with a \"via\" server should have their own resolver")
+	}
+
+	for _, args := range [][]string{
+		{"via 10.0.0.2"},
+		{"a.example.com via"},
+		{"a.example.com", "via"},
+		{"a.example.com via 10.0.0.2 via"},
+		{"a.example.com watch"},
+	} {
+		if _, err := parseHosts(args); err == nil {
+			t.Errorf("%q was accepted", args)
+		}
+	}
+}
+
+func TestMonitorEntersAndLeavesFallback(t *testing.T) {
+	defer resetStore()
+	fallbacks["a.example.com"] = []string{"192.0.2.1"}
+	defer delete(fallbacks, "a.example.com")
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10.0.0.1"}},
+		// a temporary failure switches to the fallback as well as a permanent one
+		{err: &net.DNSError{Err: "timeout", Name: "a.example.com", IsTemporary: true}},
+		{err: &net.DNSError{Err: "timeout", Name: "a.example.com", IsTemporary: true}},
+		{addresses: []string{"10.0.0.1"}},
+	}}
+	stop := startMonitors(20*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+
+	want := []struct {
+		old, new []string
+		fallback bool
+	}{
+		{nil, []string{"10.0.0.1"}, false},
+		{[]string{"10.0.0.1"}, []string{"192.0.2.1"}, true},
+		{[]string{"192.0.2.1"}, []string{"10.0.0.1"}, false},
+	}
+	for i, w := range want {
+		ev, ok := nextChange(time.Second)
+		if !ok {
+			t.Fatalf("change %d was never reported", i+1)
+		}
+		if !reflect.DeepEqual(ev.Old, w.old) || !reflect.DeepEqual(ev.New, w.new) {
+			t.Fatalf("change %d = %v -> %v, want %v -> %v", i+1, ev.Old, ev.New, w.old, w.new)
+		}
+		if got := snapshot().Hosts[0].UsingFallback; got != w.fallback {
+			t.Errorf("after change %d, UsingFallback = %v, want %v", i+1, got, w.fallback)
+		}
+	}
+	if ev, ok := nextChange(50 * time.Millisecond); ok {
+		t.Errorf("unexpected change %v -> %v", ev.Old, ev.New)
+	}
+}
+
+func TestMonitorReportsFallbackWithTheSameAddresses(t *testing.T) {
+	defer resetStore()
+	fallbacks["a.example.com"] = []string{"10.0.0.1"}
+	defer delete(fallbacks, "a.example.com")
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10.0.0.1"}},
+		{err: errors.New("NXDOMAIN")},
+	}}
+	stop := startMonitors(20*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+
+	nextChange(time.Second)
+	if _, ok := nextChange(time.Second); !ok {
+		t.Fatal("switching to a fallback with the same addresses wasn't reported")
+	}
+	if !snapshot().Hosts[0].UsingFallback {
+		t.Error("UsingFallback is false while the fallback is in use")
+	}
+	if ev, ok := nextChange(50 * time.Millisecond); ok {
+		t.Errorf("staying on the fallback was reported as a change: %v -> %v", ev.Old, ev.New)
+	}
+}
+
+func TestMonitorKeepsAddressesWhenLookupFails(t *testing.T) {
+	defer resetStore()
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10.0.0.1", "10.0.0.2"}},
+		{err: errors.New("SERVFAIL")},
+	}}
+	stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+
+	if _, ok := nextChange(time.Second); !ok {
+		t.Fatal("the first lookup was never reported")
+	}
+	if ev, ok := nextChange(100 * time.Millisecond); ok {
+		t.Fatalf("a failed lookup was reported as a change %v -> %v", ev.Old, ev.New)
+	}
+	if n := r.lookups(); n < 3 {
+		t.Fatalf("only %d lookups happened", n)
+	}
+	if got := snapshot().Hosts[0].Addresses; !reflect.DeepEqual(got, []string{"10.0.0.1", "10.0.0.2"}) {
+		t.Errorf("store has %v after failed lookups, want the last known addresses", got)
+	}
+}
+
+// a Resolver that panics on its first lookup
+type panickingResolver struct {
+	fakeResolver
+	panicked bool
+}
+
+func (p *panickingResolver) Lookup(ctx context.Context, hostname string) ([]string, error) {
+	p.mu.Lock()
+	if !p.panicked {
+		p.panicked = true
+		p.mu.Unlock()
+		panic("resolver bug")
+	}
+	p.mu.Unlock()
+	return p.fakeResolver.Lookup(ctx, hostname)
+}
+
+func TestMonitorLogsLookupErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&net.DNSError{Err: "i/o timeout", Name: "a.example.com", IsTimeout: true, IsTemporary: true},
+			"[ERROR] temporary error resolving a.example.com: lookup a.example.com: i/o timeout. will retry..."},
+		{&net.DNSError{Err: "no such host", Name: "a.example.com", IsNotFound: true},
+			"[ERROR] error resolving a.example.com: lookup a.example.com: no such host"},
+		{errors.New("connection refused"),
+			"[ERROR] error resolving a.example.com: connection refused"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		r := &fakeResolver{results: []fakeResult{{err: tt.err}}}
+		stop := startMonitors(time.Hour, hostSpec{Name: "a.example.com", Resolver: r})
+		eventually(func() bool { return r.lookups() > 0 })
+		stop()
+		log.SetOutput(os.Stderr)
+		resetStore()
+
+		got := buf.String()
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%v was logged as %q, want %q", tt.err, got, tt.want)
+		}
+		if strings.Contains(got, "%!") {
+			t.Errorf("%v was logged with a bad format: %q", tt.err, got)
+		}
+	}
+}
+
+func TestMonitorRestartsAfterPanic(t *testing.T) {
+	defer resetStore()
+	r := &panickingResolver{fakeResolver: fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.1"}}}}}
+	stop := startMonitors(5*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+
+	ev, ok := nextChange(3 * time.Second)
+	if !ok {
+		t.Fatal("the monitor did not resume after panicking")
+	}
+	if !reflect.DeepEqual(ev.New, []string{"10.0.0.1"}) {
+		t.Errorf("got %v, want [10.0.0.1]", ev.New)
+	}
+	for _, hs := range currentStatus().Hosts {
+		if hs.Monitor == nil || !hs.Monitor.Running || hs.Monitor.Restarts != 1 {
+			t.Errorf("/status reports the monitor as %+v, want running after 1 restart", hs.Monitor)
+		}
+	}
+}
+
+// Starts a nameserver on a local UDP port that answers A queries with addrs like a round-robin
+// DNS server, rotating their order on every answer
+func startRoundRobinNameserver(t *testing.T, addrs ...string) (string, func()) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	next := 0
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeA {
+			mu.Lock()
+			for i := range addrs {
+				rr, _ := dns.NewRR(q.Name + " 60 IN A " + addrs[(next+i)%len(addrs)])
+				m.Answer = append(m.Answer, rr)
+			}
+			next++
+			mu.Unlock()
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestRenderOrderIsDeterministic(t *testing.T) {
+	_, restore := setupOutput(t, `{{ range .Hosts }}{{ .Name }}{{ range .Addresses }} {{ . }}{{ end }}
+{{ end }}`)
+	defer restore()
+	server, stop := startRoundRobinNameserver(t, "10.0.0.10", "10.0.0.2", "10.0.0.1")
+	defer stop()
+	r := netResolver{r: newResolver(server), rtype: typeHost}
+	names := []string{"c.example.com", "a.example.com", "b.example.com"}
+
+	const want = "a.example.com 10.0.0.1 10.0.0.2 10.0.0.10\n" +
+		"b.example.com 10.0.0.1 10.0.0.2 10.0.0.10\n" +
+		"c.example.com 10.0.0.1 10.0.0.2 10.0.0.10\n"
+	for i := 0; i < 3; i++ {
+		// the monitors update the store in whatever order their lookups finish, and each lookup
+		// gets the addresses in a different order
+		resetStore()
+		for j := range names {
+			name := names[(i+j)%len(names)]
+			res := hostSpec{Name: name, Resolver: r}.lookup()
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			updateHost(Host{Name: name, Addresses: res.addresses})
+		}
+		content, err := commandLineOutput().render(snapshot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Fatalf("render %d:\n%s\nwant:\n%s", i+1, content, want)
+		}
+		// so the output doesn't change either
+		changed, err := writeFile(dest, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != (i == 0) {
+			t.Errorf("render %d: writeFile reported changed=%v", i+1, changed)
+		}
+	}
+}
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	mu sync.Mutex
+	n  int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.n++
+		l.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (l *countingListener) accepted() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+// Starts a DNS-over-TLS server on a local port with a certificate for dns.test, answering A
+// queries with 10.0.0.10 and 10.0.0.2 in that order. Returns its address and a pool with the
+// certificate to trust.
+func startDoTServer(t *testing.T) (string, *x509.CertPool, *countingListener, func()) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingListener{Listener: l}
+	cfg := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv := &dns.Server{Listener: tls.NewListener(counter, cfg), Net: "tcp-tls", Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeA {
+			for _, addr := range []string{"10.0.0.10", "10.0.0.2"} {
+				rr, _ := dns.NewRR(q.Name + " 60 IN A " + addr)
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return l.Addr().String(), pool, counter, func() { srv.Shutdown() }
+}
+
+// Restores the resolver globals setupDoT replaces
+func restoreResolvers() func() {
+	origSystem, origExchange, origCAs, origBackoff := systemResolver, dialExchange, dotRootCAs, dotBackoff
+	return func() {
+		systemResolver, dialExchange, dotRootCAs, dotBackoff = origSystem, origExchange, origCAs, origBackoff
+	}
+}
+
+func TestDoT(t *testing.T) {
+	defer restoreResolvers()()
+	server, pool, _, stop := startDoTServer(t)
+	defer stop()
+	dotRootCAs = pool
+
+	setupDoT(server, "dns.test")
+	addresses, err := lookupAddrs("a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.2", "10.0.0.10"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("got %q, want %q sorted", addresses, want)
+	}
+}
+
+func TestDoTBacksOffAfterAFailedHandshake(t *testing.T) {
+	defer restoreResolvers()()
+	server, pool, conns, stop := startDoTServer(t)
+	defer stop()
+	dotRootCAs, dotBackoff = pool, 100*time.Millisecond
+
+	// the certificate isn't valid for this name, so every handshake fails
+	setupDoT(server, "other.test")
+	_, err := lookupAddrs("a.example.com")
+	if err == nil || !isTemporary(err) {
+		t.Fatalf("error = %v, want a temporary error", err)
+	}
+	if !eventually(func() bool { return conns.accepted() > 0 }) {
+		t.Fatal("the server wasn't tried")
+	}
+	failed := conns.accepted()
+
+	// lookups during the backoff don't try the server
+	if _, err := lookupAddrs("a.example.com"); err == nil || !isTemporary(err) {
+		t.Errorf("error = %v, want a temporary error", err)
+	}
+	if n := conns.accepted(); n != failed {
+		t.Errorf("connected %d more times during the backoff", n-failed)
+	}
+
+	// once it has passed, the server is tried again
+	time.Sleep(dotBackoff)
+	lookupAddrs("a.example.com")
+	if !eventually(func() bool { return conns.accepted() > failed }) {
+		t.Error("the server wasn't tried again after the backoff")
+	}
+}
+
+// fakeSOCKS5 is a SOCKS5 proxy without authentication that records the addresses it's asked
+// to connect to
+type fakeSOCKS5 struct {
+	l       net.Listener
+	mu      sync.Mutex
+	targets []string
+}
+
+func startFakeSOCKS5(t *testing.T) *fakeSOCKS5 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeSOCKS5{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	// greeting: version, number of methods, methods; no authentication is chosen
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+
+	// request: version, CONNECT, reserved, address type, address, port
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || buf[1] != 1 {
+		return
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(conn, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(conn, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(conn, buf[:n])
+		host = string(buf[:n])
+	case 4:
+		io.ReadFull(conn, buf[:16])
+		host = net.IP(buf[:16]).String()
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *fakeSOCKS5) connectedTo() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+func TestProxy(t *testing.T) {
+	defer restoreResolvers()()
+	defer func(origProxy proxy.ContextDialer, origDial func(string, string, time.Duration) (net.Conn, error)) {
+		proxyDialer, dial = origProxy, origDial
+	}(proxyDialer, dial)
+
+	// SOCKS5 only carries TCP, so the nameserver is only listening on TCP
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " 60 IN A 10.0.0.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	defer srv.Shutdown()
+	server := l.Addr().String()
+
+	p := startFakeSOCKS5(t)
+	defer p.l.Close()
+	if err := setupProxy("socks5://" + p.l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := (netResolver{r: newResolver(server), rtype: typeHost}).Lookup(context.Background(), "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("got %q, want %q", addresses, want)
+	}
+	if targets := p.connectedTo(); len(targets) == 0 || targets[0] != server {
+		t.Errorf("the proxy connected to %q, want the nameserver %s", targets, server)
+	}
+
+	// health check dials go through it too
+	conn, err := dial("tcp", server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if targets := p.connectedTo(); targets[len(targets)-1] != server {
+		t.Errorf("the health check dial wasn't made through the proxy: %q", targets)
+	}
+}
+
+func TestSetupProxyRejectsOtherSchemes(t *testing.T) {
+	defer restoreResolvers()()
+	defer func(orig proxy.ContextDialer) { proxyDialer = orig }(proxyDialer)
+	for _, u := range []string{"http://127.0.0.1:8080", "127.0.0.1:1080", "socks4://127.0.0.1:1080"} {
+		if err := setupProxy(u); err == nil {
+			t.Errorf("%s was accepted", u)
+		}
+	}
+}
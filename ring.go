@@ -0,0 +1,59 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// number of virtual nodes placed on the ring for each address
+const ringReplicas = 160
+
+// Ring is a consistent hash ring of addresses
+type Ring struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Builds a hash ring from a set of addresses. The ring only depends on the
+// contents of addrs, not their order.
+func ringFor(addrs []string) *Ring {
+	r := &Ring{owners: make(map[uint32]string, len(addrs)*ringReplicas)}
+	for _, addr := range addrs {
+		for i := 0; i < ringReplicas; i++ {
+			p := ringHash(strconv.Itoa(i) + "-" + addr)
+			// on collision, keep the lexically smaller address so the result is deterministic
+			if owner, ok := r.owners[p]; ok && owner <= addr {
+				continue
+			} else if !ok {
+				r.points = append(r.points, p)
+			}
+			r.owners[p] = addr
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Get returns the address responsible for key, or an empty string if the ring is empty
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func ringGet(key string, addrs []string) string {
+	return ringFor(addrs).Get(key)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// the keys placed on the rings under test
+func ringKeys() []string {
+	var keys []string
+	for i := 0; i < 10000; i++ {
+		keys = append(keys, fmt.Sprintf("session-%d", i))
+	}
+	return keys
+}
+
+func TestRingDistribution(t *testing.T) {
+	addrs := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}
+	r := ringFor(addrs)
+	counts := make(map[string]int)
+	for _, key := range ringKeys() {
+		counts[r.Get(key)]++
+	}
+	// with enough virtual nodes, every address serves close to a quarter of the keys
+	for _, addr := range addrs {
+		if n := counts[addr]; n < 1800 || n > 3200 {
+			t.Errorf("%s serves %d of 10000 keys, want about 2500", addr, n)
+		}
+	}
+}
+
+func TestRingIgnoresOrder(t *testing.T) {
+	a := ringFor([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	b := ringFor([]string{"10.0.0.3", "10.0.0.1", "10.0.0.2"})
+	for _, key := range ringKeys() {
+		if a.Get(key) != b.Get(key) {
+			t.Fatalf("%s maps to %s or %s depending on the order of the addresses", key, a.Get(key), b.Get(key))
+		}
+	}
+}
+
+func TestRingStability(t *testing.T) {
+	before := ringFor([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"})
+
+	// adding an address only moves keys to it
+	added := ringFor([]string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"})
+	moved := 0
+	for _, key := range ringKeys() {
+		if was, is := before.Get(key), added.Get(key); was != is {
+			if is != "10.0.0.5" {
+				t.Fatalf("%s moved from %s to %s, not to the new address", key, was, is)
+			}
+			moved++
+		}
+	}
+	if moved < 1200 || moved > 2800 {
+		t.Errorf("adding a fifth address moved %d of 10000 keys, want about 2000", moved)
+	}
+
+	// removing an address only moves the keys it served
+	removed := ringFor([]string{"10.0.0.1", "10.0.0.2", "10.0.0.4"})
+	for _, key := range ringKeys() {
+		if was, is := before.Get(key), removed.Get(key); was != is && was != "10.0.0.3" {
+			t.Fatalf("%s moved from %s to %s, though %s is still there", key, was, is, was)
+		}
+	}
+}
+
+func TestRingGet(t *testing.T) {
+	if got := ringGet("key", nil); got != "" {
+		t.Errorf("empty ring returned %q", got)
+	}
+	if got := ringGet("key", []string{"10.0.0.1"}); got != "10.0.0.1" {
+		t.Errorf("single address ring returned %q", got)
+	}
+	addrs := []string{"10.0.0.1", "10.0.0.2"}
+	got := renderString(t, `{{ (ringFor .).Get "key" }} {{ ringGet "key" . }}`, addrs)
+	want := ringGet("key", addrs) + " " + ringGet("key", addrs)
+	if got != want {
+		t.Errorf("templates rendered %q, want %q", got, want)
+	}
+}
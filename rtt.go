@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how long sortByRTT waits for each connection before treating an address as unreachable
+const rttTimeout = time.Second
+
+// used by sortByRTT to open connections
+var dial = net.DialTimeout
+
+// Measures how long it takes to open a TCP connection to addr:port. ok is false if the
+// connection could not be established.
+func measureRTT(addr string, port int) (rtt time.Duration, ok bool) {
+	start := time.Now()
+	conn, err := dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), rttTimeout)
+	if err != nil {
+		return 0, false
+	}
+	rtt = time.Since(start)
+	conn.Close()
+	return rtt, true
+}
+
+// Returns addrs ordered by TCP connect time on port, fastest first. Addresses that can't be
+// reached are moved to the end, in their original order.
+func sortByRTT(port int, addrs []string) []string {
+	type probe struct {
+		addr string
+		rtt  time.Duration
+		ok   bool
+	}
+	probes := make([]probe, len(addrs))
+
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			rtt, ok := measureRTT(addr, port)
+			probes[i] = probe{addr: addr, rtt: rtt, ok: ok}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if probes[i].ok != probes[j].ok {
+			return probes[i].ok
+		}
+		return probes[i].rtt < probes[j].rtt
+	})
+	sorted := make([]string, len(probes))
+	for i, p := range probes {
+		sorted[i] = p.addr
+	}
+	return sorted
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replaces dial with one that takes latencies[host] to connect, or fails for hosts that
+// aren't listed. Returns a func that restores it.
+func stubDial(latencies map[string]time.Duration) func() {
+	orig := dial
+	dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		latency, ok := latencies[host]
+		if !ok || latency > timeout {
+			return nil, errors.New("connection refused")
+		}
+		time.Sleep(latency)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	return func() { dial = orig }
+}
+
+func TestSortByRTT(t *testing.T) {
+	defer stubDial(map[string]time.Duration{
+		"10.0.0.1": 60 * time.Millisecond,
+		"10.0.0.2": 5 * time.Millisecond,
+		"10.0.0.3": 30 * time.Millisecond,
+	})()
+	addrs := []string{"10.0.0.4", "10.0.0.1", "10.0.0.5", "10.0.0.2", "10.0.0.3"}
+	got := sortByRTT(443, addrs)
+	want := []string{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.4", "10.0.0.5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortByRTT = %v, want %v", got, want)
+	}
+	if addrs[0] != "10.0.0.4" {
+		t.Errorf("sortByRTT modified its argument: %v", addrs)
+	}
+}
+
+func TestSortByRTTProbesConcurrently(t *testing.T) {
+	latencies := make(map[string]time.Duration)
+	var addrs []string
+	for _, a := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		latencies[a] = 50 * time.Millisecond
+		addrs = append(addrs, a)
+	}
+	defer stubDial(latencies)()
+	start := time.Now()
+	sortByRTT(80, addrs)
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("probing 4 addresses took %v, expected them to run concurrently", elapsed)
+	}
+}
+
+func TestSortByRTTTemplate(t *testing.T) {
+	defer stubDial(map[string]time.Duration{"10.0.0.1": 20 * time.Millisecond, "10.0.0.2": time.Millisecond})()
+	got := renderString(t, `{{ range sortByRTT 80 . }}{{ . }} {{ end }}`, []string{"10.0.0.1", "10.0.0.2"})
+	if want := "10.0.0.2 10.0.0.1"; strings.TrimSpace(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// A template can split its output into sections, each tied to some of the hosts:
+//
+//	{{ section "web" "web1.example.com" "web2.example.com" }}
+//
+// renders the template defined as "web" with only those hosts in .Hosts, between a begin and an
+// end marker line. When a reaction finds that the only hosts whose data changed since the
+// output was last written belong to sections, just those sections are rendered again and
+// spliced into what is in dest, leaving the rest of the file as it is. Anything else renders
+// the whole template: hosts coming or going, a change to the template or to the rest of the
+// render context, a changed host outside every section, or a dest without the markers. The rest
+// of the template must therefore only depend on which hosts there are, not on their data.
+
+func sectionBegin(name string) string {
+	return sectionComment + " BEGIN dns-gen section " + name + "\n"
+}
+
+func sectionEnd(name string) string {
+	return sectionComment + " END dns-gen section " + name + "\n"
+}
+
+// section as registered in Funcs, for templates that aren't executed by parseTemplateFile
+func noSection(name string, hosts ...string) (string, error) {
+	return "", fmt.Errorf("section %s: sections can only be used in -tmpl templates", name)
+}
+
+// sectionState is what an output's last written render was made from, to tell which of its
+// sections a later reaction has to render again
+type sectionState struct {
+	tmpl []byte
+	// the render context without its hosts
+	rest []byte
+	// each host's data, by name
+	hosts map[string][]byte
+	// the hosts of each section, by name
+	sections map[string][]string
+}
+
+func newSectionState(tmpl []byte, ctx RenderContext) (*sectionState, error) {
+	s := &sectionState{tmpl: tmpl, hosts: make(map[string][]byte, len(ctx.Hosts))}
+	for _, h := range ctx.Hosts {
+		data, err := json.Marshal(h)
+		if err != nil {
+			return nil, err
+		}
+		s.hosts[h.Name] = data
+	}
+	rest := ctx
+	rest.Hosts = nil
+	var err error
+	s.rest, err = json.Marshal(rest)
+	return s, err
+}
+
+// Returns the sections that have to be rendered again to go from s to next, or false if the
+// whole template has to be
+func (s *sectionState) changedSections(next *sectionState) ([]string, bool) {
+	if !bytes.Equal(s.tmpl, next.tmpl) || !bytes.Equal(s.rest, next.rest) || len(s.hosts) != len(next.hosts) {
+		return nil, false
+	}
+	bySection := make(map[string]bool)
+	for name, data := range next.hosts {
+		old, ok := s.hosts[name]
+		if !ok {
+			return nil, false
+		}
+		if bytes.Equal(old, data) {
+			continue
+		}
+		found := false
+		for section, hosts := range s.sections {
+			for _, h := range hosts {
+				if h == name {
+					bySection[section], found = true, true
+				}
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	if len(bySection) == 0 {
+		// nothing changed, so render it all as a check that dest still matches
+		return nil, false
+	}
+	sections := make([]string, 0, len(bySection))
+	for section := range bySection {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	return sections, true
+}
+
+// Replaces section name in content, markers included, with block. Returns false if content
+// doesn't hold the section's markers once each, with the end after the begin.
+func spliceSection(content []byte, name string, block []byte) ([]byte, bool) {
+	begin, end := []byte(sectionBegin(name)), []byte(sectionEnd(name))
+	start := markerLine(content, begin)
+	if start < 0 {
+		return nil, false
+	}
+	stop := markerLine(content[start:], end)
+	if stop < 0 {
+		return nil, false
+	}
+	stop += start + len(end)
+	spliced := append(append(append([]byte(nil), content[:start]...), block...), content[stop:]...)
+	return spliced, true
+}
+
+// Returns where the only line of content that is marker starts, or -1
+func markerLine(content, marker []byte) int {
+	at := -1
+	for i := 0; i+len(marker) <= len(content); {
+		n := bytes.Index(content[i:], marker)
+		if n < 0 {
+			break
+		}
+		if i+n == 0 || content[i+n-1] == '\n' {
+			if at >= 0 {
+				return -1
+			}
+			at = i + n
+		}
+		i += n + 1
+	}
+	return at
+}
+
+// sectionRecorder collects the sections declared by a render of a template
+type sectionRecorder struct {
+	sections map[string][]string
+}
+
+// Returns the section function for a render of tmpl with ctx, which records each section in rec
+// if it isn't nil
+func sectionFunc(tmpl *template.Template, ctx RenderContext, rec *sectionRecorder) func(string, ...string) (template.HTML, error) {
+	seen := make(map[string]bool)
+	rendering := false
+	return func(name string, hosts ...string) (template.HTML, error) {
+		if name == "" || strings.ContainsAny(name, "\r\n") {
+			return "", fmt.Errorf("invalid section name %q", name)
+		}
+		if rendering {
+			return "", fmt.Errorf("section %s: sections can't be nested", name)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("section %s is declared more than once", name)
+		}
+		seen[name] = true
+		if rec != nil {
+			rec.sections[name] = hosts
+		}
+		rendering = true
+		defer func() { rendering = false }()
+		block, err := ctx.renderSection(tmpl, name, hosts)
+		// already escaped by its own render
+		return template.HTML(block), err
+	}
+}
+
+// Renders section name of tmpl with just the given hosts of ctx, between its markers
+func (ctx RenderContext) renderSection(tmpl *template.Template, name string, hosts []string) ([]byte, error) {
+	t := tmpl.Lookup(name)
+	if t == nil {
+		return nil, fmt.Errorf("section %s: no template named %q", name, name)
+	}
+	want := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		want[h] = true
+	}
+	sectionCtx := ctx
+	sectionCtx.Hosts = nil
+	for _, h := range ctx.Hosts {
+		if want[h.Name] {
+			sectionCtx.Hosts = append(sectionCtx.Hosts, h)
+		}
+	}
+	body, err := execTemplate(t, sectionCtx)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > 0 && body[len(body)-1] != '\n' {
+		body = append(body, '\n')
+	}
+	block := append([]byte(sectionBegin(name)), body...)
+	return append(block, sectionEnd(name)...), nil
+}
+
+// Renders o from ctx. When o is a template written to a file and the only hosts that changed
+// since the output was last written belong to sections, only those sections are rendered and
+// spliced into dest. Returns the content along with what it was rendered from, which should be
+// passed to setSections once the content is written.
+func (g *group) renderOutput(o output, ctx RenderContext) ([]byte, *sectionState, error) {
+	if o.tmpl == "" || o.dest == "" || gzipOutput || wantEmptyTemplate(ctx.Hosts) {
+		content, err := o.render(ctx)
+		return content, nil, err
+	}
+	tmplText, err := ioutil.ReadFile(o.tmpl)
+	if err != nil {
+		return nil, nil, err
+	}
+	next, err := newSectionState(tmplText, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if prev := g.sections[o.dest]; prev != nil {
+		if sections, ok := prev.changedSections(next); ok {
+			if content, ok, err := ctx.spliceSections(o, prev, sections); err != nil || ok {
+				next.sections = prev.sections
+				return content, next, err
+			}
+		}
+	}
+	rec := &sectionRecorder{sections: make(map[string][]string)}
+	tmpl, err := ctx.parseTemplateFile(o.tmpl, rec)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := execTemplate(tmpl, ctx)
+	next.sections = rec.sections
+	return content, next, err
+}
+
+// Renders sections of o again and splices them into its dest. Returns false if dest doesn't
+// hold them.
+func (ctx RenderContext) spliceSections(o output, prev *sectionState, sections []string) ([]byte, bool, error) {
+	target, err := destTarget(o.dest)
+	if err != nil {
+		return nil, false, nil
+	}
+	content, err := ioutil.ReadFile(target)
+	if err != nil {
+		return nil, false, nil
+	}
+	tmpl, err := ctx.parseTemplateFile(o.tmpl, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, name := range sections {
+		block, err := ctx.renderSection(tmpl, name, prev.sections[name])
+		if err != nil {
+			return nil, false, err
+		}
+		var ok bool
+		if content, ok = spliceSection(content, name, block); !ok {
+			if debug {
+				logDebug("%s doesn't hold section %s, rendering all of %s", o.dest, name, o.tmpl)
+			}
+			return nil, false, nil
+		}
+	}
+	// the address sets of the sections that weren't rendered keep their order
+	ctx.seeds.keepPrevious()
+	if debug {
+		logDebug("rendered sections %s of %s", strings.Join(sections, ", "), o.tmpl)
+	}
+	return content, true, nil
+}
+
+// Keeps what o was rendered from once it's written, or forgets it when it couldn't be, so the
+// next reaction renders the whole template
+func (g *group) setSections(o output, s *sectionState) {
+	if g.sections == nil {
+		g.sections = make(map[string]*sectionState)
+	}
+	if s == nil {
+		delete(g.sections, o.dest)
+		return
+	}
+	g.sections[o.dest] = s
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const sectionsTemplate = `# {{ tally "top" }}{{ len .Hosts }} hosts
+{{ section "a" "a.example.com" -}}
+{{ section "b" "b.example.com" "c.example.com" -}}
+{{ range .Hosts }}{{ if eq .Name "d.example.com" }}{{ .Addresses }}{{ end }}{{ end }}
+{{ define "a" }}{{ tally "a" }}{{ range .Hosts }}{{ .Name }} {{ .Addresses }}{{ end }}{{ end }}
+{{- define "b" }}{{ tally "b" }}{{ range .Hosts }}{{ .Name }} {{ .Addresses }}
+{{ end }}{{ end }}`
+
+// Counts the renders of each part of sectionsTemplate. Returns the counts and a func that
+// removes tally.
+func setupTally() (map[string]int, func()) {
+	calls := make(map[string]int)
+	Funcs["tally"] = func(part string) string {
+		calls[part]++
+		return ""
+	}
+	return calls, func() { delete(Funcs, "tally") }
+}
+
+func TestSectionsRenderOnlyTheChangedSection(t *testing.T) {
+	_, restore := setupExec(t, sectionsTemplate)
+	defer restore()
+	calls, untally := setupTally()
+	defer untally()
+	defer resetStore()
+	for _, h := range []string{"a", "b", "c", "d"} {
+		updateHost(Host{Name: h + ".example.com", Addresses: []string{"10.0.0.1"}})
+	}
+	g := commandLineGroup()
+	run := func() {
+		t.Helper()
+		if result := g.react(context.Background(), nil); result.Err() != nil {
+			t.Fatal(result.Err())
+		}
+	}
+
+	run()
+	before, _ := ioutil.ReadFile(dest)
+	want := `# 4 hosts
+# BEGIN dns-gen section a
+a.example.com [10.0.0.1]
+# END dns-gen section a
+# BEGIN dns-gen section b
+b.example.com [10.0.0.1]
+c.example.com [10.0.0.1]
+# END dns-gen section b
+[10.0.0.1]
+`
+	if string(before) != want {
+		t.Fatalf("first render:\n%s\nwant:\n%s", before, want)
+	}
+
+	updateHost(Host{Name: "c.example.com", Addresses: []string{"10.0.0.3"}})
+	run()
+	after, _ := ioutil.ReadFile(dest)
+	if want := strings.Replace(want, "c.example.com [10.0.0.1]", "c.example.com [10.0.0.3]", 1); string(after) != want {
+		t.Fatalf("after changing c:\n%s\nwant:\n%s", after, want)
+	}
+	if calls["top"] != 1 || calls["a"] != 1 || calls["b"] != 2 {
+		t.Errorf("renders of each part: %v, want only section b rendered again", calls)
+	}
+	// what was spliced in is what rendering it all gives
+	full, err := commandLineOutput().render(snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, full) {
+		t.Errorf("spliced render:\n%s\nfull render:\n%s", after, full)
+	}
+}
+
+func TestSectionsFallBackToAFullRender(t *testing.T) {
+	dir, restore := setupExec(t, sectionsTemplate)
+	defer restore()
+	calls, untally := setupTally()
+	defer untally()
+	defer resetStore()
+	for _, h := range []string{"a", "b", "c", "d"} {
+		updateHost(Host{Name: h + ".example.com", Addresses: []string{"10.0.0.1"}})
+	}
+	g := commandLineGroup()
+	run := func() {
+		t.Helper()
+		if result := g.react(context.Background(), nil); result.Err() != nil {
+			t.Fatal(result.Err())
+		}
+	}
+	run()
+
+	steps := []struct {
+		name   string
+		change func()
+	}{
+		{"a host outside every section changed", func() {
+			updateHost(Host{Name: "d.example.com", Addresses: []string{"10.0.0.2"}})
+		}},
+		{"a host was added", func() {
+			updateHost(Host{Name: "e.example.com", Addresses: []string{"10.0.0.1"}})
+		}},
+		{"nothing changed", func() {}},
+		{"the template changed", func() {
+			updateHost(Host{Name: "a.example.com", Addresses: []string{"10.0.0.2"}})
+			if err := ioutil.WriteFile(tmplPath, []byte(sectionsTemplate+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"dest lost the section's markers", func() {
+			updateHost(Host{Name: "a.example.com", Addresses: []string{"10.0.0.3"}})
+			if err := ioutil.WriteFile(dest, []byte("edited\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, step := range steps {
+		top := calls["top"]
+		step.change()
+		run()
+		if calls["top"] != top+1 {
+			t.Errorf("%s: the whole template wasn't rendered", step.name)
+		}
+		got, _ := ioutil.ReadFile(dest)
+		full, err := commandLineOutput().render(snapshot())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, full) {
+			t.Errorf("%s: dest is\n%s\nwant\n%s", step.name, got, full)
+		}
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("%s holds %d files, want just the template and dest", dir, len(entries))
+	}
+}
+
+func TestSectionErrors(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"missing template", `{{ section "a" "a.example.com" }}`, `no template named "a"`},
+		{"declared twice", `{{ section "a" }}{{ section "a" }}{{ define "a" }}{{ end }}`, "declared more than once"},
+		{"nested", `{{ section "a" }}{{ define "a" }}{{ section "b" }}{{ end }}{{ define "b" }}{{ end }}`, "can't be nested"},
+	}
+	for _, tt := range tests {
+		_, restore := setupExec(t, tt.text)
+		_, err := RenderContext{}.execTemplateFile(tmplPath)
+		restore()
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSpliceSection(t *testing.T) {
+	block := []byte("# BEGIN dns-gen section a\nnew\n# END dns-gen section a\n")
+	content := "top\n# BEGIN dns-gen section a\nold\n# END dns-gen section a\n# BEGIN dns-gen section ab\nab\n# END dns-gen section ab\n"
+	got, ok := spliceSection([]byte(content), "a", block)
+	if want := strings.Replace(content, "old", "new", 1); !ok || string(got) != want {
+		t.Errorf("got %q, %v; want %q", got, ok, want)
+	}
+	for _, bad := range []string{
+		"top\n",
+		"# BEGIN dns-gen section a\nold\n",
+		"# END dns-gen section a\n# BEGIN dns-gen section a\n",
+		"# BEGIN dns-gen section a\n# END dns-gen section a\n# BEGIN dns-gen section a\n# END dns-gen section a\n",
+	} {
+		if got, ok := spliceSection([]byte(bad), "a", block); ok {
+			t.Errorf("spliced into %q: %q", bad, got)
+		}
+	}
+}
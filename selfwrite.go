@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+// Tracks the files written by writeFile, so that watchers can tell their own writes apart
+// from external changes instead of reacting to them and writing again.
+var ownWrites = struct {
+	sync.Mutex
+	m map[string][sha256.Size]byte
+}{m: make(map[string][sha256.Size]byte)}
+
+func recordWrite(path string, content []byte) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	ownWrites.Lock()
+	defer ownWrites.Unlock()
+	ownWrites.m[path] = sha256.Sum256(content)
+}
+
+// Reports whether path still holds exactly what writeFile last wrote to it
+func isOwnWrite(path string) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	ownWrites.Lock()
+	sum, ok := ownWrites.m[path]
+	ownWrites.Unlock()
+	if !ok {
+		return false
+	}
+	content, err := ioutil.ReadFile(path)
+	return err == nil && sha256.Sum256(content) == sum
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"strings"
+)
+
+// Renders hosts using the -simple format flags, without the template engine: each address is
+// written using -simple-format, separated by -sep, with -prefix and -suffix around the whole
+// list. For example,
+//
+//	-simple -simple-format 'server %addr%:80;' -sep ' ' -prefix 'upstream app { ' -suffix ' }'
+//
+// renders as "upstream app { server 10.0.0.1:80; server 10.0.0.2:80; }".
+func renderSimple(hosts []Host) []byte {
+	var items []string
+	for _, h := range hosts {
+		for _, addr := range h.Addresses {
+			items = append(items, strings.NewReplacer("%addr%", addr, "%host%", h.Name).Replace(simpleFormat))
+		}
+	}
+	return []byte(simplePrefix + strings.Join(items, simpleSep) + simpleSuffix + "\n")
+}
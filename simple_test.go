@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestRenderSimple(t *testing.T) {
+	defer func(format, sep, prefix, suffix string) {
+		simpleFormat, simpleSep, simplePrefix, simpleSuffix = format, sep, prefix, suffix
+	}(simpleFormat, simpleSep, simplePrefix, simpleSuffix)
+
+	hosts := []Host{
+		{Name: "a.example.com", Addresses: []string{"10.0.0.1", "10.0.0.2"}},
+		{Name: "b.example.com", Addresses: []string{"fd00::1"}},
+		{Name: "c.example.com"},
+	}
+	tests := []struct {
+		format, sep, prefix, suffix string
+		want                        string
+	}{
+		{"%addr%", "\n", "", "", "10.0.0.1\n10.0.0.2\nfd00::1\n"},
+		{"%addr%", ",", "", "", "10.0.0.1,10.0.0.2,fd00::1\n"},
+		{"server %addr%:80;", " ", "upstream app { ", " }", "upstream app { server 10.0.0.1:80; server 10.0.0.2:80; server fd00::1:80; }\n"},
+		{"%addr% %host% %addr%", "|", "", "", "10.0.0.1 a.example.com 10.0.0.1|10.0.0.2 a.example.com 10.0.0.2|fd00::1 b.example.com fd00::1\n"},
+		{"%address%", " ", "", "", "%address% %address% %address%\n"},
+		{"literal", ",", "[", "]", "[literal,literal,literal]\n"},
+	}
+	for _, tt := range tests {
+		simpleFormat, simpleSep, simplePrefix, simpleSuffix = tt.format, tt.sep, tt.prefix, tt.suffix
+		if got := string(renderSimple(hosts)); got != tt.want {
+			t.Errorf("format %q sep %q prefix %q suffix %q: got %q, want %q", tt.format, tt.sep, tt.prefix, tt.suffix, got, tt.want)
+		}
+	}
+
+	// no addresses still writes the prefix and suffix
+	simpleFormat, simpleSep, simplePrefix, simpleSuffix = "%addr%", ",", "upstream { ", " }"
+	if got, want := string(renderSimple(hosts[2:])), "upstream {  }\n"; got != want {
+		t.Errorf("no addresses: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SOA is the start of authority record of a zone
+type SOA struct {
+	Zone    string `json:"zone"`
+	Ns      string `json:"ns"`
+	Mbox    string `json:"mbox"`
+	Serial  uint32 `json:"serial"`
+	Refresh uint32 `json:"refresh"`
+	Retry   uint32 `json:"retry"`
+	Expire  uint32 `json:"expire"`
+	Minttl  uint32 `json:"minttl"`
+}
+
+// Queries zone's SOA record from the nameserver lookups use (-resolver, -dot, or the first
+// nameserver in resolv.conf), through -proxy if it's set
+func lookupSOA(zone string) (SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	resp, err := exchange(m)
+	if err != nil {
+		return SOA{}, err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return SOA{}, fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+	}
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return SOA{Zone: soa.Hdr.Name, Ns: soa.Ns, Mbox: soa.Mbox, Serial: soa.Serial, Refresh: soa.Refresh,
+				Retry: soa.Retry, Expire: soa.Expire, Minttl: soa.Minttl}, nil
+		}
+	}
+	return SOA{}, fmt.Errorf("no SOA record for %s", zone)
+}
+
+// lookupSOA for templates: errors produce an empty SOA rather than failing the render
+func safeLookupSOA(zone string) SOA {
+	soa, _ := lookupSOA(zone)
+	return soa
+}
+
+// Polls zone's SOA record and reacts whenever its serial changes, e.g. to regenerate output
+// after any update to the zone even if none of the monitored records changed
+func monitorSOA(ctx context.Context, zone string, interval time.Duration) {
+	defer wg.Done()
+
+	var known SOA
+	next := time.After(startupDelay)
+
+	for {
+		select {
+		case <-next:
+			next = time.After(interval)
+			soa, err := lookupSOA(zone)
+			if err != nil {
+				logError("error looking up SOA of %s: %v", zone, err)
+				continue
+			}
+			if soa.Serial == known.Serial && known.Zone != "" {
+				continue
+			}
+			logChange("zone %s SOA serial %d -> %d", zone, known.Serial, soa.Serial)
+			known = soa
+			setSOA(soa)
+			triggerReact()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func soaHandler(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " IN SOA ns1.example.com. hostmaster.example.com. 2024010101 3600 600 86400 300")
+	m.Answer = append(m.Answer, rr)
+	w.WriteMsg(m)
+}
+
+// lookupSOA must go through dialExchange, whatever the transport behind it, rather than
+// querying a nameserver directly
+func TestLookupSOAUsesConfiguredTransport(t *testing.T) {
+	origDial := dialExchange
+	defer func() { dialExchange = origDial }()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(soaHandler)}
+	go udp.ActivateAndServe()
+	defer udp.Shutdown()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp := &dns.Server{Listener: l, Handler: dns.HandlerFunc(soaHandler)}
+	go tcp.ActivateAndServe()
+	defer tcp.Shutdown()
+
+	for _, transport := range []struct{ network, addr string }{
+		{"udp", pc.LocalAddr().String()},
+		// the framing a -proxy or -dot connection uses
+		{"tcp", l.Addr().String()},
+	} {
+		dials := 0
+		dialExchange = func(ctx context.Context) (net.Conn, error) {
+			dials++
+			var d net.Dialer
+			return d.DialContext(ctx, transport.network, transport.addr)
+		}
+		soa, err := lookupSOA("example.com")
+		if err != nil {
+			t.Errorf("%s: %v", transport.network, err)
+			continue
+		}
+		if soa.Serial != 2024010101 || soa.Ns != "ns1.example.com." {
+			t.Errorf("%s: SOA = %+v", transport.network, soa)
+		}
+		if dials != 1 {
+			t.Errorf("%s: dialed the nameserver %d times, want 1", transport.network, dials)
+		}
+	}
+}
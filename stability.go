@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// values of Host.Stability
+const (
+	stable   = "stable"
+	changing = "changing"
+	flapping = "flapping"
+)
+
+// When each host changed within the last -stability-window, oldest first
+var changeTimes = struct {
+	sync.Mutex
+	hosts map[string][]time.Time
+}{hosts: make(map[string][]time.Time)}
+
+// Drops the change times that have fallen out of the window. Must be called with changeTimes
+// locked.
+func pruneChanges(hostname string, now time.Time) []time.Time {
+	times := changeTimes.hosts[hostname]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > stabilityWindow {
+		i++
+	}
+	times = times[i:]
+	changeTimes.hosts[hostname] = times
+	return times
+}
+
+// Records that hostname's addresses changed. The first resolution of a host isn't a change.
+func recordChange(hostname string) {
+	changeTimes.Lock()
+	defer changeTimes.Unlock()
+	now := time.Now()
+	changeTimes.hosts[hostname] = append(pruneChanges(hostname, now), now)
+}
+
+// Classifies hostname by how many times it changed within -stability-window: stable below
+// -changing-threshold, flapping from -flapping-threshold on, and changing in between
+func hostStability(hostname string) string {
+	changeTimes.Lock()
+	defer changeTimes.Unlock()
+	n := len(pruneChanges(hostname, time.Now()))
+	switch {
+	case n >= flappingThreshold:
+		return flapping
+	case n >= changingThreshold:
+		return changing
+	default:
+		return stable
+	}
+}
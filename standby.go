@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// how often -active-when-file-exists is checked for promotion or demotion. Shortened in tests.
+var standbyPollInterval = time.Second
+
+// Reports whether this instance is active. Without -active-when-file-exists it always is.
+func isActive() bool {
+	if activeFile == "" {
+		return true
+	}
+	_, err := os.Stat(activeFile)
+	return err == nil
+}
+
+// Watches the -active-when-file-exists file. While it's missing, react only tracks DNS state;
+// when it appears the current state is rendered immediately.
+func monitorStandby(ctx context.Context) {
+	defer wg.Done()
+
+	active := isActive()
+	if !active {
+		logInfo("%s does not exist, starting in standby", activeFile)
+	}
+	ticker := time.NewTicker(standbyPollInterval)
+	for {
+		select {
+		case <-ticker.C:
+			now := isActive()
+			if now == active {
+				continue
+			}
+			active = now
+			if active {
+				logChange("%s exists, promoted to active", activeFile)
+				triggerReact()
+			} else {
+				logChange("%s removed, now in standby", activeFile)
+			}
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
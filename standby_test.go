@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStandby(t *testing.T) {
+	dir, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }}`)
+	defer restore()
+	defer func(file string, poll time.Duration) { activeFile, standbyPollInterval = file, poll }(activeFile, standbyPollInterval)
+	activeFile, standbyPollInterval = filepath.Join(dir, "active"), 10*time.Millisecond
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	drainChanges()
+
+	// in standby, nothing is written or run
+	if result := react(context.Background(), nil); result.Changed || len(result.Stages) != 0 {
+		t.Errorf("react in standby ran %v", stageNames(result))
+	}
+	if fileExists(dest) || fileExists(marker) {
+		t.Fatal("the output was written or the command run in standby")
+	}
+
+	reacts, stop := startCountingReactor(commandLineGroup())
+	defer stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go monitorStandby(ctx)
+	defer wg.Wait()
+	defer cancel()
+	// let it see it starts in standby
+	time.Sleep(50 * time.Millisecond)
+
+	// promotion renders the current state straight away
+	if err := ioutil.WriteFile(activeFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { return fileExists(dest) && fileExists(marker) }) {
+		t.Fatal("promotion didn't render the output and run the command")
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "[10.0.0.1]" {
+		t.Errorf("out = %q, want the current addresses", got)
+	}
+
+	// after demotion changes are tracked but not written
+	os.Remove(activeFile)
+	time.Sleep(50 * time.Millisecond)
+	before := reacts()
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.2"}})
+	requestReact(changes)
+	if !eventually(func() bool { return reacts() > before }) {
+		t.Fatal("the change was never reacted to")
+	}
+	if got, _ := ioutil.ReadFile(dest); string(got) != "[10.0.0.1]" {
+		t.Errorf("out = %q in standby, want it left alone", got)
+	}
+
+	// and the next promotion renders them
+	if err := ioutil.WriteFile(activeFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !eventually(func() bool { got, _ := ioutil.ReadFile(dest); return string(got) == "[10.0.0.2]" }) {
+		t.Error("promotion didn't render the changes made in standby")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// hostStatus is one host in the /status response
+type hostStatus struct {
+	Name       string     `json:"name"`
+	Addresses  []string   `json:"addresses"`
+	LastLookup *time.Time `json:"last_lookup,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+	Stability  string     `json:"stability"`
+	// whether the host's monitor is running and how often it restarted after a panic
+	Monitor *monitorState `json:"monitor,omitempty"`
+	// with -split-families, the time each family took in the last lookup
+	Families *familyLatencies `json:"families,omitempty"`
+}
+
+// guardStatus is the state of -guard-host
+type guardStatus struct {
+	Host string `json:"host"`
+	// whether a react is waiting for the guard host to resolve again
+	Pending bool `json:"pending"`
+}
+
+// templateStatus is how one output's renders and writes have gone, in the /status response
+type templateStatus struct {
+	// the template's path, or -json or -simple
+	Template    string     `json:"template"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// set while the output's most recent render or write has failed
+	Error   string     `json:"error,omitempty"`
+	ErrorAt *time.Time `json:"error_at,omitempty"`
+}
+
+// status is the /status response
+type status struct {
+	Healthy    bool         `json:"healthy"`
+	LastRender *time.Time   `json:"last_render,omitempty"`
+	LastReact  *time.Time   `json:"last_react,omitempty"`
+	Guard      *guardStatus `json:"guard,omitempty"`
+	// with -react-lock, whether this instance holds the lock right now
+	ReactLockHeld *bool `json:"react_lock_held,omitempty"`
+	// each output, sorted by name
+	Templates []templateStatus `json:"templates"`
+	Hosts     []hostStatus     `json:"hosts"`
+	// how much dns-gen is holding on to, for watching memory use with large host lists
+	Memory memoryCounts `json:"memory"`
+}
+
+// Returns the current state of every host. dns-gen is healthy once it has rendered its output
+// or found what it monitors (hosts, a zone transfer, a -wildcard probe or an SOA record), as
+// long as every host has resolved to at least one address and the last render didn't fail.
+func currentStatus() status {
+	memory := currentMemoryCounts()
+	var guard *guardStatus
+	if guardHost != "" {
+		guard = &guardStatus{Host: guardHost, Pending: guardPending()}
+	}
+	var lockHeld *bool
+	if reactLock != "" {
+		held := isReactLockHeld()
+		lockHeld = &held
+	}
+	store.Lock()
+	defer store.Unlock()
+	st := status{
+		Healthy:       !store.lastRender.IsZero() || len(store.hosts) > 0 || store.soa != nil || store.sourceFetched,
+		Templates:     make([]templateStatus, 0, len(store.renders)),
+		Hosts:         make([]hostStatus, 0, len(store.hosts)),
+		Guard:         guard,
+		ReactLockHeld: lockHeld,
+		Memory:        memory,
+	}
+	if !store.lastRender.IsZero() {
+		at := store.lastRender
+		st.LastRender = &at
+	}
+	if !store.lastReact.IsZero() {
+		at := store.lastReact
+		st.LastReact = &at
+	}
+	for name, rs := range store.renders {
+		ts := templateStatus{Template: name}
+		if !rs.LastSuccess.IsZero() {
+			at := rs.LastSuccess
+			ts.LastSuccess = &at
+		}
+		if rs.Err != nil {
+			at := rs.ErrAt
+			ts.Error, ts.ErrorAt = rs.Err.Error(), &at
+			st.Healthy = false
+		}
+		st.Templates = append(st.Templates, ts)
+	}
+	sort.Slice(st.Templates, func(i, j int) bool { return st.Templates[i].Template < st.Templates[j].Template })
+	for name, h := range store.hosts {
+		hs := hostStatus{Name: name, Addresses: append([]string(nil), h.Addresses...), Stability: hostStability(name)}
+		if m, ok := store.monitors[name]; ok {
+			hs.Monitor = &m
+		}
+		if f, ok := store.families[name]; ok {
+			hs.Families = &f
+		}
+		if l, ok := store.lookups[name]; ok {
+			hs.LastLookup = &l.At
+			if l.Err != nil {
+				hs.LastError = l.Err.Error()
+			}
+		}
+		if len(h.Addresses) == 0 {
+			st.Healthy = false
+		}
+		st.Hosts = append(st.Hosts, hs)
+	}
+	sort.Slice(st.Hosts, func(i, j int) bool { return st.Hosts[i].Name < st.Hosts[j].Name })
+	return st
+}
+
+// Starts serving /healthz, /status and /version on addr
+func serveStatus(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(l, statusHandler())
+	return nil
+}
+
+func statusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !currentStatus().Healthy {
+			http.Error(w, "nothing has been rendered or found yet, a host hasn't resolved, or an output's last render failed", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(currentStatus())
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(versionString() + "\n"))
+	})
+	return mux
+}
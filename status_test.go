@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func metricsText() string {
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	return buf.String()
+}
+
+// Returns what st reports for the output called name, or nil
+func templateState(st status, name string) *templateStatus {
+	for i := range st.Templates {
+		if st.Templates[i].Template == name {
+			return &st.Templates[i]
+		}
+	}
+	return nil
+}
+
+func TestRenderErrorFailureThenRecovery(t *testing.T) {
+	_, _, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }}{{ end }}`)
+	defer restore()
+	execute = ""
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	st := currentStatus()
+	ts := templateState(st, tmplPath)
+	if st.LastRender == nil || ts == nil || ts.LastSuccess == nil || ts.Error != "" {
+		t.Fatalf("after a good render: last render %v, template %+v", st.LastRender, ts)
+	}
+	success := *ts.LastSuccess
+	if m := metricsText(); !strings.Contains(m, `dnsgen_render_error{template="`+tmplPath+`"} 0`) {
+		t.Errorf("metrics don't report a healthy render:\n%s", m)
+	}
+
+	// break the template
+	if err := ioutil.WriteFile(tmplPath, []byte(`{{ index .Hosts 5 }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result := react(context.Background(), nil); result.Err() == nil {
+		t.Fatal("react with a broken template succeeded")
+	}
+	st = currentStatus()
+	ts = templateState(st, tmplPath)
+	if ts == nil || ts.Error == "" || ts.ErrorAt == nil || st.Healthy {
+		t.Errorf("/status doesn't report the failed render: %+v", st)
+	}
+	if ts == nil || ts.LastSuccess == nil || !ts.LastSuccess.Equal(success) {
+		t.Errorf("last success = %+v, want the earlier success %v", ts, success)
+	}
+	m := metricsText()
+	if !strings.Contains(m, `dnsgen_render_error{template="`+tmplPath+`"} 1`) {
+		t.Errorf("metrics don't report the failed render:\n%s", m)
+	}
+	if !strings.Contains(m, `dnsgen_render_last_success_timestamp_seconds{template="`+tmplPath+`"} `) {
+		t.Errorf("metrics are missing the last success time:\n%s", m)
+	}
+
+	// fix it again
+	if err := ioutil.WriteFile(tmplPath, []byte(`{{ len .Hosts }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if result := react(context.Background(), nil); result.Err() != nil {
+		t.Fatal(result.Err())
+	}
+	st = currentStatus()
+	ts = templateState(st, tmplPath)
+	if ts.Error != "" || ts.ErrorAt != nil || !st.Healthy {
+		t.Errorf("the render error wasn't cleared by a good render: %+v", st)
+	}
+	if !ts.LastSuccess.After(success) {
+		t.Errorf("last success %v wasn't updated after recovering", ts.LastSuccess)
+	}
+	if m := metricsText(); !strings.Contains(m, `dnsgen_render_error{template="`+tmplPath+`"} 0`) {
+		t.Errorf("metrics still report the render as failing:\n%s", m)
+	}
+}
+
+func TestRenderErrorsArePerTemplate(t *testing.T) {
+	dir, _, restore := setupReact(t, `{{ range .Hosts }}{{ .Name }}{{ end }}`)
+	defer restore()
+	execute = ""
+	broken := filepath.Join(dir, "broken.tmpl")
+	if err := ioutil.WriteFile(broken, []byte(`{{ index .Hosts 5 }}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { extraOutputs = nil }()
+	extraOutputs = outputsFlag{{tmpl: broken, dest: filepath.Join(dir, "broken.out")}}
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+
+	// the good template is written first, and its success mustn't hide the other's failure
+	for i := 0; i < 2; i++ {
+		if result := react(context.Background(), nil); result.Err() == nil {
+			t.Fatal("react with a broken template succeeded")
+		}
+	}
+	st := currentStatus()
+	if good := templateState(st, tmplPath); good == nil || good.Error != "" || good.LastSuccess == nil {
+		t.Errorf("the good template is reported as %+v", good)
+	}
+	if bad := templateState(st, broken); bad == nil || bad.Error == "" || bad.LastSuccess != nil {
+		t.Errorf("the broken template is reported as %+v", bad)
+	}
+	if st.Healthy {
+		t.Error("healthy while a template fails")
+	}
+	m := metricsText()
+	for _, want := range []string{
+		`dnsgen_render_error{template="` + tmplPath + `"} 0`,
+		`dnsgen_render_error{template="` + broken + `"} 1`,
+		`dnsgen_render_last_success_timestamp_seconds{template="` + broken + `"} 0`,
+	} {
+		if !strings.Contains(m, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, m)
+		}
+	}
+	if n := strings.Count(m, "# TYPE dnsgen_render_error gauge"); n != 1 {
+		t.Errorf("dnsgen_render_error is described %d times", n)
+	}
+}
+
+func TestRenderSeriesBeforeTheFirstRender(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	// a -config file's groups, without -tmpl
+	groups := []*group{
+		{outputs: []output{{tmpl: "a.tmpl", dest: "/etc/a.conf"}}},
+		{outputs: []output{{tmpl: "b.tmpl", dest: "/etc/b.conf"}, {json: true, dest: "/etc/b.json"}}},
+	}
+	registerOutputs(groupOutputNames(groups))
+	m := metricsText()
+	for _, name := range []string{"a.tmpl", "b.tmpl", "-json"} {
+		for _, series := range []string{"dnsgen_render_error", "dnsgen_render_last_success_timestamp_seconds"} {
+			if want := series + `{template="` + name + `"} 0`; !strings.Contains(m, want) {
+				t.Errorf("metrics don't contain %q:\n%s", want, m)
+			}
+		}
+	}
+	if got := len(currentStatus().Templates); got != 3 {
+		t.Errorf("/status lists %d templates, want 3", got)
+	}
+}
+
+// Healthy means no output's last render failed, something was rendered or found (hosts, a zone
+// transfer, a -wildcard probe or an SOA record), and every host has at least one address
+func TestHealthy(t *testing.T) {
+	resolved := func() { updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}}) }
+	tests := []struct {
+		name    string
+		setup   []func()
+		healthy bool
+	}{
+		{"nothing rendered or found", nil, false},
+		{"a host that hasn't resolved", []func(){func() { registerHosts([]hostSpec{{Name: "a"}}) }}, false},
+		{"every host resolved", []func(){resolved}, true},
+		{"a host with no addresses", []func(){resolved, func() { updateHost(Host{Name: "b"}) }}, false},
+		{"a render", []func(){func() { setLastRender("a.tmpl", time.Now()) }}, true},
+		{"a zone transfer or -wildcard probe", []func(){setSourceFetched}, true},
+		{"an SOA record", []func(){func() { setSOA(SOA{Zone: "example.com.", Serial: 1}) }}, true},
+		{"a failing output", []func(){resolved, func() { setRenderError("a.tmpl", errors.New("template: bad")) }}, false},
+		{"an output failing while another rendered", []func(){
+			resolved,
+			func() { setLastRender("a.tmpl", time.Now()) },
+			func() { setRenderError("b.tmpl", errors.New("template: bad")) },
+		}, false},
+		{"a failed output that rendered again", []func(){
+			resolved,
+			func() { setRenderError("a.tmpl", errors.New("template: bad")) },
+			func() { setLastRender("a.tmpl", time.Now()) },
+		}, true},
+	}
+	defer resetStore()
+	for _, tt := range tests {
+		resetStore()
+		for _, f := range tt.setup {
+			f()
+		}
+		if got := currentStatus().Healthy; got != tt.healthy {
+			t.Errorf("%s: healthy = %v, want %v", tt.name, got, tt.healthy)
+		}
+	}
+}
+
+func TestStatusReportsReactorState(t *testing.T) {
+	dir, _, restore := setupReact(t, `x`)
+	defer restore()
+	execute = ""
+	reactLock = filepath.Join(dir, "lock")
+	guardHost = "localhost"
+	guard.pending = false
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	recordFamilies("a", familyResult{took: 2 * time.Millisecond}, familyResult{err: errors.New("no AAAA"), took: time.Millisecond})
+	setMonitorState("a", true, 1)
+
+	st := currentStatus()
+	if st.ReactLockHeld == nil || *st.ReactLockHeld {
+		t.Errorf("react_lock_held = %v before any react, want false", st.ReactLockHeld)
+	}
+	if st.Guard == nil || st.Guard.Host != "localhost" || st.Guard.Pending {
+		t.Errorf("guard = %+v", st.Guard)
+	}
+	if st.LastReact != nil {
+		t.Errorf("last react = %v before any react", st.LastReact)
+	}
+	h := st.Hosts[0]
+	if h.Stability != "stable" {
+		t.Errorf("stability = %q, want stable", h.Stability)
+	}
+	if h.Monitor == nil || !h.Monitor.Running || h.Monitor.Restarts != 1 {
+		t.Errorf("monitor = %+v, want running after 1 restart", h.Monitor)
+	}
+	if h.Families == nil || h.Families.IPv4MS != 2 || h.Families.IPv6Error != "no AAAA" {
+		t.Errorf("families = %+v", h.Families)
+	}
+
+	// the lock is reported as held while a react is holding it
+	held := make(chan bool, 1)
+	lockingReact := func(ctx context.Context, changes []changeEvent) reactResult {
+		release, err := acquireReactLock()
+		if err != nil {
+			t.Error(err)
+			return reactResult{}
+		}
+		held <- *currentStatus().ReactLockHeld
+		release()
+		return reactResult{}
+	}
+	drainChanges()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runReactor(ctx, changes, lockingReact)
+		close(done)
+	}()
+	triggerReact()
+	if !<-held {
+		t.Error("react_lock_held is false while the lock is held")
+	}
+	cancel()
+	<-done
+	if st := currentStatus(); st.LastReact == nil || *st.ReactLockHeld {
+		t.Errorf("after the react: last react %v, lock held %v", st.LastReact, *st.ReactLockHeld)
+	}
+}
+
+func TestStatusEndpoints(t *testing.T) {
+	resetStore()
+	defer resetStore()
+	srv := httptest.NewServer(statusHandler())
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, body := get("/version"); code != http.StatusOK || body != versionString()+"\n" {
+		t.Errorf("/version = %d %q, want %q", code, body, versionString())
+	}
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz with no hosts = %d, want 503", code)
+	}
+	updateHost(Host{Name: "a", Addresses: []string{"10.0.0.1"}})
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz once every host resolved = %d, want 200", code)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Host is a monitored hostname and its most recently resolved addresses (or records, with -type)
+type Host struct {
+	Name          string   `json:"name"`
+	Addresses     []string `json:"addresses"`
+	UsingFallback bool     `json:"using_fallback"`
+	// stable, changing or flapping, depending on how often the host changed recently
+	Stability string `json:"stability"`
+	// with -geoip-db, the addresses along with their country, city and ASN
+	Geo []GeoAddress `json:"geo,omitempty"`
+	// with -k8s-service, every endpoint of the Service including those that aren't ready
+	Endpoints []Endpoint `json:"endpoints,omitempty"`
+	// with -history-size, the address sets the host resolved to within -history-ttl, most recent
+	// first, and the addresses among them it no longer resolves to
+	History  []HistoryEntry `json:"history,omitempty"`
+	Draining []string       `json:"draining,omitempty"`
+	// the records in Addresses by type. Only those of the -type being monitored are set: A and
+	// AAAA for host, SRV for srv and TXT for txt.
+	A    []string    `json:"a,omitempty"`
+	AAAA []string    `json:"aaaa,omitempty"`
+	SRV  []SRVRecord `json:"srv,omitempty"`
+	TXT  []string    `json:"txt,omitempty"`
+}
+
+// RenderContext is the data templates are executed with
+type RenderContext struct {
+	// every monitored host, sorted by name
+	Hosts []Host `json:"hosts"`
+	// with -capture-exec-output, the stdout of the last successful -exec. The command runs
+	// after the render in each reaction, so this is always the output of an earlier reaction.
+	LastExecOutput string `json:"last_exec_output,omitempty"`
+	// with -soa, the most recently seen SOA record of the zone
+	SOA *SOA `json:"soa,omitempty"`
+	// with -axfr, the records of the most recent transfer of the zone, sorted
+	Zone []string `json:"zone,omitempty"`
+	// with -wildcard, the candidates under it that resolved on the most recent probe, sorted
+	Wildcard []string `json:"wildcard,omitempty"`
+	// seeds shuffle, see group.shuffleSeeds
+	seeds *shuffleSeeds
+}
+
+// largest -exec output kept for .LastExecOutput; anything beyond it is dropped
+const maxExecOutput = 64 * 1024
+
+// Last known state of every monitored host, updated by the monitors whenever a host changes.
+// Rendering reads from here rather than doing its own lookups.
+var store = struct {
+	sync.Mutex
+	hosts          map[string]Host
+	lastExecOutput string
+	soa            *SOA
+	// when each host was last looked up and how it went, for -status-addr
+	lookups map[string]lookupState
+	// when any output was last written successfully
+	lastRender time.Time
+	// how each output's renders and writes have gone, by output name
+	renders map[string]renderState
+	// set by warmStart, and cleared once every host has been looked up
+	awaitingFirstLookups bool
+	// when the reactor last reacted
+	lastReact time.Time
+	// whether each host's monitor is running and how often it was restarted
+	monitors map[string]monitorState
+	// with -split-families, how each family's part of a host's last lookup went
+	families map[string]familyLatencies
+	// -axfr or -wildcard has fetched its data at least once, even if it found nothing
+	sourceFetched bool
+}{
+	hosts:    make(map[string]Host),
+	lookups:  make(map[string]lookupState),
+	monitors: make(map[string]monitorState),
+	families: make(map[string]familyLatencies),
+	renders:  make(map[string]renderState),
+}
+
+type monitorState struct {
+	Running  bool `json:"running"`
+	Restarts int  `json:"restarts"`
+}
+
+type familyLatencies struct {
+	IPv4MS    float64 `json:"ipv4_ms"`
+	IPv4Error string  `json:"ipv4_error,omitempty"`
+	IPv6MS    float64 `json:"ipv6_ms"`
+	IPv6Error string  `json:"ipv6_error,omitempty"`
+}
+
+type lookupState struct {
+	At  time.Time
+	Err error
+}
+
+// Adds hosts to the store before their first lookup, so they appear with no addresses
+// until they resolve
+func registerHosts(hosts []hostSpec) {
+	store.Lock()
+	defer store.Unlock()
+	for _, h := range hosts {
+		if _, ok := store.hosts[h.Name]; !ok {
+			store.hosts[h.Name] = Host{Name: h.Name}
+		}
+	}
+}
+
+func updateHost(h Host) {
+	h.Addresses = internAddresses(h.Addresses)
+	store.Lock()
+	old := store.hosts[h.Name]
+	store.hosts[h.Name] = h
+	store.Unlock()
+	releaseAddresses(old.Addresses)
+}
+
+// Returns how many addresses each host currently has
+func addressCounts() map[string]int {
+	store.Lock()
+	defer store.Unlock()
+	counts := make(map[string]int, len(store.hosts))
+	for name, h := range store.hosts {
+		counts[name] = len(h.Addresses)
+	}
+	return counts
+}
+
+// Returns a copy of the store's contents. Hosts are sorted by name so that rendered output
+// doesn't depend on the order monitors happened to update them.
+func snapshot() RenderContext {
+	return snapshotHosts(nil)
+}
+
+// Like snapshot, but only includes the hosts in names, or every host if names is nil
+func snapshotHosts(names map[string]bool) RenderContext {
+	zone, wildcard := zoneRecords(), wildcardMembers()
+	store.Lock()
+	defer store.Unlock()
+	hosts := make([]Host, 0, len(store.hosts))
+	for _, h := range store.hosts {
+		if names != nil && !names[h.Name] {
+			continue
+		}
+		h.Addresses = append([]string(nil), h.Addresses...)
+		h.Endpoints = append([]Endpoint(nil), h.Endpoints...)
+		h.Stability = hostStability(h.Name)
+		h.Geo = geoLookup(h.Addresses)
+		setTypedRecords(&h)
+		h.History, h.Draining = addressHistory(h.Name), draining(h.Name)
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].Name < hosts[j].Name })
+	return RenderContext{Hosts: hosts, LastExecOutput: store.lastExecOutput, SOA: store.soa, Zone: zone, Wildcard: wildcard}
+}
+
+func setSOA(soa SOA) {
+	store.Lock()
+	defer store.Unlock()
+	store.soa = &soa
+}
+
+// Keeps the output of a successful -exec for the next render, truncated to maxExecOutput bytes
+func setExecOutput(out []byte) {
+	if len(out) > maxExecOutput {
+		out = out[:maxExecOutput]
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.lastExecOutput = string(out)
+}
+
+func recordLookup(hostname string, err error) {
+	store.Lock()
+	store.lookups[hostname] = lookupState{At: time.Now(), Err: err}
+	done := store.awaitingFirstLookups && !missingLookups()
+	if done {
+		store.awaitingFirstLookups = false
+	}
+	store.Unlock()
+	if done {
+		// the cached render written by warmStart can now be replaced
+		triggerReact()
+	}
+}
+
+// Reports whether dest still holds the cached render from warmStart and some host hasn't been
+// looked up yet
+func awaitingFirstLookups() bool {
+	store.Lock()
+	defer store.Unlock()
+	return store.awaitingFirstLookups && missingLookups()
+}
+
+// Reports whether any host in the store hasn't been looked up. The store must be locked.
+func missingLookups() bool {
+	for name := range store.hosts {
+		if _, ok := store.lookups[name]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// renderState is how an output's renders and writes have gone
+type renderState struct {
+	// when the output's dest was last written successfully
+	LastSuccess time.Time
+	// why the output's last render or write failed, cleared by its next successful one
+	Err   error
+	ErrAt time.Time
+}
+
+// Records outputs that will be rendered, so that they're reported before their first render
+func registerOutputs(names []string) {
+	store.Lock()
+	defer store.Unlock()
+	for _, name := range names {
+		if _, ok := store.renders[name]; !ok {
+			store.renders[name] = renderState{}
+		}
+	}
+}
+
+// Records a successful render and write of output, clearing its earlier render error
+func setLastRender(output string, at time.Time) {
+	store.Lock()
+	defer store.Unlock()
+	store.lastRender = at
+	store.renders[output] = renderState{LastSuccess: at}
+}
+
+// Records a failed render or write of output, which its dest wasn't updated with
+func setRenderError(output string, err error) {
+	store.Lock()
+	defer store.Unlock()
+	rs := store.renders[output]
+	rs.Err, rs.ErrAt = err, time.Now()
+	store.renders[output] = rs
+}
+
+// Returns how each output's renders and writes have gone, by output name
+func renderStates() map[string]renderState {
+	store.Lock()
+	defer store.Unlock()
+	states := make(map[string]renderState, len(store.renders))
+	for name, rs := range store.renders {
+		states[name] = rs
+	}
+	return states
+}
+
+// Records that -axfr or -wildcard has fetched its data, which counts towards being healthy
+func setSourceFetched() {
+	store.Lock()
+	defer store.Unlock()
+	store.sourceFetched = true
+}
+
+func setLastReact(at time.Time) {
+	store.Lock()
+	defer store.Unlock()
+	store.lastReact = at
+}
+
+func setMonitorState(hostname string, running bool, restarts int) {
+	store.Lock()
+	defer store.Unlock()
+	store.monitors[hostname] = monitorState{Running: running, Restarts: restarts}
+}
+
+func recordFamilies(hostname string, v4, v6 familyResult) {
+	l := familyLatencies{IPv4MS: durationMS(v4.took), IPv6MS: durationMS(v6.took)}
+	if v4.err != nil {
+		l.IPv4Error = v4.err.Error()
+	}
+	if v6.err != nil {
+		l.IPv6Error = v6.err.Error()
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.families[hostname] = l
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// runSummary is what -summary-format reports at the end of a -once run
+type runSummary struct {
+	Hosts []hostSummary `json:"hosts"`
+	// whether the run wrote new content to dest
+	Changed bool `json:"changed"`
+	// the error from the stage that failed, if any
+	Error  string         `json:"error,omitempty"`
+	Stages []stageSummary `json:"stages"`
+}
+
+type hostSummary struct {
+	Name          string   `json:"name"`
+	Addresses     []string `json:"addresses"`
+	UsingFallback bool     `json:"using_fallback,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type stageSummary struct {
+	Stage      string  `json:"stage"`
+	Error      string  `json:"error,omitempty"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// Describes a -once run from the store's hosts, the lookup errors, keyed by hostname, and the
+// result of the reaction
+func summarize(errs map[string]error, result reactResult) runSummary {
+	s := runSummary{Changed: result.Changed, Hosts: []hostSummary{}, Stages: []stageSummary{}}
+	for _, h := range snapshot().Hosts {
+		hs := hostSummary{Name: h.Name, Addresses: h.Addresses, UsingFallback: h.UsingFallback}
+		if hs.Addresses == nil {
+			hs.Addresses = []string{}
+		}
+		if err := errs[h.Name]; err != nil {
+			hs.Error = err.Error()
+		}
+		s.Hosts = append(s.Hosts, hs)
+	}
+	for _, st := range result.Stages {
+		ss := stageSummary{Stage: st.Stage, DurationMS: durationMS(st.Duration)}
+		if st.Err != nil {
+			ss.Error = st.Err.Error()
+		}
+		s.Stages = append(s.Stages, ss)
+	}
+	if err := result.Err(); err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// Formats the summary as -summary-format json or text
+func (s runSummary) format(format string) ([]byte, error) {
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(s, "", "  ")
+		return append(b, '\n'), err
+	case "text":
+		var buf bytes.Buffer
+		rows := [][]string{{"HOST", "ADDRESSES"}}
+		for _, h := range s.Hosts {
+			addrs := strings.Join(h.Addresses, ",")
+			if h.UsingFallback {
+				addrs += " (fallback)"
+			}
+			if h.Error != "" {
+				addrs = strings.TrimSpace(addrs + " error: " + h.Error)
+			}
+			rows = append(rows, []string{h.Name, addrs})
+		}
+		table, _ := columns(rows)
+		buf.WriteString(table)
+		buf.WriteString("\n")
+		switch {
+		case s.Error != "":
+			fmt.Fprintf(&buf, "failed: %s\n", s.Error)
+		case s.Changed:
+			buf.WriteString("ok, output changed\n")
+		default:
+			buf.WriteString("ok, output unchanged\n")
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown summary format %q, expected json or text", format)
+}
+
+// Writes the summary to -summary-file, or stdout if that isn't set
+func writeSummary(s runSummary) error {
+	b, err := s.format(summaryFormat)
+	if err != nil {
+		return err
+	}
+	if summaryFile == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(summaryFile, b, 0644)
+}
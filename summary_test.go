@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSummary() runSummary {
+	resetStore()
+	updateHost(Host{Name: "a.example.com", Addresses: []string{"10.0.0.1", "10.0.0.2"}})
+	updateHost(Host{Name: "b.example.com"})
+	errs := map[string]error{"b.example.com": errors.New("no such host")}
+	result := reactResult{Changed: true, Stages: []stageResult{
+		{Stage: stageRender, Duration: time.Millisecond},
+		{Stage: stageWrite, Duration: 2 * time.Millisecond},
+	}}
+	return summarize(errs, result)
+}
+
+func TestSummaryJSON(t *testing.T) {
+	defer resetStore()
+	b, err := testSummary().format("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got runSummary
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("summary is not valid JSON: %v\n%s", err, b)
+	}
+	want := []hostSummary{
+		{Name: "a.example.com", Addresses: []string{"10.0.0.1", "10.0.0.2"}},
+		{Name: "b.example.com", Addresses: []string{}, Error: "no such host"},
+	}
+	if !reflect.DeepEqual(got.Hosts, want) {
+		t.Errorf("hosts = %+v, want %+v", got.Hosts, want)
+	}
+	if !got.Changed || got.Error != "" {
+		t.Errorf("changed = %v, error = %q; want a change and no error", got.Changed, got.Error)
+	}
+	if len(got.Stages) != 2 || got.Stages[1].Stage != stageWrite || got.Stages[1].DurationMS != 2 {
+		t.Errorf("stages = %+v", got.Stages)
+	}
+}
+
+func TestSummaryText(t *testing.T) {
+	defer resetStore()
+	b, err := testSummary().format("text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+	for _, want := range []string{"HOST", "a.example.com 10.0.0.1,10.0.0.2", "b.example.com error: no such host", "ok, output changed"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("summary is missing %q:\n%s", want, got)
+		}
+	}
+
+	failed := runSummary{Error: "write: permission denied"}
+	b, _ = failed.format("text")
+	if !strings.Contains(string(b), "failed: write: permission denied") {
+		t.Errorf("failed run summary:\n%s", b)
+	}
+}
+
+func TestWriteSummaryFile(t *testing.T) {
+	dir, restore := setupOutput(t, "")
+	defer restore()
+	origFormat, origFile := summaryFormat, summaryFile
+	defer func() { summaryFormat, summaryFile = origFormat, origFile }()
+	summaryFormat, summaryFile = "json", filepath.Join(dir, "summary.json")
+
+	if err := writeSummary(testSummary()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got runSummary
+	if err := json.Unmarshal(b, &got); err != nil || len(got.Hosts) != 2 {
+		t.Errorf("-summary-file contains %s (%v)", b, err)
+	}
+}
+
+func TestProbeHosts(t *testing.T) {
+	defer func(orig string) { summaryFormat = orig }(summaryFormat)
+	hosts := []hostSpec{
+		{Name: "a.example.com", Resolver: &fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.2", "10.0.0.1"}}}}},
+		{Name: "b.example.com", Resolver: &fakeResolver{results: []fakeResult{{err: errors.New("NXDOMAIN")}}}},
+	}
+
+	summaryFormat = "json"
+	var buf bytes.Buffer
+	if probeHosts(&buf, hosts) {
+		t.Error("probe succeeded with a host that failed to resolve")
+	}
+	var got struct{ Hosts []hostSummary }
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("-probe -summary-format json printed %q: %v", buf.String(), err)
+	}
+	want := []hostSummary{
+		{Name: "a.example.com", Addresses: []string{"10.0.0.1", "10.0.0.2"}},
+		{Name: "b.example.com", Addresses: []string{}, Error: "NXDOMAIN"},
+	}
+	if !reflect.DeepEqual(got.Hosts, want) {
+		t.Errorf("hosts = %+v, want %+v", got.Hosts, want)
+	}
+
+	summaryFormat = ""
+	buf.Reset()
+	if !probeHosts(&buf, hosts[:1]) {
+		t.Error("probe failed with every host resolved")
+	}
+	if out := buf.String(); !strings.HasPrefix(out, "HOST") || !strings.Contains(out, "10.0.0.1,10.0.0.2") {
+		t.Errorf("table = %q", out)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Renders -tmpl against every fixture in dir and compares the output with its golden file.
+// Each fixture is a name.json file holding a render context in the same format -json writes,
+// and name.golden holds the expected output. Prints a line per fixture, with a diff for each
+// mismatch, and returns whether they all passed.
+func runTemplateTests(dir string) (bool, error) {
+	fixtures, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return false, err
+	}
+	if len(fixtures) == 0 {
+		return false, fmt.Errorf("no *.json fixtures in %s", dir)
+	}
+	sort.Strings(fixtures)
+
+	passed := true
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		if err := runTemplateTest(fixture, strings.TrimSuffix(fixture, ".json")+".golden"); err != nil {
+			passed = false
+			fmt.Printf("FAIL %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("ok   %s\n", name)
+	}
+	return passed, nil
+}
+
+func runTemplateTest(fixture, golden string) error {
+	data, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		return err
+	}
+	var ctx RenderContext
+	if err := json.Unmarshal(data, &ctx); err != nil {
+		return fmt.Errorf("invalid fixture: %v", err)
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		return err
+	}
+	got, err := ctx.execTemplateFile(tmplPath)
+	if err != nil {
+		return fmt.Errorf("render failed: %v", err)
+	}
+	if !bytes.Equal(got, expected) {
+		return fmt.Errorf("output differs from %s:\n%s", filepath.Base(golden), lineDiff(expected, got))
+	}
+	return nil
+}
+
+// Returns the lines that differ between expected and got, prefixed with - and + respectively
+func lineDiff(expected, got []byte) string {
+	a, b := strings.Split(string(expected), "\n"), strings.Split(string(got), "\n")
+	var diff strings.Builder
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(a):
+			fmt.Fprintf(&diff, "  %d: + %s\n", i+1, b[i])
+		case i >= len(b):
+			fmt.Fprintf(&diff, "  %d: - %s\n", i+1, a[i])
+		case a[i] != b[i]:
+			fmt.Fprintf(&diff, "  %d: - %s\n  %d: + %s\n", i+1, a[i], i+1, b[i])
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes each fixture and golden file in files to dir
+func writeFixtures(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Runs the template tests in dir, returning their result along with what they printed
+func captureTemplateTests(t *testing.T, dir string) (bool, string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	orig := os.Stdout
+	os.Stdout = w
+	passed, err := runTemplateTests(dir)
+	os.Stdout = orig
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	return passed, string(out), err
+}
+
+func TestRunTemplateTests(t *testing.T) {
+	dir, restore := setupOutput(t, "{{ range .Hosts }}{{ .Name }}{{ range .Addresses }} {{ . }}{{ end }}\n{{ end }}")
+	defer restore()
+	writeFixtures(t, dir, map[string]string{
+		"one.json":   `{"hosts": [{"name": "a", "addresses": ["10.0.0.1", "10.0.0.2"]}]}`,
+		"one.golden": "a 10.0.0.1 10.0.0.2\n",
+		"two.json":   `{"hosts": [{"name": "a", "addresses": ["10.0.0.1"]}, {"name": "b", "addresses": ["10.0.0.2"]}]}`,
+		"two.golden": "a 10.0.0.1\nb 10.0.0.2\n",
+	})
+
+	passed, out, err := captureTemplateTests(t, dir)
+	if err != nil || !passed {
+		t.Fatalf("got %v, %v; want every fixture to pass\n%s", passed, err, out)
+	}
+	if want := "ok   one\nok   two\n"; out != want {
+		t.Errorf("printed %q, want %q", out, want)
+	}
+}
+
+func TestRunTemplateTestsReportsEachFailure(t *testing.T) {
+	dir, restore := setupOutput(t, "{{ range .Hosts }}{{ .Name }}{{ range .Addresses }} {{ . }}{{ end }}\n{{ end }}")
+	defer restore()
+	writeFixtures(t, dir, map[string]string{
+		"changed.json":   `{"hosts": [{"name": "a", "addresses": ["10.0.0.1"]}, {"name": "b", "addresses": ["10.0.0.3"]}]}`,
+		"changed.golden": "a 10.0.0.1\nb 10.0.0.2\n",
+		"invalid.json":   `{"hosts": `,
+		"invalid.golden": "",
+		"ok.json":        `{"hosts": [{"name": "a", "addresses": ["10.0.0.1"]}]}`,
+		"ok.golden":      "a 10.0.0.1\n",
+	})
+
+	passed, out, err := captureTemplateTests(t, dir)
+	if err != nil || passed {
+		t.Fatalf("got %v, %v; want the run to fail\n%s", passed, err, out)
+	}
+	// the mismatch is shown as a diff, and the fixtures after a failure still run
+	for _, want := range []string{
+		"FAIL changed: output differs from changed.golden:\n  2: - b 10.0.0.2\n  2: + b 10.0.0.3\n",
+		"FAIL invalid: invalid fixture",
+		"ok   ok\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRunTemplateTestsWithNoFixtures(t *testing.T) {
+	dir, restore := setupOutput(t, "")
+	defer restore()
+	if _, _, err := captureTemplateTests(t, dir); err == nil {
+		t.Error("a directory without fixtures passed")
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Collects the lowest TTL of the answers to a lookup's DNS queries, read off the resolver's
+// connections as the responses pass through. The TTL comes from the same answers the lookup
+// used, over whichever transport it went through (-dot, -proxy, -resolver), so finding it
+// takes no extra queries.
+type ttlRecorder struct {
+	sync.Mutex
+	ttl   uint32
+	found bool
+}
+
+type ttlRecorderKey struct{}
+
+// Returns a context whose lookups report their answers' TTLs to the returned recorder
+func withTTLRecorder(ctx context.Context) (context.Context, *ttlRecorder) {
+	r := new(ttlRecorder)
+	return context.WithValue(ctx, ttlRecorderKey{}, r), r
+}
+
+// Records a TTL of an answer to a lookup made with ctx. Does nothing if ctx has no recorder.
+func recordTTL(ctx context.Context, ttl uint32) {
+	r, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder)
+	if !ok {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if !r.found || ttl < r.ttl {
+		r.ttl, r.found = ttl, true
+	}
+}
+
+// Returns the lowest TTL recorded, or false if no answer had any records
+func (r *ttlRecorder) TTL() (time.Duration, bool) {
+	r.Lock()
+	defer r.Unlock()
+	return time.Duration(r.ttl) * time.Second, r.found
+}
+
+// Wraps conn so the TTLs of the DNS responses read from it are recorded for ctx's lookup.
+// Returns conn itself if ctx has no recorder.
+func recordTTLs(ctx context.Context, conn net.Conn) net.Conn {
+	if _, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder); !ok {
+		return conn
+	}
+	// the resolver uses UDP framing, one message per read, only for a net.PacketConn, so the
+	// wrapper has to be one too
+	if pc, ok := conn.(net.PacketConn); ok {
+		return &ttlPacketConn{Conn: conn, pc: pc, ctx: ctx}
+	}
+	return &ttlStreamConn{Conn: conn, ctx: ctx}
+}
+
+// Records the TTLs in a DNS response
+func recordMsgTTLs(ctx context.Context, b []byte) {
+	var m dns.Msg
+	if err := m.Unpack(b); err != nil {
+		return
+	}
+	for _, rr := range m.Answer {
+		recordTTL(ctx, rr.Header().Ttl)
+	}
+}
+
+type ttlPacketConn struct {
+	net.Conn
+	pc  net.PacketConn
+	ctx context.Context
+}
+
+func (c *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	recordMsgTTLs(c.ctx, b[:n])
+	return n, err
+}
+
+func (c *ttlPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	recordMsgTTLs(c.ctx, b[:n])
+	return n, addr, err
+}
+
+func (c *ttlPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
+
+// ttlStreamConn reads DNS over TCP (or TLS), where each message is preceded by its length
+// and may arrive over several reads
+type ttlStreamConn struct {
+	net.Conn
+	ctx context.Context
+	buf []byte
+}
+
+func (c *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf = append(c.buf, b[:n]...)
+	for len(c.buf) >= 2 {
+		size := int(c.buf[0])<<8 | int(c.buf[1])
+		if len(c.buf) < 2+size {
+			break
+		}
+		recordMsgTTLs(c.ctx, c.buf[2:2+size])
+		c.buf = c.buf[2+size:]
+	}
+	return n, err
+}
+
+// Returns how long to wait before refreshing a host again: with -inter-from-ttl, the TTL of
+// the records its last lookup returned clamped to -min-inter and -max-inter, otherwise
+// interval. interval is also used when the last lookup returned no TTL, e.g. because it failed.
+func nextInterval(last lookupResult, interval time.Duration) time.Duration {
+	if !ttlPolling {
+		return interval
+	}
+	if !last.ttlKnown {
+		return interval
+	}
+	ttl := last.ttl
+	switch {
+	case ttl < minInterval:
+		ttl = minInterval
+	case ttl > maxInterval:
+		ttl = maxInterval
+	}
+	return ttl
+}
+
+// Starts the -regen-on-ttl timer for records with ttl, which runs for at least -min-inter so
+// records with a TTL of 0 don't cause constant reactions; replaced in tests
+var ttlExpiry = func(ttl time.Duration) <-chan time.Time {
+	if ttl < minInterval {
+		ttl = minInterval
+	}
+	return time.After(ttl)
+}
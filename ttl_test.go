@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Starts a nameserver on a local UDP port that answers every A query with addr and ttl, and
+// every other query with no records
+func startNameserver(t *testing.T, addr string, ttl uint32) (string, func()) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if q := req.Question[0]; q.Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(q.Name + " " + "IN A " + addr)
+			rr.Header().Ttl = ttl
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestLookupTTLFromTheSameAnswer(t *testing.T) {
+	server, stop := startNameserver(t, "10.0.0.1", 42)
+	defer stop()
+	host := hostSpec{Name: "a.example.com", Resolver: netResolver{r: newResolver(server), rtype: typeHost}}
+
+	r := host.lookup()
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if len(r.addresses) != 1 || r.addresses[0] != "10.0.0.1" {
+		t.Errorf("addresses = %v, want [10.0.0.1]", r.addresses)
+	}
+	if !r.ttlKnown || r.ttl != 42*time.Second {
+		t.Errorf("ttl = %v (known %v), want 42s", r.ttl, r.ttlKnown)
+	}
+}
+
+func TestStreamConnRecordsSplitMessages(t *testing.T) {
+	ctx, rec := withTTLRecorder(context.Background())
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := recordTTLs(ctx, client)
+	if _, ok := conn.(net.PacketConn); ok {
+		t.Fatal("a stream connection was wrapped as a packet connection")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.com.", dns.TypeA)
+	for _, ttl := range []uint32{300, 30} {
+		rr, _ := dns.NewRR("a.example.com. IN A 10.0.0.1")
+		rr.Header().Ttl = ttl
+		m.Answer = append(m.Answer, rr)
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	framed := append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	go func() {
+		// the length and the message arrive in several pieces, the way TCP may deliver them
+		for _, part := range [][]byte{framed[:1], framed[1:7], framed[7:]} {
+			server.Write(part)
+		}
+		server.Close()
+	}()
+	buf := make([]byte, 512)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	if ttl, ok := rec.TTL(); !ok || ttl != 30*time.Second {
+		t.Errorf("TTL = %v (found %v), want the lowest, 30s", ttl, ok)
+	}
+}
+
+func TestNextInterval(t *testing.T) {
+	origPolling, origMin, origMax := ttlPolling, minInterval, maxInterval
+	defer func() { ttlPolling, minInterval, maxInterval = origPolling, origMin, origMax }()
+	ttlPolling, minInterval, maxInterval = true, 5*time.Second, time.Minute
+
+	tests := []struct {
+		last lookupResult
+		want time.Duration
+	}{
+		{lookupResult{ttl: 30 * time.Second, ttlKnown: true}, 30 * time.Second},
+		{lookupResult{ttl: time.Second, ttlKnown: true}, 5 * time.Second},
+		{lookupResult{ttl: time.Hour, ttlKnown: true}, time.Minute},
+		{lookupResult{ttl: 0, ttlKnown: true}, 5 * time.Second},
+		// a failed lookup has no TTL, so -inter is used
+		{lookupResult{}, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := nextInterval(tt.last, 10*time.Second); got != tt.want {
+			t.Errorf("nextInterval(%+v) = %v, want %v", tt.last, got, tt.want)
+		}
+	}
+}
+
+func TestFakeResolverTTL(t *testing.T) {
+	r := &fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.1"}, ttl: 7}}}
+	res := hostSpec{Name: "a", Resolver: r}.lookup()
+	if !res.ttlKnown || res.ttl != 7*time.Second {
+		t.Errorf("ttl = %v (known %v), want 7s", res.ttl, res.ttlKnown)
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	defer func(orig time.Duration) { minTTL = orig }(minTTL)
+	minTTL = 30 * time.Second
+
+	for _, tt := range []struct {
+		ttl     uint32
+		hostMin time.Duration
+		want    time.Duration
+	}{
+		// below the floor
+		{1, 0, 30 * time.Second},
+		// above it
+		{300, 0, 300 * time.Second},
+		// the host's own floor replaces -min-ttl, whether higher or lower
+		{1, 10 * time.Second, 10 * time.Second},
+		{60, 2 * time.Minute, 2 * time.Minute},
+		{300, 2 * time.Minute, 300 * time.Second},
+	} {
+		r := &fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.1"}, ttl: tt.ttl}}}
+		res := hostSpec{Name: "a", Resolver: r, MinTTL: tt.hostMin}.lookup()
+		if !res.ttlKnown || res.ttl != tt.want {
+			t.Errorf("TTL %ds with min-ttl %v was taken as %v, want %v", tt.ttl, tt.hostMin, res.ttl, tt.want)
+		}
+	}
+
+	// the fake resolver can't return a TTL of 0, so that comes from a nameserver
+	server, stop := startNameserver(t, "10.0.0.1", 0)
+	defer stop()
+	res := hostSpec{Name: "a.example.com", Resolver: netResolver{r: newResolver(server), rtype: typeHost}}.lookup()
+	if !res.ttlKnown || res.ttl != minTTL {
+		t.Errorf("TTL 0 was taken as %v (known %v), want %v", res.ttl, res.ttlKnown, minTTL)
+	}
+
+	// a failed lookup has no TTL to floor
+	r := &fakeResolver{results: []fakeResult{{err: errors.New("timeout")}}}
+	if res := (hostSpec{Name: "a", Resolver: r}).lookup(); res.ttlKnown {
+		t.Errorf("a failed lookup has TTL %v", res.ttl)
+	}
+}
+
+func TestParseHostsMinTTL(t *testing.T) {
+	hosts, err := parseHosts([]string{"a.example.com min-ttl 30s", "b.example.com", "c.example.com", "via", "10.0.0.2", "min-ttl", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []time.Duration{30 * time.Second, 0, time.Minute} {
+		if hosts[i].MinTTL != want {
+			t.Errorf("%s has min-ttl %v, want %v", hosts[i].Name, hosts[i].MinTTL, want)
+		}
+	}
+	if hosts[2].Server != "10.0.0.2" {
+		t.Errorf("c.example.com lost its via server")
+	}
+	for _, args := range [][]string{
+		{"a.example.com min-ttl"},
+		{"a.example.com min-ttl soon"},
+		{"a.example.com min-ttl -5s"},
+		{"min-ttl 5s"},
+	} {
+		if _, err := parseHosts(args); err == nil {
+			t.Errorf("%q was accepted", args)
+		}
+	}
+}
+
+// A controllable clock for -regen-on-ttl: each timer started is recorded and fires only when
+// the test says so
+type ttlClock struct {
+	mu     sync.Mutex
+	ttls   []time.Duration
+	timers []chan time.Time
+}
+
+func (c *ttlClock) after(ttl time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.ttls = append(c.ttls, ttl)
+	c.timers = append(c.timers, ch)
+	return ch
+}
+
+// Expires the most recently started timer, returning its TTL
+func (c *ttlClock) expire(t *testing.T) time.Duration {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		t.Fatal("no TTL timer was started")
+	}
+	c.timers[len(c.timers)-1] <- time.Now()
+	return c.ttls[len(c.ttls)-1]
+}
+
+func TestRegenOnTTL(t *testing.T) {
+	_, marker, restore := setupReact(t, `{{ range .Hosts }}{{ .Addresses }}{{ end }}`)
+	defer restore()
+	execOnChangeOnly = true
+	clock := &ttlClock{}
+	origExpiry, origRegen := ttlExpiry, regenOnTTL
+	ttlExpiry, regenOnTTL = clock.after, true
+	defer func() { ttlExpiry, regenOnTTL = origExpiry, origRegen }()
+
+	r := &fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.1"}, ttl: 30}}}
+	stop := startMonitors(time.Hour, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+	ev, ok := nextChange(time.Second)
+	if !ok || ev.Host != "a.example.com" {
+		t.Fatalf("first lookup reported %+v, %v", ev, ok)
+	}
+	if result := react(context.Background(), []changeEvent{ev}); result.Err() != nil || !fileExists(marker) {
+		t.Fatalf("first react = %v, ran the command: %v", result.Err(), fileExists(marker))
+	}
+	os.Remove(marker)
+	if _, ok := nextChange(50 * time.Millisecond); ok {
+		t.Fatal("reacted before the TTL expired")
+	}
+
+	if ttl := clock.expire(t); ttl != 30*time.Second {
+		t.Errorf("timer started for %v, want the record's TTL of 30s", ttl)
+	}
+	ev, ok = nextChange(time.Second)
+	if !ok {
+		t.Fatal("no react after the TTL expired")
+	}
+	if ev.Host != "" || ev.Expired != "a.example.com" {
+		t.Errorf("TTL expiry reported as %+v, want an expiry of a.example.com", ev)
+	}
+	if n := r.lookups(); n != 2 {
+		t.Errorf("%d lookups, want the expiry to look the host up again", n)
+	}
+	clock.mu.Lock()
+	if len(clock.timers) != 2 {
+		t.Errorf("%d TTL timers started, want one more for the fresh records", len(clock.timers))
+	}
+	clock.mu.Unlock()
+
+	// the output is unchanged, but the command runs anyway, -exec-on-change-only or not
+	result := react(context.Background(), []changeEvent{ev})
+	if result.Err() != nil || result.Changed {
+		t.Fatalf("react = %v, changed %v", result.Err(), result.Changed)
+	}
+	if !fileExists(marker) {
+		t.Error("the command didn't run after the TTL expired")
+	}
+}
+
+func TestRegenOnTTLCountsFromFirstSeen(t *testing.T) {
+	clock := &ttlClock{}
+	origExpiry, origRegen := ttlExpiry, regenOnTTL
+	ttlExpiry, regenOnTTL = clock.after, true
+	defer func() { ttlExpiry, regenOnTTL = origExpiry, origRegen }()
+	defer resetStore()
+
+	r := &fakeResolver{results: []fakeResult{
+		{addresses: []string{"10.0.0.1"}, ttl: 30},
+		{addresses: []string{"10.0.0.1"}, ttl: 30},
+		{addresses: []string{"10.0.0.1"}, ttl: 30},
+		{addresses: []string{"10.0.0.2"}, ttl: 20},
+	}}
+	stop := startMonitors(10*time.Millisecond, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+	for deadline := time.Now().Add(time.Second); r.lookups() < 5 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	// lookups that return the records already seen leave the timer running; new records start
+	// one of their own
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if want := []time.Duration{30 * time.Second, 20 * time.Second}; !reflect.DeepEqual(clock.ttls, want) {
+		t.Errorf("TTL timers started for %v, want %v", clock.ttls, want)
+	}
+}
+
+func TestRegenOnTTLOff(t *testing.T) {
+	clock := &ttlClock{}
+	origExpiry := ttlExpiry
+	ttlExpiry = clock.after
+	defer func() { ttlExpiry = origExpiry }()
+	defer resetStore()
+
+	r := &fakeResolver{results: []fakeResult{{addresses: []string{"10.0.0.1"}, ttl: 30}}}
+	stop := startMonitors(time.Hour, hostSpec{Name: "a.example.com", Resolver: r})
+	defer stop()
+	nextChange(time.Second)
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	if len(clock.timers) != 0 {
+		t.Errorf("started %d TTL timers without -regen-on-ttl", len(clock.timers))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	wildcardMu   sync.Mutex
+	wildcardData []string
+)
+
+// Returns the names under -wildcard that resolved on the most recent probe
+func wildcardMembers() []string {
+	wildcardMu.Lock()
+	defer wildcardMu.Unlock()
+	return wildcardData
+}
+
+// Looks up each candidate under parent and returns the sorted names that resolve to at least
+// one address. Wildcards can't be enumerated over DNS, so only the given candidates are tried.
+func probeCandidates(parent string, candidates []string) []string {
+	resolvable := []string{}
+	for _, c := range candidates {
+		name := c + "." + parent
+		if addresses, err := lookupAddrs(name); err == nil && len(addresses) > 0 {
+			resolvable = append(resolvable, name)
+		} else if debug {
+			logDebug("candidate [%s] did not resolve: %v", name, err)
+		}
+	}
+	sort.Strings(resolvable)
+	return resolvable
+}
+
+func monitorWildcard(ctx context.Context, parent string, candidates []string, interval time.Duration) {
+	defer wg.Done()
+
+	var known []string
+	ticker := time.NewTicker(interval)
+	first := time.After(startupDelay)
+
+	refresh := func() {
+		start := time.Now()
+		resolvable := probeCandidates(parent, candidates)
+		setSourceFetched()
+		if debug {
+			logDebug("probe [%s] => %v in %v", parent, resolvable, time.Since(start))
+		}
+		if !equivalent(known, resolvable) {
+			logEvent(levelChange, logFields{"host": parent, "old": known, "new": resolvable}, "%s %s -> %s", parent, known, resolvable)
+			known = resolvable
+			wildcardMu.Lock()
+			wildcardData = resolvable
+			wildcardMu.Unlock()
+			triggerReact()
+		}
+	}
+
+	for {
+		select {
+		case <-first:
+			refresh()
+		case <-ticker.C:
+			refresh()
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// Splits a comma-separated candidate list, dropping empty entries
+func parseCandidates(s string) []string {
+	var candidates []string
+	for _, c := range strings.Split(s, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			candidates = append(candidates, c)
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubNameserver answers A queries for the names it's told resolve, and NXDOMAIN for the rest
+type stubNameserver struct {
+	mu    sync.Mutex
+	names map[string]bool
+}
+
+func (s *stubNameserver) set(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = make(map[string]bool)
+	for _, name := range names {
+		s.names[dns.Fqdn(name)] = true
+	}
+}
+
+func (s *stubNameserver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	if !s.names[q.Name] {
+		m.SetRcode(req, dns.RcodeNameError)
+	} else if q.Qtype == dns.TypeA {
+		rr, _ := dns.NewRR(q.Name + " 60 IN A 10.0.0.1")
+		m.Answer = append(m.Answer, rr)
+	}
+	w.WriteMsg(m)
+}
+
+// Points the system resolver at a stub nameserver for the rest of the test
+func useStubNameserver(t *testing.T) (*stubNameserver, func()) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubNameserver{}
+	srv := &dns.Server{PacketConn: pc, Handler: stub}
+	go srv.ActivateAndServe()
+	orig := systemResolver
+	systemResolver = newResolver(pc.LocalAddr().String())
+	return stub, func() {
+		systemResolver = orig
+		srv.Shutdown()
+	}
+}
+
+func TestProbeCandidates(t *testing.T) {
+	stub, restore := useStubNameserver(t)
+	defer restore()
+	stub.set("web.svc.example.com", "api.svc.example.com")
+
+	got := probeCandidates("svc.example.com", []string{"web", "db", "api"})
+	if want := []string{"api.svc.example.com", "web.svc.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	stub.set()
+	if got := probeCandidates("svc.example.com", []string{"web", "db", "api"}); len(got) != 0 {
+		t.Errorf("got %q, want nothing to resolve", got)
+	}
+}
+
+func TestMonitorWildcardAddsMembersToTheContext(t *testing.T) {
+	defer resetStore()
+	defer func() {
+		wildcardMu.Lock()
+		wildcardData = nil
+		wildcardMu.Unlock()
+	}()
+	stub, restore := useStubNameserver(t)
+	defer restore()
+	stub.set("web.svc.example.com")
+
+	drainChanges()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go monitorWildcard(ctx, "svc.example.com", []string{"web", "db"}, 20*time.Millisecond)
+	defer wg.Wait()
+	defer cancel()
+
+	for _, want := range [][]string{
+		{"web.svc.example.com"},
+		// db starts resolving
+		{"db.svc.example.com", "web.svc.example.com"},
+		// and web stops
+		{"db.svc.example.com"},
+	} {
+		stub.set(want...)
+		if _, ok := nextChange(time.Second); !ok {
+			t.Fatalf("no react when the members became %q", want)
+		}
+		if got := snapshot().Wildcard; !reflect.DeepEqual(got, want) {
+			t.Errorf("context has members %q, want %q", got, want)
+		}
+	}
+}
+
+func TestParseCandidates(t *testing.T) {
+	if got := parseCandidates(" web, ,api,"); !reflect.DeepEqual(got, []string{"web", "api"}) {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upper bound on the delay between failed zone transfers
+const maxTransferBackoff = 5 * time.Minute
+
+var (
+	zoneMu   sync.Mutex
+	zoneData []string
+)
+
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Splits a zone@server argument, defaulting the server port to 53
+func parseAXFR(s string) (zone, server string, err error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("expected zone@server, got %q", s)
+	}
+	zone, server = dns.Fqdn(parts[0]), parts[1]
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return zone, server, nil
+}
+
+// Parses a TSIG key in the same [algorithm:]name:secret format used by dig -y
+func parseTSIG(s string) (alg, name, secret string, err error) {
+	parts := strings.Split(s, ":")
+	switch len(parts) {
+	case 2:
+		alg, name, secret = dns.HmacSHA256, parts[0], parts[1]
+	case 3:
+		var ok bool
+		if alg, ok = tsigAlgorithms[strings.ToLower(parts[0])]; !ok {
+			return "", "", "", fmt.Errorf("unsupported TSIG algorithm: %s", parts[0])
+		}
+		name, secret = parts[1], parts[2]
+	default:
+		return "", "", "", fmt.Errorf("expected [algorithm:]name:secret")
+	}
+	return alg, dns.Fqdn(name), secret, nil
+}
+
+// Transfers zone from server and returns its records in presentation format, sorted.
+// SOA records are skipped so that a serial bump alone isn't treated as a change.
+func transferZone(zone, server string, match *regexp.Regexp) ([]string, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(zone)
+	t := new(dns.Transfer)
+	if axfrTSIG != "" {
+		alg, name, secret, err := parseTSIG(axfrTSIG)
+		if err != nil {
+			return nil, err
+		}
+		m.SetTsig(name, alg, 300, time.Now().Unix())
+		t.TsigSecret = map[string]string{name: secret}
+	}
+
+	ch, err := t.In(m, server)
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		for _, rr := range env.RR {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				continue
+			}
+			if match != nil && !match.MatchString(rr.Header().Name) {
+				continue
+			}
+			records = append(records, rr.String())
+		}
+	}
+	sort.Strings(records)
+	return records, nil
+}
+
+// Returns the records from the most recent successful zone transfer
+func zoneRecords() []string {
+	zoneMu.Lock()
+	defer zoneMu.Unlock()
+	return zoneData
+}
+
+func monitorZone(ctx context.Context, zone, server string, match *regexp.Regexp, interval time.Duration) {
+	defer wg.Done()
+
+	var known []string
+	next := time.After(startupDelay)
+	backoff := interval
+
+	for {
+		select {
+		case <-next:
+			start := time.Now()
+			records, err := transferZone(zone, server, match)
+			if err != nil {
+				logError("zone transfer of %s from %s failed: %v. retrying in %v", zone, server, err, backoff)
+				next = time.After(backoff)
+				if backoff *= 2; backoff > maxTransferBackoff {
+					backoff = maxTransferBackoff
+				}
+				continue
+			}
+			backoff = interval
+			next = time.After(interval)
+			setSourceFetched()
+			if debug {
+				logDebug("transfer [%s] => %d records in %v", zone, len(records), time.Since(start))
+			}
+			if !equivalent(known, records) {
+				logChange("zone %s: %d -> %d records", zone, len(known), len(records))
+				known = records
+				zoneMu.Lock()
+				zoneData = records
+				zoneMu.Unlock()
+				triggerReact()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Starts a nameserver on a local TCP port that serves zone by AXFR with the records returned by
+// records at the time of each transfer, between the zone's SOA. With a tsig key (name:secret),
+// only signed transfers are answered.
+func startZoneServer(t *testing.T, zone, tsig string, records func() []string) (string, func()) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		if tsig != "" && (req.IsTsig() == nil || w.TsigStatus() != nil) {
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		soa, _ := dns.NewRR(zone + " 3600 IN SOA ns1." + zone + " hostmaster." + zone + " 1 3600 600 86400 300")
+		rrs := []dns.RR{soa}
+		for _, r := range records() {
+			rr, err := dns.NewRR(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rrs = append(rrs, rr)
+		}
+		rrs = append(rrs, soa)
+		ch := make(chan *dns.Envelope)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			new(dns.Transfer).Out(w, req, ch)
+		}()
+		ch <- &dns.Envelope{RR: rrs}
+		close(ch)
+		<-done
+	})}
+	if tsig != "" {
+		_, name, secret, _ := parseTSIG(tsig)
+		srv.TsigSecret = map[string]string{name: secret}
+	}
+	go srv.ActivateAndServe()
+	return l.Addr().String(), func() { srv.Shutdown() }
+}
+
+func TestTransferZone(t *testing.T) {
+	server, stop := startZoneServer(t, "example.com.", "", func() []string {
+		return []string{
+			"www.example.com. 300 IN A 10.0.0.2",
+			"api.example.com. 300 IN A 10.0.0.1",
+			"db.internal.example.com. 300 IN A 10.0.1.1",
+		}
+	})
+	defer stop()
+
+	records, err := transferZone("example.com.", server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sorted, and without the SOA
+	want := []string{
+		"api.example.com.\t300\tIN\tA\t10.0.0.1",
+		"db.internal.example.com.\t300\tIN\tA\t10.0.1.1",
+		"www.example.com.\t300\tIN\tA\t10.0.0.2",
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+
+	records, err = transferZone("example.com.", server, regexp.MustCompile(`\.internal\.`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(records, want[1:2]) {
+		t.Errorf("with -axfr-match got %q, want %q", records, want[1:2])
+	}
+}
+
+func TestTransferZoneTSIG(t *testing.T) {
+	defer func(orig string) { axfrTSIG = orig }(axfrTSIG)
+	const key = "hmac-sha256:transfer:c2VjcmV0LWtleS1mb3ItdGVzdHM="
+	server, stop := startZoneServer(t, "example.com.", key, func() []string {
+		return []string{"www.example.com. 300 IN A 10.0.0.2"}
+	})
+	defer stop()
+
+	axfrTSIG = ""
+	if _, err := transferZone("example.com.", server, nil); err == nil {
+		t.Error("an unsigned transfer succeeded")
+	}
+	axfrTSIG = key
+	records, err := transferZone("example.com.", server, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("got %q, want the zone's one record", records)
+	}
+}
+
+func TestMonitorZoneAddsRecordsToTheContext(t *testing.T) {
+	defer resetStore()
+	defer func() {
+		zoneMu.Lock()
+		zoneData = nil
+		zoneMu.Unlock()
+	}()
+	var mu sync.Mutex
+	records := []string{"www.example.com. 300 IN A 10.0.0.2"}
+	server, stop := startZoneServer(t, "example.com.", "", func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return records
+	})
+	defer stop()
+
+	drainChanges()
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(1)
+	go monitorZone(ctx, "example.com.", server, nil, 20*time.Millisecond)
+	defer wg.Wait()
+	defer cancel()
+
+	if _, ok := nextChange(time.Second); !ok {
+		t.Fatal("the transfer didn't cause a react")
+	}
+	if zone := snapshot().Zone; len(zone) != 1 || zone[0] != "www.example.com.\t300\tIN\tA\t10.0.0.2" {
+		t.Errorf("context has zone %q, want the transferred record", zone)
+	}
+
+	// a changed zone reacts again
+	mu.Lock()
+	records = append(records, "api.example.com. 300 IN A 10.0.0.1")
+	mu.Unlock()
+	if _, ok := nextChange(time.Second); !ok {
+		t.Fatal("the changed zone didn't cause a react")
+	}
+	rc := snapshot()
+	if len(rc.Zone) != 2 {
+		t.Errorf("context has zone %q, want both records", rc.Zone)
+	}
+	// and -json includes them
+	content, err := output{json: true}.render(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Zone []string `json:"zone"`
+	}
+	if err := json.Unmarshal(content, &doc); err != nil || len(doc.Zone) != 2 {
+		t.Errorf("-json output has zone %q (%v), want both records", doc.Zone, err)
+	}
+}